@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"home-cloud/models"
+	"home-cloud/service"
 	"home-cloud/utils"
 	"io/ioutil"
 	"os"
@@ -54,7 +55,16 @@ func BootStrap() {
 			panic("Please remove the config.json directory before running")
 		}
 	}
+	// fail before serving if the master key is configured but invalid
+	if utils.GetMasterKey() != nil {
+		utils.GetLogger().Info("Encryption at rest by the master key is enabled")
+	}
 	models.InitDatabase()
+	// resume the pending webhook deliveries
+	service.StartWebhookWorker()
+	// find the migrations interrupted by the last shutdown
+	service.RecoverMigrations()
+	service.StartJobWorkers()
 }
 
 func initConfigJson() {
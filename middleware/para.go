@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"net/http"
 	"strings"
 )
@@ -10,28 +11,12 @@ import (
 func ValidateDir() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		dir := c.PostForm("dir")
-		if len(dir) > 0 && strings.HasPrefix(dir, "/") && (!strings.HasSuffix(dir[1:], "/")) {
-			//filter root slash
-			path := dir[1:]
-			var paths []string
-			//not a root path
-			if len(path) > 0 {
-				pathsTmp := strings.Split(path, "/")
-				for _, p := range pathsTmp {
-					//filter invalid path
-					if len(p) < 1 || p == "." || p == ".." {
-						if c.Request.URL.Path != "/api/file/get_file" {
-							c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Path"})
-						} else {
-							c.String(http.StatusBadRequest, "400 Bad Request")
-							c.Abort()
-						}
-						return
-					} else {
-						paths = append(paths, p)
-					}
-				}
-			}
+		// GET requests are used to display files inline, e.g. in img or video tags
+		if c.Request.Method == http.MethodGet {
+			dir = c.Query("dir")
+		}
+		paths, ok := SplitDir(dir)
+		if ok {
 			c.Set("vDir", paths)
 			c.Next()
 		} else {
@@ -44,3 +29,46 @@ func ValidateDir() gin.HandlerFunc {
 		}
 	}
 }
+
+// ValidateFileID validate the file ID in the id parameter, used by the ID-based endpoints
+func ValidateFileID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.PostForm("id")
+		if c.Request.Method == http.MethodGet {
+			id = c.Query("id")
+		}
+		fileID, err := uuid.Parse(id)
+		if err != nil {
+			if c.Request.URL.Path != "/api/file/id/get_file" {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid ID"})
+			} else {
+				c.String(http.StatusBadRequest, "400 Bad Request")
+				c.Abort()
+			}
+			return
+		}
+		c.Set("vFileID", fileID)
+		c.Next()
+	}
+}
+
+// SplitDir split the absolute path into its components, ok is false if the path is invalid
+// The root path "/" has no components
+func SplitDir(dir string) (paths []string, ok bool) {
+	if len(dir) == 0 || !strings.HasPrefix(dir, "/") || strings.HasSuffix(dir[1:], "/") {
+		return nil, false
+	}
+	//filter root slash
+	path := dir[1:]
+	//not a root path
+	if len(path) > 0 {
+		for _, p := range strings.Split(path, "/") {
+			//filter invalid path
+			if len(p) < 1 || p == "." || p == ".." {
+				return nil, false
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths, true
+}
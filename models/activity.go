@@ -0,0 +1,48 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Activity a record in the activity log of the user
+type Activity struct {
+	ID uint `gorm:"primaryKey"`
+	// OwnerId the owner of the file
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;index:idx_owner_activity"`
+	// ActorId the user performing the operation
+	ActorId uuid.UUID `gorm:"type:char(36);not null"`
+	Action  string    `gorm:"type:varchar(20);not null"`
+	FileId  uuid.UUID `gorm:"type:char(36);not null;index"`
+	// Name and Position of the file when the operation happened
+	Name     string `gorm:"type:varchar(191);not null"`
+	Position string `gorm:"type:text"`
+	IsDir    int    `gorm:"default:0"`
+	ClientIP string `gorm:"type:varchar(45)"`
+	// CreatedAt is also indexed to list the recent activities
+	CreatedAt time.Time `gorm:"index:idx_owner_activity"`
+}
+
+func (activity *Activity) CreateActivity() error {
+	return DB.Create(activity).Error
+}
+
+// GetActivities return the activities of the user, newest first, and the total count
+func GetActivities(owner uuid.UUID, offset int, limit int) (activities []*Activity, total int64, err error) {
+	err = DB.Model(&Activity{}).Where(&Activity{OwnerId: owner}).Count(&total).Error
+	if err != nil {
+		return
+	}
+	err = DB.Where(&Activity{OwnerId: owner}).Order("created_at desc").Order("id desc").
+		Offset(offset).Limit(limit).Find(&activities).Error
+	return
+}
+
+// GetRecentFileIDs return the IDs of files recently uploaded, created or modified, newest first
+func GetRecentFileIDs(owner uuid.UUID, actions []string, limit int) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := DB.Model(&Activity{}).Select("file_id").
+		Where("owner_id = ? AND is_dir = ? AND action IN ?", owner, 0, actions).
+		Group("file_id").Order("MAX(id) desc").Limit(limit).Pluck("file_id", &ids).Error
+	return ids, err
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Change an entry of the change journal of the user's tree, Seq is the cursor of delta sync
+type Change struct {
+	ID      uint64    `gorm:"primaryKey;autoIncrement"`
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_owner_seq,priority:1"`
+	// Seq the sequence number of the change in the journal of the owner. Unlike ID, the changes of an owner
+	// are committed in the order of Seq, so a client never skips a change committed after a newer one
+	Seq    uint64    `gorm:"default:null;uniqueIndex:idx_owner_seq,priority:2"`
+	FileId uuid.UUID `gorm:"type:char(36);not null"`
+	// Type created, modified, moved or deleted
+	Type     string    `gorm:"type:varchar(16);not null"`
+	ParentId uuid.UUID `gorm:"type:char(36);not null"`
+	Name     string    `gorm:"type:varchar(191);not null"`
+	Position string    `gorm:"type:text"`
+	// OldPosition the position before the file is moved or renamed
+	OldPosition string `gorm:"type:text"`
+	IsDir       int    `gorm:"default:0;not null"`
+	Size        uint64 `gorm:"default:0;not null"`
+	Revision    uint64 `gorm:"default:0;not null"`
+	CreatedAt   time.Time
+}
+
+// ChangeSequence the last sequence number of the change journal of the owner
+type ChangeSequence struct {
+	OwnerId uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Seq     uint64    `gorm:"default:0;not null"`
+	// ResetSeq a change up to it is missing from the journal, the clients with an older cursor list the tree again
+	ResetSeq uint64 `gorm:"default:0;not null"`
+}
+
+// CreateChange append the change to the journal with the next sequence number of the owner
+// The sequence of the owner is locked until the change is committed
+func (change *Change) CreateChange() error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("INSERT INTO change_sequences (owner_id, seq) VALUES (?, 1) ON DUPLICATE KEY UPDATE seq = seq + 1",
+			change.OwnerId).Error
+		if err != nil {
+			return err
+		}
+		if err = tx.Model(&ChangeSequence{}).Where("owner_id = ?", change.OwnerId).
+			Select("seq").Scan(&change.Seq).Error; err != nil {
+			return err
+		}
+		return tx.Create(change).Error
+	})
+}
+
+// GetChanges return the changes of the owner after the cursor in order
+func GetChanges(owner uuid.UUID, cursor uint64, limit int) (changes []*Change, err error) {
+	err = DB.Where("owner_id = ? AND seq > ?", owner, cursor).Order("seq").Limit(limit).Find(&changes).Error
+	return
+}
+
+// ResetChanges take the next sequence number of the owner as the reset point when a change cannot be journaled
+func ResetChanges(owner uuid.UUID) error {
+	// The assignments are applied in order, reset_seq takes the increased seq
+	return DB.Exec("INSERT INTO change_sequences (owner_id, seq, reset_seq) VALUES (?, 1, 1) "+
+		"ON DUPLICATE KEY UPDATE seq = seq + 1, reset_seq = seq", owner).Error
+}
+
+// GetChangeSequence return the sequence of the owner, it is all zero if there is no change
+func GetChangeSequence(owner uuid.UUID) (*ChangeSequence, error) {
+	sequence := &ChangeSequence{OwnerId: owner}
+	err := DB.Where("owner_id = ?", owner).Limit(1).Find(sequence).Error
+	return sequence, err
+}
+
+// GetLatestChangeSeq return the sequence number of the latest change of the owner, 0 if there is no change
+// It is taken from the sequence, which also counts the reset points
+func GetLatestChangeSeq(owner uuid.UUID) (seq uint64, err error) {
+	err = DB.Model(&ChangeSequence{}).Where("owner_id = ?", owner).Select("COALESCE(MAX(seq), 0)").Scan(&seq).Error
+	return
+}
+
+// BackfillChangeSeqs number the changes journaled before the sequence numbers are introduced by their IDs,
+// so the cursors held by the clients are still valid, then start the sequences after them
+func BackfillChangeSeqs() error {
+	if err := DB.Model(&Change{}).Where("seq IS NULL").Update("seq", gorm.Expr("id")).Error; err != nil {
+		return err
+	}
+	return DB.Exec("INSERT INTO change_sequences (owner_id, seq) SELECT owner_id, MAX(seq) FROM changes GROUP BY owner_id " +
+		"ON DUPLICATE KEY UPDATE seq = GREATEST(change_sequences.seq, VALUES(seq))").Error
+}
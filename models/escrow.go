@@ -0,0 +1,37 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// EscrowKey the public key of an admin escrow key pair, the private key is only kept by the admins
+// Users can enroll to seal their file encryption key to the latest one, so the admins can reset
+// their password without losing the files
+type EscrowKey struct {
+	ID uint `gorm:"primaryKey"`
+	// PublicKey the X25519 public key in hex format
+	PublicKey string `gorm:"size:64;not null"`
+	// CreatorId the admin who created the key pair
+	CreatorId uuid.UUID `gorm:"type:char(36)"`
+	CreatedAt time.Time
+}
+
+// CreateEscrowKey save the new escrow public key
+func (key *EscrowKey) CreateEscrowKey() error {
+	return DB.Create(key).Error
+}
+
+// GetLatestEscrowKey return the escrow key new enrollments are sealed to
+func GetLatestEscrowKey() (*EscrowKey, error) {
+	var key EscrowKey
+	err := DB.Order("id desc").First(&key).Error
+	return &key, err
+}
+
+// GetEscrowKeyByID find the escrow key by ID
+func GetEscrowKeyByID(id uint) (*EscrowKey, error) {
+	var key EscrowKey
+	err := DB.First(&key, id).Error
+	return &key, err
+}
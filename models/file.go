@@ -4,9 +4,18 @@ import (
 	"errors"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"path"
+	"strings"
+	"unicode/utf8"
 )
 
+// ErrPendingDeletion the folder or one of its parents is being deleted
+var ErrPendingDeletion = errors.New("folder is being deleted")
+
+// ErrMoveIntoItself the folder is moved into itself or one of its sub folders
+var ErrMoveIntoItself = errors.New("folder moved into itself")
+
 type File struct {
 	// 表字段
 	gorm.Model
@@ -17,15 +26,36 @@ type File struct {
 	Name string `gorm:"type:varchar(191);not null;uniqueIndex:idx_only_one"`
 	// ParentId uuid.Nil for root folder
 	ParentId  uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_only_one"`
-	OwnerId   uuid.UUID `gorm:"type:char(36);not null"`
+	OwnerId   uuid.UUID `gorm:"type:char(36);not null;index:idx_owner_path,priority:1"`
 	CreatorId uuid.UUID `gorm:"type:char(36);not null"`
 	Size      uint64    `gorm:"default:0;not null"`
 	FileType  string    `gorm:"default:'other'"`
 	RealPath  string    `gorm:"not null"`
 	Favorite  int       `gorm:"default:0"`
+	// Revision increase by one every time the content of the file is changed
+	Revision uint64 `gorm:"default:0;not null"`
+	// MimeType detected from the content when uploading, or from the extension if it is unknown
+	// FileType and MimeType are encrypted like the names if the names of the owner are encrypted
+	MimeType string `gorm:"type:varchar(191);default:''"`
+	// Path The materialized position of the file, "/" for the root folder. It is kept in sync with the names
+	// of the ancestors, so positions and subtrees can be found without walking the tree
+	Path string `gorm:"type:text;index:idx_owner_path,priority:2,length:255"`
+	// DataKey the random key encrypting the content of the file, encrypted by the file encryption key DataKeyId
+	// of the owner in hex format. It is empty if the content is not encrypted or written before it was introduced
+	DataKey   string `gorm:"size:120;default:null"`
+	DataKeyId uint32 `gorm:"default:0"`
+	// Deleting 1 if the folder is being deleted in the background, it is hidden from the folder listings
+	// and nothing can be created in it or moved into or out of it
+	Deleting int `gorm:"default:0;not null"`
 
 	// Position The position of file. This field will be ignored in the database
 	Position string `gorm:"-"`
+	// Tags The tags attached to the file, only loaded when needed. This field will be ignored in the database
+	Tags []*Tag `gorm:"-"`
+	// Photo The EXIF metadata of image file, only loaded when needed. This field will be ignored in the database
+	Photo *Photo `gorm:"-"`
+	// Track The tags of audio file, only loaded when needed. This field will be ignored in the database
+	Track *Track `gorm:"-"`
 }
 
 // TraceRoot used to find the position of current file
@@ -33,6 +63,10 @@ func (file *File) TraceRoot() (err error) {
 	if len(file.Position) > 0 {
 		return nil
 	}
+	if len(file.Path) > 0 {
+		file.Position = file.Path
+		return nil
+	}
 	if file.ParentId != uuid.Nil {
 		var folder *File
 		err = DB.Where(&File{ID: file.ParentId, OwnerId: file.OwnerId}).First(&folder).Error
@@ -49,8 +83,96 @@ func (file *File) TraceRoot() (err error) {
 	}
 	return nil
 }
+
+// CreateFile save the new file, its materialized path is computed from the parent folder
+// The parent is locked until the file is created, so it is not renamed or moved with a stale path of the file
 func (file *File) CreateFile() error {
-	return DB.Create(file).Error
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if file.ParentId == uuid.Nil {
+			file.Path = "/"
+		} else {
+			parentPath, err := lockPath(tx, file.ParentId)
+			if err != nil {
+				return err
+			}
+			if err = checkPendingDeletion(tx, file.OwnerId, parentPath); err != nil {
+				return err
+			}
+			file.Path = path.Join(parentPath, file.Name)
+		}
+		return tx.Create(file).Error
+	})
+}
+
+// lockPath lock the file until the transaction ends and return its current path
+// Creating, renaming and moving lock the files, so the paths of the children are always computed from the latest ones
+func lockPath(tx *gorm.DB, fid uuid.UUID) (string, error) {
+	var locked File
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("path").Where(&File{ID: fid}).First(&locked).Error
+	return locked.Path, err
+}
+
+// checkPendingDeletion return ErrPendingDeletion if the folder at the path or one of its parents is being deleted
+func checkPendingDeletion(tx *gorm.DB, owner uuid.UUID, filePath string) error {
+	var paths []string
+	for p := filePath; p != "/" && p != "."; p = path.Dir(p) {
+		paths = append(paths, p)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	var count int64
+	err := tx.Model(&File{}).Where("owner_id = ? AND deleting = 1 AND path IN ?", owner, paths).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrPendingDeletion
+	}
+	return nil
+}
+
+// IsPendingDeletion check if the file or one of its parents is being deleted
+func (file *File) IsPendingDeletion() (bool, error) {
+	err := checkPendingDeletion(DB, file.OwnerId, file.Path)
+	if errors.Is(err, ErrPendingDeletion) {
+		return true, nil
+	}
+	return false, err
+}
+
+// MarkDeleting mark the folder as being deleted, it returns false if it has been marked
+func (file *File) MarkDeleting() (bool, error) {
+	result := DB.Model(&File{}).Where("id = ? AND deleting = 0", file.ID).Update("deleting", 1)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	file.Deleting = 1
+	return true, nil
+}
+
+// MarkDeletingIf mark the folder like MarkDeleting only if its revision and stored name are not changed,
+// it returns false if it has been marked or changed
+func (file *File) MarkDeletingIf(revision uint64, name string) (bool, error) {
+	result := DB.Model(&File{}).Where("id = ? AND deleting = 0 AND revision = ? AND name = ?", file.ID, revision, name).
+		Update("deleting", 1)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	file.Deleting = 1
+	return true, nil
+}
+
+// UnmarkDeleting show the folder again after its deletion is cancelled or failed
+func (file *File) UnmarkDeleting() error {
+	file.Deleting = 0
+	return DB.Model(&File{}).Where("id = ?", file.ID).Update("deleting", 0).Error
 }
 
 func (file *File) UpdateFile() error {
@@ -77,7 +199,7 @@ func (file *File) GetChildInFolder() ([]*File, error) {
 		return nil, err
 	}
 	var children []*File
-	err = DB.Where(&File{ParentId: file.ID, OwnerId: file.OwnerId}).Order("is_dir desc").Order("name").Find(&children).Error
+	err = DB.Where(&File{ParentId: file.ID, OwnerId: file.OwnerId}).Where("deleting = 0").Order("is_dir desc").Order("name").Find(&children).Error
 	if (err != nil) && (!errors.Is(err, gorm.ErrRecordNotFound)) {
 		return nil, err
 	}
@@ -114,6 +236,265 @@ func (file *File) DeleteFile() {
 		return
 	}
 	DB.Unscoped().Delete(file)
+	file.deleteRelated()
+}
+
+// DeleteFileIf delete the file like DeleteFile only if its revision and stored name are not changed,
+// it returns false otherwise
+func (file *File) DeleteFileIf(revision uint64, name string) (bool, error) {
+	if file.ParentId == uuid.Nil {
+		return false, nil
+	}
+	result := DB.Unscoped().Where("revision = ? AND name = ?", revision, name).Delete(file)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	file.deleteRelated()
+	return true, nil
+}
+
+// deleteRelated delete the tags, the metadata, the photo and the track of the deleted file
+func (file *File) deleteRelated() {
+	DeleteFileTags(file.ID)
+	DeleteFileMetas(file.ID)
+	if file.IsDir == 0 {
+		DeletePhoto(file.ID)
+		DeleteTrack(file.ID)
+	}
+}
+
+// GetFilesByIDs return the files of the owner with the IDs
+func GetFilesByIDs(owner uuid.UUID, ids []uuid.UUID) ([]*File, error) {
+	var files []*File
+	if len(ids) == 0 {
+		return files, nil
+	}
+	err := DB.Where(&File{OwnerId: owner}).Where("id IN ?", ids).Find(&files).Error
+	return files, err
+}
+
+// UpdateContent switch the file to the new blob realPath with its size and data key, and increase the revision
+// only if the revision is not changed. dataKey is empty if the new content is not encrypted by a data key
+// return false if the file has been modified by others
+func (file *File) UpdateContent(revision uint64, newSize uint64, realPath string, dataKey string, dataKeyID uint32) (bool, error) {
+	var dataKeyValue interface{} = dataKey
+	if dataKey == "" {
+		dataKeyValue = gorm.Expr("NULL")
+	}
+	res := DB.Model(&File{}).Where("id = ? AND revision = ?", file.ID, revision).
+		Updates(map[string]interface{}{
+			"size":        newSize,
+			"real_path":   realPath,
+			"revision":    revision + 1,
+			"data_key":    dataKeyValue,
+			"data_key_id": dataKeyID,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	return true, DB.Where(&File{ID: file.ID}).First(file).Error
+}
+
+// UpdateFileType update the type and MIME type of the file
+func (file *File) UpdateFileType(fileType string, mimeType string) error {
+	return DB.Model(file).Updates(map[string]interface{}{"file_type": fileType, "mime_type": mimeType}).Error
+}
+
+// ReplaceFileType replace the type and MIME type of the file if they are not changed by others since it is loaded
+func (file *File) ReplaceFileType(fileType string, mimeType string) error {
+	return DB.Model(&File{}).Where("id = ? AND file_type = ? AND mime_type = ?", file.ID, file.FileType, file.MimeType).
+		Updates(map[string]interface{}{"file_type": fileType, "mime_type": mimeType}).Error
+}
+
+// GetFilesByOwner return the files (not including folders) of the user in batches
+// The files are ordered by ID, pass the last ID of the previous batch to get the next batch
+func GetFilesByOwner(owner uuid.UUID, lastID uuid.UUID, limit int) ([]*File, error) {
+	var files []*File
+	err := DB.Where(&File{OwnerId: owner}).Where("is_dir = ?", 0).
+		Where("id > ?", lastID).Order("id").Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// GetFilesByDataKeyID return the files of the user whose data keys are encrypted by the file encryption key
+func GetFilesByDataKeyID(owner uuid.UUID, keyID uint32) ([]*File, error) {
+	var files []*File
+	err := DB.Select("id", "data_key", "data_key_id").Where(&File{OwnerId: owner}).
+		Where("data_key IS NOT NULL AND data_key_id = ?", keyID).Find(&files).Error
+	return files, err
+}
+
+// SetDataKey replace the data key of the file only if it is not changed since the file is loaded
+// return false if the file has been written by others
+func (file *File) SetDataKey(oldDataKey string, dataKey string, dataKeyID uint32) (bool, error) {
+	query := DB.Model(&File{}).Where("id = ?", file.ID)
+	if oldDataKey == "" {
+		query = query.Where("data_key IS NULL")
+	} else {
+		query = query.Where("data_key = ?", oldDataKey)
+	}
+	res := query.Updates(map[string]interface{}{"data_key": dataKey, "data_key_id": dataKeyID})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	file.DataKey = dataKey
+	file.DataKeyId = dataKeyID
+	return true, nil
+}
+
+// GetFileNames return the IDs, names and paths of all the files and folders of the user
+func GetFileNames(owner uuid.UUID) ([]*File, error) {
+	var files []*File
+	err := DB.Select("id", "name", "path", "parent_id", "is_dir").Where(&File{OwnerId: owner}).Find(&files).Error
+	return files, err
+}
+
+// GetFileTypes return the IDs, types and MIME types of the files (not including folders) of the user
+func GetFileTypes(owner uuid.UUID) ([]*File, error) {
+	var files []*File
+	err := DB.Select("id", "file_type", "mime_type").Where(&File{OwnerId: owner}).Where("is_dir = ?", 0).Find(&files).Error
+	return files, err
+}
+
+// CountFilesByOwner count the files (not including folders) of the user
+func CountFilesByOwner(owner uuid.UUID) (count int64, err error) {
+	err = DB.Model(&File{}).Where(&File{OwnerId: owner}).Where("is_dir = ?", 0).Count(&count).Error
+	return
+}
+
+// Rename change the name of the file or folder, the paths of its children are updated too
+func (file *File) Rename(newName string) error {
+	var newPath string
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// A folder above may be renamed or moved after the file is loaded
+		oldPath, err := lockPath(tx, file.ID)
+		if err != nil {
+			return err
+		}
+		newPath = path.Join(path.Dir(oldPath), newName)
+		if err = tx.Model(file).Updates(map[string]interface{}{"name": newName, "path": newPath}).Error; err != nil {
+			return err
+		}
+		return movePaths(tx, file, oldPath, newPath)
+	})
+	if err == nil {
+		file.Name = newName
+		file.Path = newPath
+	}
+	return err
+}
+
+// Move change the parent folder of the file, the paths of its children are updated too
+// The name is taken from the path, since Name may be replaced by the decrypted name
+func (file *File) Move(parent *File) error {
+	var newPath string
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		parentPath, err := lockPath(tx, parent.ID)
+		if err != nil {
+			return err
+		}
+		var oldPath string
+		if oldPath, err = lockPath(tx, file.ID); err != nil {
+			return err
+		}
+		// Checked again with the locked paths, the parent may be moved into the folder since it was loaded
+		if parentPath == oldPath || strings.HasPrefix(parentPath, oldPath+"/") {
+			return ErrMoveIntoItself
+		}
+		// The files listed by the delete job should not be moved out, and nothing should be moved in
+		if err = checkPendingDeletion(tx, file.OwnerId, parentPath); err != nil {
+			return err
+		}
+		if err = checkPendingDeletion(tx, file.OwnerId, oldPath); err != nil {
+			return err
+		}
+		newPath = path.Join(parentPath, path.Base(oldPath))
+		if err = tx.Model(file).Updates(map[string]interface{}{"parent_id": parent.ID, "path": newPath}).Error; err != nil {
+			return err
+		}
+		return movePaths(tx, file, oldPath, newPath)
+	})
+	if err == nil {
+		file.ParentId = parent.ID
+		file.Path = newPath
+	}
+	return err
+}
+
+// movePaths replace the path prefix of the children in the folder after the folder is renamed or moved
+func movePaths(tx *gorm.DB, folder *File, oldPath string, newPath string) error {
+	if folder.IsDir == 0 || oldPath == "" {
+		return nil
+	}
+	// SUBSTRING counts characters from 1
+	return tx.Model(&File{}).Where("owner_id = ? AND path LIKE ?", folder.OwnerId, escapeLike(oldPath)+"/%").
+		Update("path", gorm.Expr("CONCAT(?, SUBSTRING(path, ?))", newPath, utf8.RuneCountInString(oldPath)+1)).Error
+}
+
+// escapeLike escape the wildcards in the LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+// GetFileByPath find the file or folder of the owner by its materialized path
+func GetFileByPath(owner uuid.UUID, filePath string) (*File, error) {
+	var file File
+	err := DB.Where("owner_id = ? AND path = ?", owner, filePath).First(&file).Error
+	if err == nil {
+		file.Position = file.Path
+	}
+	return &file, err
+}
+
+// subtreeQuery the query of the folder and all the files and folders in it
+func subtreeQuery(folder *File) *gorm.DB {
+	query := DB.Model(&File{}).Where(&File{OwnerId: folder.OwnerId})
+	if folder.Path == "/" {
+		return query.Where("path <> ''")
+	}
+	return query.Where("path = ? OR path LIKE ?", folder.Path, escapeLike(folder.Path)+"/%")
+}
+
+// CountSubtree count the folder and all the files and folders in it
+func CountSubtree(folder *File) (count int64, err error) {
+	err = subtreeQuery(folder).Count(&count).Error
+	return
+}
+
+// GetSubtree return the folder and all the files and folders in it
+func GetSubtree(folder *File) ([]*File, error) {
+	var files []*File
+	err := subtreeQuery(folder).Order("path").Find(&files).Error
+	for _, v := range files {
+		v.Position = v.Path
+	}
+	return files, err
+}
+
+// BackfillPaths compute the materialized paths of the files saved before they are introduced
+// Each round fills the files whose parent already has the path, so it takes one query per level
+func BackfillPaths() error {
+	err := DB.Model(&File{}).Where("parent_id = ? AND (path = '' OR path IS NULL)", uuid.Nil).
+		Update("path", "/").Error
+	if err != nil {
+		return err
+	}
+	for {
+		res := DB.Exec("UPDATE files c JOIN files p ON c.parent_id = p.id " +
+			"SET c.path = CONCAT(IF(p.path = '/', '', p.path), '/', c.name) " +
+			"WHERE (c.path = '' OR c.path IS NULL) AND p.path <> ''")
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+	}
 }
 
 func (file *File) AddFavorite() error {
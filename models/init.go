@@ -80,10 +80,25 @@ func Migration() {
 	if err != nil {
 		panic("Create user data path error: " + err.Error())
 	}
-	err = DB.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(&User{}, &File{})
+	err = DB.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(
+		&User{}, &File{}, &Photo{}, &Track{}, &Activity{}, &Tag{}, &FileTag{}, &FileMeta{},
+		&Webhook{}, &WebhookDelivery{}, &Change{}, &ChangeSequence{}, &MigrationJob{}, &MigrationItem{}, &Job{}, &EscrowKey{},
+	)
 	if err != nil {
 		panic("Migrate tables error: " + err.Error())
 	}
+	if err = BackfillPaths(); err != nil {
+		panic("Backfill file paths error: " + err.Error())
+	}
+	if err = BackfillLegacyEncryption(); err != nil {
+		panic("Backfill legacy encryption error: " + err.Error())
+	}
+	if err = BackfillChangeSeqs(); err != nil {
+		panic("Backfill change sequences error: " + err.Error())
+	}
+	if err = ClearEncryptedPhotoMetadata(); err != nil {
+		panic("Clear photo metadata error: " + err.Error())
+	}
 	if !CheckAdminExist() {
 		fmt.Println("No admin user, create one......")
 		if err = InitAdminUser(); err != nil {
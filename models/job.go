@@ -0,0 +1,142 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"time"
+)
+
+// Job a persistent background job run by the workers
+type Job struct {
+	ID uint `gorm:"primaryKey"`
+	// OwnerId the user who the job belongs to
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;index"`
+	// Type the name of the handler, e.g. migration, delete or scrub
+	Type string `gorm:"type:varchar(32);not null"`
+	// Payload the parameters of the job in JSON
+	Payload string `gorm:"type:text"`
+	// Status 0 for queued, 1 for running, 2 for completed, 3 for failed, 4 for cancelled,
+	// 5 for waiting for the file encryption key of the owner
+	Status int `gorm:"type:tinyint;default:0;index"`
+	Total  int64
+	Done   int64
+	// Bytes the bytes processed
+	Bytes uint64
+	// Cancel 1 if the cancellation is requested while it is running
+	Cancel int `gorm:"type:tinyint;default:0"`
+	// Result the report of the job in JSON, e.g. the corrupted files found by a scrub
+	Result     string `gorm:"type:text"`
+	Error      string `gorm:"type:varchar(512)"`
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// CreateJob save the new job
+func (job *Job) CreateJob() error {
+	return DB.Create(job).Error
+}
+
+// UpdateJobProgress save the progress of the job without touching its status
+func (job *Job) UpdateJobProgress() error {
+	return DB.Model(job).Updates(map[string]interface{}{
+		"total": job.Total,
+		"done":  job.Done,
+		"bytes": job.Bytes,
+	}).Error
+}
+
+// UpdateJobStatus save the status, the progress and the result of the job
+func (job *Job) UpdateJobStatus() error {
+	// cancel is only set by RequestJobCancel, so the request will not be overwritten
+	return DB.Model(job).Select("status", "total", "done", "bytes", "result", "error",
+		"started_at", "finished_at").Updates(job).Error
+}
+
+// ClaimQueuedJob take the oldest queued job and mark it running
+// The status is checked when updating, so a job will only be claimed by one worker
+func ClaimQueuedJob() (*Job, error) {
+	for {
+		var job Job
+		err := DB.Where("status = ?", 0).Order("id").First(&job).Error
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		result := DB.Model(&Job{}).Where("id = ? AND status = ?", job.ID, 0).
+			Updates(map[string]interface{}{"status": 1, "started_at": now})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			job.Status = 1
+			job.StartedAt = &now
+			return &job, nil
+		}
+	}
+}
+
+// RequeueRunningJobs put the jobs interrupted by the last shutdown back to the queue
+func RequeueRunningJobs() error {
+	return DB.Model(&Job{}).Where("status = ?", 1).Update("status", 0).Error
+}
+
+// GetJobByID find the job by ID
+func GetJobByID(id uint) (*Job, error) {
+	var job Job
+	err := DB.First(&job, id).Error
+	return &job, err
+}
+
+// GetActiveJob return the latest unfinished job of the type of the user
+func GetActiveJob(uid uuid.UUID, jobType string) (*Job, error) {
+	var job Job
+	err := DB.Where("owner_id = ? AND type = ? AND status IN ?", uid, jobType, []int{0, 1, 5}).
+		Order("id desc").First(&job).Error
+	return &job, err
+}
+
+// GetWaitingJobs return the jobs of the user waiting for the file encryption key
+func GetWaitingJobs(uid uuid.UUID) (jobs []*Job, err error) {
+	err = DB.Where("owner_id = ? AND status = ?", uid, 5).Find(&jobs).Error
+	return
+}
+
+// GetJobs return the latest jobs, all users if uid is uuid.Nil
+func GetJobs(uid uuid.UUID, offset int, limit int) (jobs []*Job, total int64, err error) {
+	query := func() *gorm.DB {
+		if uid == uuid.Nil {
+			return DB.Model(&Job{})
+		}
+		return DB.Model(&Job{}).Where("owner_id = ?", uid)
+	}
+	err = query().Count(&total).Error
+	if err != nil {
+		return
+	}
+	err = query().Order("id desc").Offset(offset).Limit(limit).Find(&jobs).Error
+	return
+}
+
+// CancelPendingJob cancel the job if it is queued or waiting for the key
+func CancelPendingJob(id uint) (bool, error) {
+	result := DB.Model(&Job{}).Where("id = ? AND status IN ?", id, []int{0, 5}).
+		Updates(map[string]interface{}{"status": 4, "cancel": 1, "finished_at": time.Now()})
+	return result.RowsAffected == 1, result.Error
+}
+
+// RequestJobCancel mark the running job to be cancelled, the handler stops at the next item
+func RequestJobCancel(id uint) (bool, error) {
+	result := DB.Model(&Job{}).Where("id = ? AND status = ?", id, 1).Update("cancel", 1)
+	return result.RowsAffected == 1, result.Error
+}
+
+// IsJobCancelled check whether the cancellation of the job is requested
+func IsJobCancelled(id uint) bool {
+	var job Job
+	if err := DB.Select("cancel").First(&job, id).Error; err != nil {
+		return false
+	}
+	return job.Cancel == 1
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// FileMeta a custom property or the note of a file or folder
+type FileMeta struct {
+	ID      uint      `gorm:"primaryKey"`
+	FileId  uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_file_key"`
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;index"`
+	// Key the name of the property, empty for the note
+	Key string `gorm:"type:varchar(100);not null;uniqueIndex:idx_file_key"`
+	// Value in plain text, or encrypted with the file encryption key of the user in hex format
+	Value string `gorm:"type:text"`
+	// Encryption the algorithm used to encrypt the value, 0 for plain text
+	Encryption int `gorm:"type:tinyint;default:0"`
+	// KeyId the ID of the file encryption key used to encrypt the value
+	KeyId     uint32 `gorm:"default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SaveFileMeta create or replace the property of the file
+func (meta *FileMeta) SaveFileMeta() error {
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_id"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "encryption", "key_id", "updated_at"}),
+	}).Create(meta).Error
+}
+
+// GetFileMetas return the properties of the file ordered by key
+func GetFileMetas(fid uuid.UUID) (metas []*FileMeta, err error) {
+	err = DB.Where("file_id = ?", fid).Order("`key`").Find(&metas).Error
+	return
+}
+
+// DeleteFileMeta delete the property of the file, return false if it does not exist
+func DeleteFileMeta(fid uuid.UUID, key string) (bool, error) {
+	res := DB.Where("file_id = ? AND `key` = ?", fid, key).Delete(&FileMeta{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// DeleteFileMetas delete all properties of the file
+func DeleteFileMetas(fid uuid.UUID) {
+	DB.Where("file_id = ?", fid).Delete(&FileMeta{})
+}
+
+// GetEncryptedFileMetas return all the encrypted properties of the user, used to search in the values
+func GetEncryptedFileMetas(owner uuid.UUID) (metas []*FileMeta, err error) {
+	err = DB.Where("owner_id = ? AND encryption > ?", owner, 0).Find(&metas).Error
+	return
+}
+
+// UpdateFileMetaValue save the value encrypted by another key, it is skipped if the value is changed by others
+func (meta *FileMeta) UpdateFileMetaValue(oldValue string) (bool, error) {
+	result := DB.Model(&FileMeta{}).Where("id = ? AND value = ?", meta.ID, oldValue).
+		Updates(map[string]interface{}{"value": meta.Value, "key_id": meta.KeyId})
+	return result.RowsAffected == 1, result.Error
+}
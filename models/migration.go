@@ -0,0 +1,113 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// MigrationJob a persistent job migrating the blobs of a user to another encryption algorithm
+type MigrationJob struct {
+	ID     uint      `gorm:"primaryKey"`
+	UserId uuid.UUID `gorm:"type:char(36);not null;index"`
+	// OldAlgorithm -1 if it is unknown, e.g. the migration was interrupted before jobs were persisted
+	OldAlgorithm int `gorm:"not null"`
+	NewAlgorithm int `gorm:"not null"`
+	// Rollback 1 if the job is migrating the blobs back to the old algorithm
+	Rollback int `gorm:"type:tinyint;default:0"`
+	// Status 0 for running or waiting for the key, 1 for completed, 2 for failed, 3 for cancelled
+	Status    int    `gorm:"type:tinyint;default:0;index"`
+	Total     int    `gorm:"default:0"`
+	Done      int    `gorm:"default:0"`
+	Failed    int    `gorm:"default:0"`
+	LastError string `gorm:"type:varchar(512)"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// MigrationItem the progress of a blob in the migration job
+type MigrationItem struct {
+	ID    uint `gorm:"primaryKey"`
+	JobId uint `gorm:"not null;index:idx_job_status,priority:1"`
+	// Folder files or covers in the user data folder
+	Folder string `gorm:"type:varchar(16);not null"`
+	Name   string `gorm:"type:varchar(191);not null"`
+	// Status 0 for pending, 1 for migrated, 2 for failed
+	Status int    `gorm:"type:tinyint;default:0;index:idx_job_status,priority:2"`
+	Error  string `gorm:"type:varchar(512)"`
+}
+
+// CreateMigrationJob save the job and its items
+func CreateMigrationJob(job *MigrationJob, items []*MigrationItem) error {
+	job.Total = len(items)
+	if err := DB.Create(job).Error; err != nil {
+		return err
+	}
+	for _, item := range items {
+		item.JobId = job.ID
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	return DB.CreateInBatches(items, 500).Error
+}
+
+// UpdateMigrationJob save the progress and status of the job
+func (job *MigrationJob) UpdateMigrationJob() error {
+	return DB.Save(job).Error
+}
+
+// GetActiveMigrationJob return the latest unfinished job of the user
+func GetActiveMigrationJob(uid uuid.UUID) (*MigrationJob, error) {
+	var job MigrationJob
+	err := DB.Where("user_id = ? AND status IN ?", uid, []int{0, 2}).Order("id desc").First(&job).Error
+	return &job, err
+}
+
+// GetMigrationJobByID find the job by ID
+func GetMigrationJobByID(id uint) (*MigrationJob, error) {
+	var job MigrationJob
+	err := DB.First(&job, id).Error
+	return &job, err
+}
+
+// GetMigrationJobs return the latest jobs of all users
+func GetMigrationJobs(offset int, limit int) (jobs []*MigrationJob, total int64, err error) {
+	err = DB.Model(&MigrationJob{}).Count(&total).Error
+	if err != nil {
+		return
+	}
+	err = DB.Order("id desc").Offset(offset).Limit(limit).Find(&jobs).Error
+	return
+}
+
+// GetPendingMigrationItems return the items not migrated yet in batches
+func GetPendingMigrationItems(jobID uint, lastID uint, limit int) (items []*MigrationItem, err error) {
+	err = DB.Where("job_id = ? AND status = ? AND id > ?", jobID, 0, lastID).Order("id").Limit(limit).Find(&items).Error
+	return
+}
+
+// UpdateMigrationItem save the status of the item
+func (item *MigrationItem) UpdateMigrationItem() error {
+	return DB.Model(item).Updates(map[string]interface{}{"status": item.Status, "error": item.Error}).Error
+}
+
+// ResetMigrationItems set the items back to pending, only the failed items will be reset if all is false
+func ResetMigrationItems(jobID uint, all bool) error {
+	query := DB.Model(&MigrationItem{}).Where("job_id = ?", jobID)
+	if !all {
+		query = query.Where("status = ?", 2)
+	}
+	return query.Updates(map[string]interface{}{"status": 0, "error": ""}).Error
+}
+
+// CountMigrationItems count the items of the job in the status
+func CountMigrationItems(jobID uint, status int) (count int64, err error) {
+	err = DB.Model(&MigrationItem{}).Where("job_id = ? AND status = ?", jobID, status).Count(&count).Error
+	return
+}
+
+// GetUsersInMigration return the users whose Migration is in progress
+func GetUsersInMigration() (users []*User, err error) {
+	err = DB.Where(&User{Migration: 1}).Find(&users).Error
+	return
+}
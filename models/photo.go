@@ -0,0 +1,80 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Photo the metadata extracted from the EXIF of an image file
+type Photo struct {
+	// FileId the ID of the image file
+	FileId  uuid.UUID `gorm:"type:char(36);primaryKey"`
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;index:idx_owner_taken"`
+	// TakenAt the capture date in EXIF, or the upload time if it is missing
+	TakenAt     time.Time `gorm:"not null;index:idx_owner_taken"`
+	CameraMake  string    `gorm:"type:varchar(100)"`
+	CameraModel string    `gorm:"type:varchar(100)"`
+	// Orientation the EXIF orientation, 1 for normal
+	Orientation int `gorm:"default:1"`
+	Width       int `gorm:"default:0"`
+	Height      int `gorm:"default:0"`
+	// Latitude and Longitude are nil if the photo has no GPS information
+	Latitude  *float64
+	Longitude *float64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SavePhoto create or replace the metadata of the photo
+func (photo *Photo) SavePhoto() error {
+	return DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(photo).Error
+}
+
+// GetPhotoByFileID return the metadata of the image file
+func GetPhotoByFileID(fid uuid.UUID) (*Photo, error) {
+	var photo Photo
+	err := DB.Where(&Photo{FileId: fid}).First(&photo).Error
+	return &photo, err
+}
+
+// DeletePhoto delete the metadata of the image file
+func DeletePhoto(fid uuid.UUID) {
+	DB.Where("file_id = ?", fid).Delete(&Photo{})
+}
+
+// GetPhotoTimeline return the photos of the user ordered by capture date and the total count
+func GetPhotoTimeline(owner uuid.UUID, offset int, limit int) (photos []*Photo, total int64, err error) {
+	err = DB.Model(&Photo{}).Where(&Photo{OwnerId: owner}).Count(&total).Error
+	if err != nil {
+		return
+	}
+	err = DB.Where(&Photo{OwnerId: owner}).Order("taken_at desc").Order("file_id").
+		Offset(offset).Limit(limit).Find(&photos).Error
+	return
+}
+
+// ClearPhotoMetadata remove the location, the camera and the capture date of the photos of the user,
+// the capture date is replaced by the time the metadata was saved
+func ClearPhotoMetadata(owner uuid.UUID) error {
+	return clearPhotoMetadata(DB.Where("owner_id = ?", owner))
+}
+
+// ClearEncryptedPhotoMetadata remove the metadata above of the photos of all users enabling encryption,
+// it was saved before they enabled it
+func ClearEncryptedPhotoMetadata() error {
+	return clearPhotoMetadata(DB.Where("owner_id IN (?)", DB.Model(&User{}).Select("id").Where("encryption <> 0")))
+}
+
+func clearPhotoMetadata(query *gorm.DB) error {
+	return query.Model(&Photo{}).
+		Where("latitude IS NOT NULL OR longitude IS NOT NULL OR camera_make <> '' OR camera_model <> '' OR taken_at <> created_at").
+		Updates(map[string]interface{}{
+			"latitude":     gorm.Expr("NULL"),
+			"longitude":    gorm.Expr("NULL"),
+			"camera_make":  "",
+			"camera_model": "",
+			"taken_at":     gorm.Expr("created_at"),
+		}).Error
+}
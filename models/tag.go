@@ -0,0 +1,116 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Tag a user-defined label which can be attached to files and folders
+type Tag struct {
+	ID      uuid.UUID `gorm:"type:char(36);primaryKey"`
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_tag_name"`
+	Name    string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_tag_name"`
+	// Color in #rrggbb format
+	Color     string `gorm:"type:varchar(7);not null;default:'#808080'"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// FileTag the relation between files and tags
+type FileTag struct {
+	FileId uuid.UUID `gorm:"type:char(36);primaryKey"`
+	TagId  uuid.UUID `gorm:"type:char(36);primaryKey;index"`
+}
+
+func (tag *Tag) CreateTag() error {
+	return DB.Create(tag).Error
+}
+
+func (tag *Tag) UpdateTag() error {
+	return DB.Save(tag).Error
+}
+
+// DeleteTag delete the tag and detach it from all files
+func (tag *Tag) DeleteTag() error {
+	if err := DB.Where("tag_id = ?", tag.ID).Delete(&FileTag{}).Error; err != nil {
+		return err
+	}
+	return DB.Delete(tag).Error
+}
+
+func GetTagByID(tid uuid.UUID) (*Tag, error) {
+	var tag Tag
+	err := DB.Where(&Tag{ID: tid}).First(&tag).Error
+	return &tag, err
+}
+
+// GetTags return the tags of the user ordered by name
+func GetTags(owner uuid.UUID) (tags []*Tag, err error) {
+	err = DB.Where(&Tag{OwnerId: owner}).Order("name").Find(&tags).Error
+	return
+}
+
+// CountFilesByTag return the number of files and folders of each tag
+func CountFilesByTag(owner uuid.UUID) (map[uuid.UUID]int64, error) {
+	var rows []struct {
+		TagId uuid.UUID
+		Count int64
+	}
+	err := DB.Model(&FileTag{}).Select("file_tags.tag_id, COUNT(*) AS count").
+		Joins("JOIN tags ON tags.id = file_tags.tag_id").Where("tags.owner_id = ?", owner).
+		Group("file_tags.tag_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uuid.UUID]int64, len(rows))
+	for _, v := range rows {
+		counts[v.TagId] = v.Count
+	}
+	return counts, nil
+}
+
+// AttachTag attach the tag to the file, do nothing if it has been attached
+func AttachTag(fid uuid.UUID, tid uuid.UUID) error {
+	return DB.Where(&FileTag{FileId: fid, TagId: tid}).FirstOrCreate(&FileTag{FileId: fid, TagId: tid}).Error
+}
+
+// DetachTag detach the tag from the file
+func DetachTag(fid uuid.UUID, tid uuid.UUID) error {
+	return DB.Where("file_id = ? AND tag_id = ?", fid, tid).Delete(&FileTag{}).Error
+}
+
+// DeleteFileTags detach all tags from the file
+func DeleteFileTags(fid uuid.UUID) {
+	DB.Where("file_id = ?", fid).Delete(&FileTag{})
+}
+
+// GetTagsOfFiles return the tags attached to each file
+func GetTagsOfFiles(fids []uuid.UUID) (map[uuid.UUID][]*Tag, error) {
+	res := make(map[uuid.UUID][]*Tag)
+	if len(fids) == 0 {
+		return res, nil
+	}
+	var rows []struct {
+		FileId uuid.UUID
+		Tag
+	}
+	err := DB.Model(&FileTag{}).Select("file_tags.file_id, tags.*").
+		Joins("JOIN tags ON tags.id = file_tags.tag_id").
+		Where("file_tags.file_id IN ?", fids).Order("tags.name").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		tag := rows[i].Tag
+		res[rows[i].FileId] = append(res[rows[i].FileId], &tag)
+	}
+	return res, nil
+}
+
+// GetFilesByTag return the files and folders with the tag
+func GetFilesByTag(owner uuid.UUID, tid uuid.UUID) (files []*File, err error) {
+	err = DB.Model(&File{}).Joins("JOIN file_tags ON file_tags.file_id = files.id").
+		Where("files.owner_id = ? AND file_tags.tag_id = ?", owner, tid).
+		Order("is_dir desc").Order("name").Find(&files).Error
+	return
+}
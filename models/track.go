@@ -0,0 +1,100 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Track the information read from the tags of an audio file
+// The text tags and CoverMime are encrypted like the names if the names of the owner are encrypted
+type Track struct {
+	// FileId the ID of the audio file
+	FileId      uuid.UUID `gorm:"type:char(36);primaryKey"`
+	OwnerId     uuid.UUID `gorm:"type:char(36);not null;index:idx_owner_artist_album"`
+	Title       string    `gorm:"type:varchar(191);not null;default:''"`
+	Artist      string    `gorm:"type:varchar(191);not null;default:'';index:idx_owner_artist_album"`
+	Album       string    `gorm:"type:varchar(191);not null;default:'';index:idx_owner_artist_album"`
+	AlbumArtist string    `gorm:"type:varchar(191);not null;default:''"`
+	Year        int       `gorm:"default:0"`
+	TrackNumber int       `gorm:"default:0"`
+	// Duration unit: second
+	Duration int `gorm:"default:0"`
+	// HasCover 1 if the embedded cover art is saved in the covers folder of the user
+	HasCover  int    `gorm:"default:0"`
+	CoverMime string `gorm:"type:varchar(191);default:''"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Artist the summary of an artist in the music library
+type Artist struct {
+	Artist string
+	Albums int
+	Tracks int
+}
+
+// Album the summary of an album in the music library
+type Album struct {
+	Album  string
+	Artist string
+	Year   int
+	Tracks int
+}
+
+// SaveTrack create or replace the track
+func (track *Track) SaveTrack() error {
+	return DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(track).Error
+}
+
+// GetTrackByFileID return the track of the audio file
+func GetTrackByFileID(fid uuid.UUID) (*Track, error) {
+	var track Track
+	err := DB.Where(&Track{FileId: fid}).First(&track).Error
+	return &track, err
+}
+
+// DeleteTrack delete the track of the audio file
+func DeleteTrack(fid uuid.UUID) {
+	DB.Where("file_id = ?", fid).Delete(&Track{})
+}
+
+// GetArtists return the artists in the music library of the user
+func GetArtists(owner uuid.UUID) (artists []*Artist, err error) {
+	err = DB.Model(&Track{}).Select("artist, COUNT(DISTINCT album) AS albums, COUNT(*) AS tracks").
+		Where("owner_id = ?", owner).Group("artist").Order("artist").Scan(&artists).Error
+	return
+}
+
+// GetAlbums return the albums in the music library of the user, filtered by artist if byArtist is true
+func GetAlbums(owner uuid.UUID, artist string, byArtist bool) (albums []*Album, err error) {
+	query := DB.Model(&Track{}).Select("album, artist, MAX(year) AS year, COUNT(*) AS tracks").
+		Where("owner_id = ?", owner)
+	if byArtist {
+		query = query.Where("artist = ?", artist)
+	}
+	err = query.Group("album").Group("artist").Order("artist").Order("album").Scan(&albums).Error
+	return
+}
+
+// GetTracks return the tracks of the album, ordered by track number
+func GetTracks(owner uuid.UUID, artist string, album string) (tracks []*Track, err error) {
+	err = DB.Where("owner_id = ? AND artist = ? AND album = ?", owner, artist, album).
+		Order("track_number").Order("title").Find(&tracks).Error
+	return
+}
+
+// GetTracksByOwner return the tracks in the music library of the user
+func GetTracksByOwner(owner uuid.UUID) (tracks []*Track, err error) {
+	err = DB.Where("owner_id = ?", owner).Find(&tracks).Error
+	return
+}
+
+// ReplaceTags replace the text tags of the track if they are not changed by others since it is loaded
+func (track *Track) ReplaceTags(title string, artist string, album string, albumArtist string, coverMime string) error {
+	return DB.Model(&Track{}).
+		Where("file_id = ? AND title = ? AND artist = ? AND album = ? AND album_artist = ? AND cover_mime = ?",
+			track.FileId, track.Title, track.Artist, track.Album, track.AlbumArtist, track.CoverMime).
+		Updates(map[string]interface{}{"title": title, "artist": artist, "album": album,
+			"album_artist": albumArtist, "cover_mime": coverMime}).Error
+}
@@ -32,12 +32,36 @@ type User struct {
 	UsedStorage uint64 `gorm:"default:0;comment:'user Storage"`
 	// 0 for disable encryption, 1 for AES-256-GCM, 2 for ChaCha20-Poly1305, 3 for XChaCha20-Poly1305
 	Encryption int `gorm:"type:tinyint;default:0"`
+	// LegacyEncryption the algorithm of the blobs written before the blob format header was introduced,
+	// -1 before it is filled when starting
+	LegacyEncryption int `gorm:"type:tinyint;default:-1"`
 	// EncryptionKey AES-256-GCM encrypted key for file encryption, in hex format.
 	// The EncryptionKey was generated when user registered and is encrypted
 	// by the derived encryption key from user password
 	// First 12 byte (len:24) is the nonce in AES-256-GCM
 	// Last 48 byte (len:96) is the encrypted key
 	EncryptionKey string `gorm:"size:120;default:null"`
+	// KeyId the ID of the current file encryption key, it is recorded in the format header of the blobs
+	KeyId uint32 `gorm:"default:0"`
+	// OldEncryptionKey the previous file encryption key during key rotation, encrypted in the same way as
+	// EncryptionKey. It is destroyed when all the blobs are encrypted by the current key
+	OldEncryptionKey string `gorm:"size:120;default:null"`
+	OldKeyId         uint32 `gorm:"default:0"`
+	// RecoveryKey the file encryption key encrypted by the key derived from the one-time recovery key of the user,
+	// in the same format as EncryptionKey. The recovery key itself is only shown to the user when it is generated
+	RecoveryKey string `gorm:"size:120;default:null"`
+	// EscrowKey the file encryption key sealed to the admin escrow public key EscrowKeyId, in hex format
+	EscrowKey   string `gorm:"size:255;default:null"`
+	EscrowKeyId uint   `gorm:"default:0"`
+	// OldEscrowKey the old file encryption key sealed to the same escrow public key during key rotation
+	OldEscrowKey string `gorm:"size:255;default:null"`
+	// NameKey the random key encrypting the names of the files and folders, encrypted by the file encryption key
+	// NameKeyId in hex format. The names are not encrypted if it is empty
+	NameKey   string `gorm:"size:120;default:null"`
+	NameKeyId uint32 `gorm:"default:0"`
+	// Vault indicate that the files are end-to-end encrypted by the client, the server only keeps EncryptionKey
+	// wrapped by the client and never receives the key derived from the password
+	Vault int `gorm:"type:tinyint;default:0"`
 	// Migration indicate that user is migrating encryption algorithm
 	// if Migration is 1 or 2, will not be allowed to log in
 	// Migration 1 for migration in progress, 2 for migration error occurred
@@ -106,7 +130,7 @@ func (user *User) ChangePassword(newPass string, newAccountSalt string, newMacSa
 	user.AccountSalt = newAccountSalt
 	user.MacSalt = newMacSalt
 	user.EncryptionKey = newFileEncryptionKey
-	DB.Save(&user)
+	DB.Model(user).Select("password", "account_salt", "mac_salt", "encryption_key").Updates(user)
 }
 
 func (user *User) UpdateProfile(email string, nickName string, gender int, bio string) {
@@ -115,15 +139,30 @@ func (user *User) UpdateProfile(email string, nickName string, gender int, bio s
 	user.Nickname = nickName
 	user.Gender = gender
 	user.Bio = bio
-	DB.Save(&user)
+	DB.Model(user).Select("email", "nickname", "gender", "bio").Updates(user)
 }
 
-func (user *User) SearchFiles(keyword string) ([]*File, error) {
+// SearchFiles search files by keyword in the name or in the plain text properties
+// matchedIDs are the files matched in other ways, e.g. in the encrypted properties
+// searchName is false if the names are encrypted, the matched names should be in matchedIDs
+// If tags is not empty, only files with all the tags will be returned
+func (user *User) SearchFiles(keyword string, searchName bool, tags []uuid.UUID, matchedIDs []uuid.UUID) ([]*File, error) {
 	var files []*File
 	var err error
-	err = DB.Model(&File{}).Where(&File{OwnerId: user.ID}).
-		Where("name like ?", "%"+keyword+"%").
-		Find(&files).Error
+	condition := DB.Where("id IN (?)", DB.Model(&FileMeta{}).Select("file_id").
+		Where("owner_id = ? AND encryption = ? AND value like ?", user.ID, 0, "%"+keyword+"%"))
+	if searchName {
+		condition = condition.Or("name like ?", "%"+keyword+"%")
+	}
+	if len(matchedIDs) > 0 {
+		condition = condition.Or("id IN ?", matchedIDs)
+	}
+	query := DB.Model(&File{}).Where(&File{OwnerId: user.ID}).Where(condition)
+	if len(tags) > 0 {
+		query = query.Where("id IN (?)", DB.Model(&FileTag{}).Select("file_id").
+			Where("tag_id IN ?", tags).Group("file_id").Having("COUNT(*) = ?", len(tags)))
+	}
+	err = query.Find(&files).Error
 	if err != nil {
 		return nil, err
 	}
@@ -143,22 +182,22 @@ func (user *User) FindFavorites() ([]*File, error) {
 
 func (user *User) UpdateUsedStorage(newSize uint64) {
 	user.UsedStorage = newSize
-	DB.Save(user)
+	DB.Model(user).Update("used_storage", newSize)
 }
 
 func (user *User) SetStorageQuota(newSize uint64) {
 	user.Storage = newSize
-	DB.Save(user)
+	DB.Model(user).Update("storage", newSize)
 }
 
 func (user *User) SetAsAdmin() {
 	user.Status = 1
-	DB.Save(user)
+	DB.Model(user).Update("status", 1)
 }
 
 func (user *User) SetAsNormalUser() {
 	user.Status = 0
-	DB.Save(user)
+	DB.Model(user).Update("status", 0)
 }
 
 func (user *User) DeleteUser() {
@@ -171,6 +210,12 @@ func (user *User) GetUserList() (users []*User, err error) {
 	return
 }
 
+// GetAllUsers return all the users in the system
+func GetAllUsers() (users []*User, err error) {
+	err = DB.Order("username").Find(&users).Error
+	return
+}
+
 // GetAdminCount count admin
 func GetAdminCount() (count int64) {
 	DB.Model(&User{}).Where(&User{Status: 1}).Count(&count)
@@ -182,15 +227,177 @@ func (user *User) SetPassword(newPass string, newAccountSalt string, newMacSalt
 	user.AccountSalt = newAccountSalt
 	user.MacSalt = newMacSalt
 	user.EncryptionKey = newEncryptionKey
-	DB.Save(user)
+	DB.Model(user).Select("password", "account_salt", "mac_salt", "encryption_key").Updates(user)
 }
 
 func (user *User) SetEncryption(newEncryption int) {
 	user.Encryption = newEncryption
-	DB.Save(user)
+	DB.Model(user).Update("encryption", newEncryption)
+}
+
+// BackfillLegacyEncryption record the algorithm of the blobs without the format header
+// Blobs are always written with the header after it is introduced, so the current setting is used
+func BackfillLegacyEncryption() error {
+	return DB.Model(&User{}).Where("legacy_encryption = ?", -1).
+		Update("legacy_encryption", gorm.Expr("encryption")).Error
 }
 
 func (user *User) SetMigration(newMigration int) {
 	user.Migration = newMigration
-	DB.Save(user)
+	DB.Model(user).Update("migration", newMigration)
+}
+
+// StartMigration mark the user as migrating if no migration or key rotation is in progress
+// It returns false if another request has started one first
+func (user *User) StartMigration() (bool, error) {
+	result := DB.Model(&User{}).Where("id = ? AND migration = 0 AND old_encryption_key IS NULL", user.ID).
+		Update("migration", 1)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.Migration = 1
+	return true, nil
+}
+
+// StartKeyRotation keep the current file encryption key as the old one and replace it with the new key
+// Only the columns of the keys are updated, so a stale user object saved by others will not restore the old key.
+// The recovery key cannot encrypt the new key, so it is invalidated. The escrowed key is replaced by
+// newEscrowKey if it is not empty. It returns false if a rotation or a migration is in progress
+func (user *User) StartKeyRotation(newEncryptionKey string, newEscrowKey string) (bool, error) {
+	columns := map[string]interface{}{
+		"old_encryption_key": gorm.Expr("encryption_key"),
+		"old_key_id":         gorm.Expr("key_id"),
+		"encryption_key":     newEncryptionKey,
+		"key_id":             gorm.Expr("key_id + 1"),
+		"recovery_key":       gorm.Expr("NULL"),
+	}
+	if newEscrowKey != "" {
+		columns["old_escrow_key"] = gorm.Expr("escrow_key")
+		columns["escrow_key"] = newEscrowKey
+	}
+	result := DB.Model(&User{}).Where("id = ? AND old_encryption_key IS NULL AND migration = 0", user.ID).Updates(columns)
+	return result.RowsAffected == 1, result.Error
+}
+
+// FinishKeyRotation destroy the old file encryption key
+func (user *User) FinishKeyRotation() error {
+	user.OldEncryptionKey = ""
+	user.OldEscrowKey = ""
+	return DB.Model(user).Updates(map[string]interface{}{
+		"old_encryption_key": gorm.Expr("NULL"),
+		"old_escrow_key":     gorm.Expr("NULL"),
+	}).Error
+}
+
+// SetRecoveryKey replace the file encryption key encrypted by the recovery key, empty to remove it
+func (user *User) SetRecoveryKey(recoveryKey string) error {
+	user.RecoveryKey = recoveryKey
+	var value interface{} = recoveryKey
+	if recoveryKey == "" {
+		value = gorm.Expr("NULL")
+	}
+	return DB.Model(user).Update("recovery_key", value).Error
+}
+
+// SetEscrowKey replace the escrowed file encryption key, empty to withdraw from the escrow
+// The escrowed old key is also withdrawn, since it is sealed to the same escrow public key
+func (user *User) SetEscrowKey(escrowKey string, escrowKeyID uint) error {
+	user.EscrowKey = escrowKey
+	user.EscrowKeyId = escrowKeyID
+	user.OldEscrowKey = ""
+	var value interface{} = escrowKey
+	if escrowKey == "" {
+		value = gorm.Expr("NULL")
+	}
+	return DB.Model(user).Updates(map[string]interface{}{
+		"escrow_key":     value,
+		"escrow_key_id":  escrowKeyID,
+		"old_escrow_key": gorm.Expr("NULL"),
+	}).Error
+}
+
+// RecoverPassword set the new password and the file encryption keys encrypted by it
+// newOldEncryptionKey is only used during key rotation. The keys are only replaced if they are not rotated
+// since the user is loaded, it returns false otherwise
+// usedRecoveryKey is the recovery key the keys are recovered by, it is cleared in the same update, and nothing
+// is replaced if it has been used or replaced by others
+func (user *User) RecoverPassword(newPass string, newAccountSalt string, newMacSalt string,
+	newEncryptionKey string, newOldEncryptionKey string, usedRecoveryKey string) (bool, error) {
+	columns := map[string]interface{}{
+		"password":       newPass,
+		"account_salt":   newAccountSalt,
+		"mac_salt":       newMacSalt,
+		"encryption_key": newEncryptionKey,
+	}
+	query := DB.Model(&User{}).Where("id = ? AND key_id = ?", user.ID, user.KeyId)
+	if newOldEncryptionKey != "" {
+		columns["old_encryption_key"] = newOldEncryptionKey
+		query = query.Where("old_encryption_key IS NOT NULL")
+	} else {
+		query = query.Where("old_encryption_key IS NULL")
+	}
+	if usedRecoveryKey != "" {
+		columns["recovery_key"] = gorm.Expr("NULL")
+		query = query.Where("recovery_key = ?", usedRecoveryKey)
+	}
+	result := query.Updates(columns)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false, result.Error
+	}
+	utils.GetLogger().Warn("Recover password for " + user.Username)
+	user.Password = newPass
+	user.AccountSalt = newAccountSalt
+	user.MacSalt = newMacSalt
+	user.EncryptionKey = newEncryptionKey
+	user.OldEncryptionKey = newOldEncryptionKey
+	if usedRecoveryKey != "" {
+		user.RecoveryKey = ""
+	}
+	return true, nil
+}
+
+// EnableVault switch the user to the vault mode, the copies of the file encryption key kept for the recovery
+// and the escrow are destroyed. It returns false if the key is being rotated or migrated, or the names are encrypted
+func (user *User) EnableVault() (bool, error) {
+	result := DB.Model(&User{}).
+		Where("id = ? AND vault = 0 AND old_encryption_key IS NULL AND migration = 0 AND name_key IS NULL", user.ID).
+		Updates(map[string]interface{}{
+			"vault":          1,
+			"recovery_key":   gorm.Expr("NULL"),
+			"escrow_key":     gorm.Expr("NULL"),
+			"escrow_key_id":  0,
+			"old_escrow_key": gorm.Expr("NULL"),
+		})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false, result.Error
+	}
+	user.Vault = 1
+	user.RecoveryKey = ""
+	user.EscrowKey = ""
+	user.EscrowKeyId = 0
+	user.OldEscrowKey = ""
+	return true, nil
+}
+
+// EnableNameEncryption save the name key encrypted by the current file encryption key nameKeyID,
+// it returns false if the names are encrypted already or the key is being rotated
+func (user *User) EnableNameEncryption(nameKey string, nameKeyID uint32) (bool, error) {
+	result := DB.Model(&User{}).
+		Where("id = ? AND name_key IS NULL AND key_id = ? AND old_encryption_key IS NULL", user.ID, nameKeyID).
+		Updates(map[string]interface{}{"name_key": nameKey, "name_key_id": nameKeyID})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false, result.Error
+	}
+	user.NameKey = nameKey
+	user.NameKeyId = nameKeyID
+	return true, nil
+}
+
+// UpdateNameKey replace the name key encrypted by another file encryption key, e.g. during key rotation
+func (user *User) UpdateNameKey(oldNameKey string, nameKey string, nameKeyID uint32) error {
+	return DB.Model(&User{}).Where("id = ? AND name_key = ?", user.ID, oldNameKey).
+		Updates(map[string]interface{}{"name_key": nameKey, "name_key_id": nameKeyID}).Error
 }
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Webhook an outgoing webhook subscription
+type Webhook struct {
+	ID uuid.UUID `gorm:"type:char(36);primaryKey"`
+	// OwnerId the user who created the webhook
+	OwnerId uuid.UUID `gorm:"type:char(36);not null;index"`
+	// Admin 1 for admin-level webhook, which receives the events of all users
+	Admin int    `gorm:"type:tinyint;default:0"`
+	URL   string `gorm:"type:varchar(2048);not null"`
+	// Secret the key of HMAC-SHA256 signature in hex format
+	Secret string `gorm:"size:64;not null"`
+	// Events the subscribed events separated by comma, * for all events
+	Events    string `gorm:"type:varchar(512);not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WebhookDelivery a delivery of an event to a webhook, pending deliveries are the persistent queue
+type WebhookDelivery struct {
+	ID        uint      `gorm:"primaryKey"`
+	WebhookId uuid.UUID `gorm:"type:char(36);not null;index"`
+	Event     string    `gorm:"type:varchar(50);not null"`
+	Payload   string    `gorm:"type:mediumtext"`
+	// Status 0 for pending, 1 for delivered, 2 for failed after all retries
+	Status   int `gorm:"type:tinyint;default:0;index:idx_pending"`
+	Attempts int `gorm:"default:0"`
+	// NextAttemptAt the time of the next retry for pending deliveries
+	NextAttemptAt  time.Time `gorm:"index:idx_pending"`
+	LastStatusCode int       `gorm:"default:0"`
+	LastError      string    `gorm:"type:varchar(512)"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// CreateWebhook save a new webhook
+func (webhook *Webhook) CreateWebhook() error {
+	return DB.Create(webhook).Error
+}
+
+// DeleteWebhook delete the webhook and its deliveries
+func (webhook *Webhook) DeleteWebhook() error {
+	if err := DB.Where("webhook_id = ?", webhook.ID).Delete(&WebhookDelivery{}).Error; err != nil {
+		return err
+	}
+	return DB.Delete(webhook).Error
+}
+
+// GetWebhookByID find the webhook by ID
+func GetWebhookByID(wid uuid.UUID) (*Webhook, error) {
+	var webhook Webhook
+	err := DB.Where(&Webhook{ID: wid}).First(&webhook).Error
+	return &webhook, err
+}
+
+// GetWebhooks return the user webhooks of the owner, or all admin-level webhooks if admin is true
+func GetWebhooks(owner uuid.UUID, admin bool) (webhooks []*Webhook, err error) {
+	if admin {
+		err = DB.Where("admin = ?", 1).Order("created_at").Find(&webhooks).Error
+	} else {
+		err = DB.Where("owner_id = ? AND admin = ?", owner, 0).Order("created_at").Find(&webhooks).Error
+	}
+	return
+}
+
+// GetEventWebhooks return the webhooks of the owner and all the admin-level webhooks
+// If owner is uuid.Nil, only admin-level webhooks will be returned
+func GetEventWebhooks(owner uuid.UUID) (webhooks []*Webhook, err error) {
+	err = DB.Where("admin = ?", 1).Or("owner_id = ? AND admin = ?", owner, 0).Find(&webhooks).Error
+	return
+}
+
+// CreateDelivery queue a new delivery
+func (delivery *WebhookDelivery) CreateDelivery() error {
+	return DB.Create(delivery).Error
+}
+
+// UpdateDelivery save the status of the delivery after an attempt
+func (delivery *WebhookDelivery) UpdateDelivery() error {
+	return DB.Save(delivery).Error
+}
+
+// GetDueDeliveries return the pending deliveries which should be sent now in the order they are queued,
+// except those of the excluded webhooks
+// A delivery waiting for a retry holds back the later deliveries of its webhook, so the events arrive in order
+func GetDueDeliveries(exclude []uuid.UUID, limit int) (deliveries []*WebhookDelivery, err error) {
+	now := time.Now()
+	query := DB.Where("status = ? AND next_attempt_at <= ?", 0, now).
+		Where("NOT EXISTS (SELECT 1 FROM webhook_deliveries AS earlier WHERE earlier.webhook_id = webhook_deliveries.webhook_id "+
+			"AND earlier.status = ? AND earlier.id < webhook_deliveries.id AND earlier.next_attempt_at > ?)", 0, now)
+	if len(exclude) > 0 {
+		query = query.Where("webhook_id NOT IN ?", exclude)
+	}
+	err = query.Order("id").Limit(limit).Find(&deliveries).Error
+	return
+}
+
+// GetDeliveries return the deliveries of the webhook, newest first, and the total count
+func GetDeliveries(wid uuid.UUID, offset int, limit int) (deliveries []*WebhookDelivery, total int64, err error) {
+	err = DB.Model(&WebhookDelivery{}).Where("webhook_id = ?", wid).Count(&total).Error
+	if err != nil {
+		return
+	}
+	err = DB.Where("webhook_id = ?", wid).Order("id desc").Offset(offset).Limit(limit).Find(&deliveries).Error
+	return
+}
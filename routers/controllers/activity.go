@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strconv"
+)
+
+// GetActivities get the activity feed of the user
+func GetActivities(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page"})
+		return
+	}
+	var pageSize int
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page Size"})
+		return
+	}
+	activities, total, err := service.GetActivities(user, page, pageSize, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resActivities := make([]gin.H, len(activities))
+	for i, v := range activities {
+		resActivities[i] = gin.H{
+			"Action":    v.Action,
+			"FileId":    v.FileId,
+			"Name":      v.Name,
+			"Position":  v.Position,
+			"IsDir":     v.IsDir,
+			"ActorId":   service.GetUserNameByID(v.ActorId),
+			"ClientIP":  v.ClientIP,
+			"CreatedAt": v.CreatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "total": total, "page": page, "page_size": pageSize, "activities": resActivities})
+}
+
+// GetRecentFiles get the files recently uploaded, created or modified
+func GetRecentFiles(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Limit"})
+		return
+	}
+	files, err := service.GetRecentFiles(user, limit, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resFileInfo := make([]gin.H, len(files))
+	for i, v := range files {
+		resFileInfo[i] = gin.H{
+			"ID":        v.ID,
+			"Name":      v.Name,
+			"Position":  v.Position,
+			"IsDir":     v.IsDir,
+			"Size":      v.Size,
+			"FileType":  v.FileType,
+			"UpdatedAt": v.UpdatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "recent": resFileInfo})
+}
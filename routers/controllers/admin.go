@@ -133,11 +133,15 @@ func ResetUserPassword(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Please input username"})
 		return
 	}
-	res, err := service.ResetUserPassword(resetUser)
+	// The private key of the admin escrow, only needed for the users enabling encryption
+	escrowPrivateKey := c.PostForm("escrow_private_key")
+	res, err := service.ResetUserPassword(resetUser, escrowPrivateKey)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
 			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
 		} else if errors.Is(err, service.ErrSystem) {
 			status = http.StatusInternalServerError
 		} else {
@@ -148,3 +152,163 @@ func ResetUserPassword(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"success": 0, "result": res})
 	}
 }
+
+// GetEscrowKey get the latest admin escrow public key
+func GetEscrowKey(c *gin.Context) {
+	key, err := service.GetEscrowKey()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "result": key})
+}
+
+// NewEscrowKey create a new admin escrow key pair, a key pair is generated if the public key is not provided
+// The generated private key is only returned once
+func NewEscrowKey(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	publicKey := c.PostForm("public_key")
+	key, privateKey, err := service.CreateEscrowKey(user, publicKey)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "result": key, "private_key": privateKey})
+}
+
+// EncryptAtRest encrypt the existing plain blobs of all users by the master key in the background
+func EncryptAtRest(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	job, err := service.EncryptAtRest(user)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
+}
+
+// BackfillFileTypes detect the types of existing files in the background
+// The progress can be found by /api/job/get
+func BackfillFileTypes(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	job, err := service.BackfillFileTypes(user)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
+}
+
+// GetMigrationJobs get the encryption algorithm migration jobs of all users
+func GetMigrationJobs(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page"})
+		return
+	}
+	var pageSize int
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page Size"})
+		return
+	}
+	jobs, total, err := service.GetMigrationJobs(page, pageSize)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resJobs := make([]gin.H, len(jobs))
+	for i, v := range jobs {
+		var status string
+		switch v.Status {
+		case 0:
+			status = "running"
+		case 1:
+			status = "completed"
+		default:
+			status = "failed"
+		}
+		if v.Status == 0 && service.IsMigrationWaitingLogin(v.UserId) {
+			// Recovered after a restart, the key of the user is needed to continue
+			status = "waiting_login"
+		}
+		resJobs[i] = gin.H{
+			"ID":           v.ID,
+			"User":         service.GetUserNameByID(v.UserId),
+			"OldAlgorithm": v.OldAlgorithm,
+			"NewAlgorithm": v.NewAlgorithm,
+			"Rollback":     v.Rollback == 1,
+			"Status":       status,
+			"Total":        v.Total,
+			"Done":         v.Done,
+			"Failed":       v.Failed,
+			"LastError":    v.LastError,
+			"CreatedAt":    v.CreatedAt,
+			"UpdatedAt":    v.UpdatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "jobs": resJobs, "total": total})
+}
+
+// RetryMigration retry the failed blobs of a failed migration, it continues when the user logs in
+func RetryMigration(c *gin.Context) {
+	migrationUser := c.PostForm("migration_user")
+	if migrationUser == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Please input username"})
+		return
+	}
+	handleMigrationAction(c, service.RetryMigration(migrationUser))
+}
+
+// RollbackMigration migrate the blobs of a failed migration back to the old algorithm when the user logs in
+func RollbackMigration(c *gin.Context) {
+	migrationUser := c.PostForm("migration_user")
+	if migrationUser == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Please input username"})
+		return
+	}
+	handleMigrationAction(c, service.RollbackMigration(migrationUser))
+}
+
+// handleMigrationAction write the response of the admin actions on a migration
+func handleMigrationAction(c *gin.Context, err error) {
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
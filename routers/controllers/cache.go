@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"home-cloud/service"
+	"net/http"
+	"time"
+)
+
+// checkNotModified set the validators of the response and write 304 Not Modified if the client has the same version
+// If-None-Match takes precedence over If-Modified-Since, modified is ignored if it is zero
+// For methods other than GET and HEAD, a matching If-None-Match is answered with 412 Precondition Failed instead
+func checkNotModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	// private data, the client must revalidate before using the cache
+	c.Header("Cache-Control", "private, no-cache")
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	notModified := false
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		notModified = service.MatchETag(inm, etag, true)
+		if notModified && c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"success": 1, "message": GetErrorMessage(service.ErrPrecondition)})
+			return true
+		}
+	} else if ims := c.GetHeader("If-Modified-Since"); ims != "" && !modified.IsZero() && c.Request.Method == http.MethodGet {
+		if t, err := http.ParseTime(ims); err == nil {
+			notModified = !modified.Truncate(time.Second).After(t)
+		}
+	}
+	if notModified {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+	}
+	return notModified
+}
+
+// checkIfMatch write 412 Precondition Failed if the If-Match header does not match the entity tag
+func checkIfMatch(c *gin.Context, etag string) bool {
+	if im := c.GetHeader("If-Match"); im != "" && !service.MatchETag(im, etag, false) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"success": 1, "message": GetErrorMessage(service.ErrPrecondition)})
+		return false
+	}
+	return true
+}
+
+// jsonWithETag write the JSON response with a weak entity tag of the body, or 304 Not Modified if it is not changed
+func jsonWithETag(c *gin.Context, obj interface{}) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(service.ErrSystem)})
+		return
+	}
+	sum := sha256.Sum256(body)
+	if checkNotModified(c, `W/"`+hex.EncodeToString(sum[:16])+`"`, time.Time{}) {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
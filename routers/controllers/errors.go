@@ -26,6 +26,20 @@ func GetErrorMessage(err error) (res string) {
 		res = "You need at least one admin user"
 	case service.ErrResetForbidden:
 		res = "Cannot reset password for users enabling encryption"
+	case service.ErrModified:
+		res = "The file has been modified by others, please reload it"
+	case service.ErrInProgress:
+		res = "The task is in progress, please try again later"
+	case service.ErrSkipped:
+		res = "The file already exists and has been skipped"
+	case service.ErrPrecondition:
+		res = "The file does not match the version you have, please reload it"
+	case service.ErrVault:
+		res = "The file is end-to-end encrypted and can only be read by your client"
+	case service.ErrDeleting:
+		res = "The folder is being deleted"
+	case service.ErrResync:
+		res = "Some changes are missing, please list all the files again"
 	}
 	return
 }
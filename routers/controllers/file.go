@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"home-cloud/middleware"
 	"home-cloud/models"
 	"home-cloud/service"
 	"home-cloud/utils"
-	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +20,7 @@ func UploadFiles(c *gin.Context) {
 	form, err := c.MultipartForm()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Request"})
+		return
 	}
 	user := c.Value("user").(*models.User)
 
@@ -25,7 +28,7 @@ func UploadFiles(c *gin.Context) {
 	vDir := c.Value("vDir").([]string)
 
 	var folder *models.File
-	folder, err = service.GetFileOrFolderInfoByPath(vDir, user)
+	folder, err = service.GetFileOrFolderInfoByPath(vDir, user, c)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -39,22 +42,78 @@ func UploadFiles(c *gin.Context) {
 		return
 	}
 
+	// The policy when the name exists: overwrite, rename (keep both), skip or fail
+	conflict := c.DefaultPostForm("conflict", service.ConflictOverwrite)
+	if conflict != service.ConflictOverwrite && conflict != service.ConflictRename &&
+		conflict != service.ConflictSkip && conflict != service.ConflictFail {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Conflict Policy"})
+		return
+	}
+	// If-Match is only allowed when overwriting a single file
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" && (len(files) != 1 || conflict != service.ConflictOverwrite) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "If-Match requires overwriting a single file"})
+		return
+	}
+	// The relative path of each part for folder uploads, e.g. webkitRelativePath
+	paths := form.Value["path"]
+	if len(paths) > 0 && len(paths) != len(files) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Path"})
+		return
+	}
+	// The data key of each part wrapped by the client in the vault mode, the parts are encrypted by the client
+	dataKeys := form.Value["data_key"]
+	if (user.Vault == 1 || len(dataKeys) > 0) && len(dataKeys) != len(files) {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Data Key"})
+		return
+	}
+	// The folders of the relative paths which have been resolved or created
+	folders := map[string]*models.File{"": folder}
 	res := make(map[string]interface{})
-	for _, file := range files {
+	for i, file := range files {
+		// The result is keyed by the relative path in folder uploads
+		key := file.Filename
+		target := folder
+		if len(paths) > 0 {
+			var ok bool
+			key = paths[i]
+			if target, ok = getUploadFolder(c, folders, key, file, user, res); !ok {
+				continue
+			}
+		}
 		if len(file.Filename) == 0 || strings.ContainsAny(file.Filename, "/?*|<>:\\") {
-			res[file.Filename] = gin.H{
+			res[key] = gin.H{
 				"result":  false,
 				"message": "Invalid File Name",
 			}
 		} else {
-			if err = service.UploadFile(file, user, folder, c); err != nil {
-				res[file.Filename] = gin.H{
+			var stored *models.File
+			dataKey := ""
+			if len(dataKeys) > 0 {
+				dataKey = dataKeys[i]
+			}
+			stored, err = service.UploadFile(file, user, target, conflict, ifMatch, dataKey, c)
+			if errors.Is(err, service.ErrPrecondition) {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"success": 1, "message": GetErrorMessage(err)})
+				return
+			}
+			if errors.Is(err, service.ErrSkipped) {
+				res[key] = gin.H{
+					"result":  true,
+					"skipped": true,
+					"name":    stored.Name,
+					"id":      stored.ID,
+				}
+			} else if err != nil {
+				res[key] = gin.H{
 					"result":  false,
 					"message": GetErrorMessage(err),
 				}
 			} else {
-				res[file.Filename] = gin.H{
+				res[key] = gin.H{
 					"result": true,
+					"name":   stored.Name,
+					"id":     stored.ID,
 				}
 			}
 		}
@@ -66,12 +125,59 @@ func UploadFiles(c *gin.Context) {
 	})
 }
 
+// getUploadFolder resolve the folder of the relative path of the uploaded part, the missing folders will be created
+// The name of the part will be replaced by the last component of the path
+func getUploadFolder(c *gin.Context, folders map[string]*models.File, relativePath string, file *multipart.FileHeader,
+	user *models.User, res map[string]interface{}) (*models.File, bool) {
+	// The same rules as the dir parameter
+	names, ok := middleware.SplitDir("/" + relativePath)
+	if !ok || len(names) == 0 {
+		res[relativePath] = gin.H{
+			"result":  false,
+			"message": "Invalid Path",
+		}
+		return nil, false
+	}
+	for _, name := range names {
+		if strings.ContainsAny(name, "/?*|<>:\\") {
+			res[relativePath] = gin.H{
+				"result":  false,
+				"message": "Invalid Path",
+			}
+			return nil, false
+		}
+	}
+	file.Filename = names[len(names)-1]
+	dir := strings.Join(names[:len(names)-1], "/")
+	folder, ok := folders[dir]
+	if !ok {
+		var err error
+		folder, err = service.MakeFolders(folders[""], user, names[:len(names)-1], c)
+		if err != nil {
+			res[relativePath] = gin.H{
+				"result":  false,
+				"message": GetErrorMessage(err),
+			}
+			return nil, false
+		}
+		folders[dir] = folder
+	}
+	return folder, true
+}
+
+// getRequestFile find the file or folder by the id parameter in the ID-based endpoints, or by the dir parameter
+func getRequestFile(c *gin.Context, user *models.User) (*models.File, error) {
+	if fileID, ok := c.Value("vFileID").(uuid.UUID); ok {
+		return service.GetFileOrFolderInfoByID(fileID, user, c)
+	}
+	return service.GetFileOrFolderInfoByPath(c.Value("vDir").([]string), user, c)
+}
+
 // GetFolder get children list in the folder
 func GetFolder(c *gin.Context) {
 	user := c.Value("user").(*models.User)
-	vDir := c.Value("vDir").([]string)
 
-	folder, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	folder, err := getRequestFile(c, user)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -86,7 +192,10 @@ func GetFolder(c *gin.Context) {
 	}
 	var files []*models.File
 
-	files, err = service.GetFolder(folder, user)
+	files, err = service.GetFolder(folder, user, c)
+	if err == nil {
+		err = service.LoadTags(files...)
+	}
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -101,19 +210,24 @@ func GetFolder(c *gin.Context) {
 		var resFiles = make([]gin.H, len(files))
 		for i, v := range files {
 			resFiles[i] = gin.H{
+				"ID":        v.ID,
 				"Name":      v.Name,
 				"IsDir":     v.IsDir,
 				"Position":  v.Position,
 				"Size":      v.Size,
 				"FileType":  v.FileType,
+				"MimeType":  v.MimeType,
 				"UpdatedAt": v.UpdatedAt,
 				"CreatedAt": v.CreatedAt,
 				"CreatorId": service.GetUserNameByID(v.CreatorId),
 				"OwnerId":   service.GetUserNameByID(v.OwnerId),
 				"Favorite":  v.Favorite,
+				"Revision":  v.Revision,
+				"ETag":      service.FileETag(v, ""),
+				"Tags":      getTagsInfo(v.Tags),
 			}
 		}
-		c.JSON(http.StatusOK, gin.H{"success": 0, "children": resFiles})
+		jsonWithETag(c, gin.H{"success": 0, "children": resFiles})
 	}
 }
 
@@ -122,7 +236,7 @@ func NewFileOrFolder(c *gin.Context) {
 	user := c.Value("user").(*models.User)
 	vDir := c.Value("vDir").([]string)
 
-	folder, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	folder, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -145,21 +259,164 @@ func NewFileOrFolder(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Name"})
 		return
 	}
-	err = service.NewFileOrFolder(folder, user, newName, t, c)
+	var file *models.File
+	file, err = service.NewFileOrFolder(folder, user, newName, t, c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": GetErrorMessage(err)})
 	} else {
-		c.JSON(http.StatusOK, gin.H{"success": 0})
+		c.JSON(http.StatusOK, gin.H{"success": 0, "ID": file.ID})
+	}
+}
+
+// RenameFile change the name of a file or folder
+func RenameFile(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	newName := c.PostForm("name")
+	if len(newName) == 0 || strings.ContainsAny(newName, "/?*|<>:\\") {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Name"})
+		return
+	}
+	err = service.RenameFile(file, user, newName, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrDeleting) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0, "ID": file.ID, "Position": file.Position})
+	}
+}
+
+// MoveFile move the file or folder into the folder in the to parameter
+func MoveFile(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	toDir, ok := middleware.SplitDir(c.PostForm("to"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Path"})
+		return
+	}
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	var folder *models.File
+	if err == nil {
+		folder, err = service.GetFileOrFolderInfoByPath(toDir, user, c)
+	}
+	if err == nil {
+		err = service.MoveFile(file, folder, user, c)
+	}
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrDuplicate) || errors.Is(err, service.ErrDeleting) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrSystem) || errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0, "ID": file.ID, "Position": file.Position})
+	}
+}
+
+// SaveFileContent save the new content of a text or markdown file
+func SaveFileContent(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	content, ok := c.GetPostForm("content")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Please input content"})
+		return
+	}
+	if !checkIfMatch(c, service.FileETag(file, "")) {
+		return
+	}
+	var revision uint64
+	revision, err = strconv.ParseUint(c.PostForm("revision"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Revision"})
+		return
+	}
+	err = service.SaveFileContent(file, user, []byte(content), revision, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrModified) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrSystem) || errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"success":   0,
+			"Size":      file.Size,
+			"Revision":  file.Revision,
+			"ETag":      service.FileETag(file, ""),
+			"UpdatedAt": file.UpdatedAt,
+		})
 	}
 }
 
+// previewCSP forbid scripts, forms and plugins in uploaded files (e.g. HTML or SVG) displayed inline
+const previewCSP = "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+// pdfPreviewCSP is used for PDF files since the browser PDF viewer will not work in sandbox
+const pdfPreviewCSP = "default-src 'none'; object-src 'self'; style-src 'unsafe-inline'"
+
 // GetFile download a file
+// If mode is view, the file will be displayed inline in the browser
 func GetFile(c *gin.Context) {
 	//This will only return error page in plain text because it may not be processed by axios
 	user := c.Value("user").(*models.User)
-	vDir := c.Value("vDir").([]string)
+	mode := c.PostForm("mode")
+	if c.Request.Method == http.MethodGet {
+		mode = c.Query("mode")
+	}
 
-	file, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	file, err := getRequestFile(c, user)
 	if err != nil {
 		if errors.Is(err, service.ErrInvalidOrPermission) {
 			c.String(http.StatusNotFound, "404 Not Found")
@@ -181,45 +438,143 @@ func GetFile(c *gin.Context) {
 		}
 		return
 	}
-	var f []byte
-	if user.Encryption == 0 {
-		f, err = ioutil.ReadFile(dst)
+	// The rendered preview is a different representation of the same content
+	variant := ""
+	if mode == "view" {
+		variant = mode
+	}
+	if checkNotModified(c, service.FileETag(file, variant), file.UpdatedAt) {
+		return
+	}
+	// The blob may be written before the encryption setting is changed, so it is always decided by its header
+	f, err := service.GetFileEncrypted(dst, file, user, c)
+	if errors.Is(err, service.ErrVault) {
+		// The client downloads the blob and decrypts it
+		c.String(http.StatusConflict, "409 Conflict")
+		return
+	}
+	if err != nil {
+		utils.GetLogger().Errorf("Error when finding and decrypting %s for %s", dst, file.Position)
+		c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		return
+	}
+	disposition := "attachment"
+	contentType := utils.GetMimeTypeByName(filename, file.FileType, file.MimeType)
+	if mode == "view" {
+		contentType, f, err = service.GetFilePreview(file, f)
 		if err != nil {
-			utils.GetLogger().Errorf("Error when finding %s for %s", dst, file.Position)
+			utils.GetLogger().Errorf("Error when rendering preview for %s", file.Position)
 			c.String(http.StatusInternalServerError, "500 Internal Server Error")
 			return
 		}
-	} else {
-		if user.Encryption < 0 || user.Encryption > 3 {
-			c.String(http.StatusBadRequest, "400 Bad Request")
-			return
+		if contentType != "application/octet-stream" {
+			disposition = "inline"
 		}
-		f, err = service.GetFileEncrypted(dst, user, c)
-		if err != nil {
-			utils.GetLogger().Errorf("Error when finding and decrypting %s for %s", dst, file.Position)
-			c.String(http.StatusInternalServerError, "500 Internal Server Error")
-			return
+		if contentType == "application/pdf" {
+			// The sandbox directive will block the PDF viewer in some browsers
+			c.Header("Content-Security-Policy", pdfPreviewCSP)
+		} else {
+			c.Header("Content-Security-Policy", previewCSP)
 		}
 	}
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	c.Header("Content-Disposition", utils.GetContentDisposition(disposition, filename))
 	c.Header("Content-Length", fmt.Sprintf("%d", len(f)))
-	c.Header("Content-Type", http.DetectContentType(f))
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
 	_, err = c.Writer.Write(f)
 	if err != nil {
 		//Delete header for download
 		c.Writer.Header().Del("Content-Disposition")
 		c.Writer.Header().Del("Content-Length")
 		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Security-Policy")
+		c.Writer.Header().Del("ETag")
+		c.Writer.Header().Del("Last-Modified")
 		utils.GetLogger().Errorf("Error when writing %s to response", dst)
 		c.String(http.StatusInternalServerError, "500 Internal Server Error")
+	} else if mode != "view" {
+		service.PublishDownload(file, user, c)
 	}
 }
 
-// GetFileOrFolderInfoByPath get the file or folder info based on its path
+// StreamFile send the content of a file inline with the support of range requests, used by the media players
+func StreamFile(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, err := getRequestFile(c, user)
+	var dst, filename string
+	if err == nil {
+		dst, filename, err = service.GetFile(file, user)
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			c.String(http.StatusNotFound, "404 Not Found")
+		} else if errors.Is(err, service.ErrSystem) {
+			c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		} else {
+			c.String(http.StatusBadRequest, "400 Bad Request")
+		}
+		return
+	}
+	content, f, err := service.OpenFileContent(dst, file, user, c)
+	if errors.Is(err, service.ErrVault) {
+		c.String(http.StatusConflict, "409 Conflict")
+		return
+	}
+	if err != nil {
+		utils.GetLogger().Errorf("Error when finding and decrypting %s for %s", dst, file.Position)
+		c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		return
+	}
+	if f != nil {
+		defer f.Close()
+	}
+	// The conditional and range requests are answered by ServeContent with the validators
+	c.Header("ETag", service.FileETag(file, ""))
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("Content-Disposition", utils.GetContentDisposition("inline", filename))
+	c.Header("Content-Type", utils.GetMimeTypeByName(filename, file.FileType, file.MimeType))
+	c.Header("Content-Security-Policy", previewCSP)
+	c.Header("X-Content-Type-Options", "nosniff")
+	http.ServeContent(c.Writer, c.Request, "", file.UpdatedAt, content)
+}
+
+// GetFileBlob download the stored blob of a file in the vault mode with the keys to decrypt it by the client
+func GetFileBlob(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, err := getRequestFile(c, user)
+	var blob *service.VaultBlob
+	if err == nil {
+		blob, err = service.GetVaultBlob(file, user)
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			c.String(http.StatusNotFound, "404 Not Found")
+		} else if errors.Is(err, service.ErrPrecondition) {
+			c.String(http.StatusPreconditionFailed, "412 Precondition Failed")
+		} else if errors.Is(err, service.ErrSystem) {
+			c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		} else {
+			c.String(http.StatusBadRequest, "400 Bad Request")
+		}
+		return
+	}
+	if checkNotModified(c, service.FileETag(file, "blob"), file.UpdatedAt) {
+		return
+	}
+	if blob.DataKey != "" {
+		c.Header("X-Data-Key", blob.DataKey)
+		c.Header("X-Data-Key-Id", strconv.FormatUint(uint64(blob.DataKeyId), 10))
+	}
+	c.Header("X-Legacy-Encryption", strconv.Itoa(blob.LegacyEncryption))
+	c.Header("Content-Disposition", utils.GetContentDisposition("attachment", file.Name))
+	c.Data(http.StatusOK, "application/octet-stream", blob.Content)
+	service.PublishDownload(file, user, c)
+}
+
+// GetFileOrFolderInfoByPath get the file or folder info based on its path, or its ID in the ID-based endpoint
 func GetFileOrFolderInfoByPath(c *gin.Context) {
 	user := c.Value("user").(*models.User)
-	vDir := c.Value("vDir").([]string)
-	file, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	file, err := getRequestFile(c, user)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -231,35 +586,56 @@ func GetFileOrFolderInfoByPath(c *gin.Context) {
 		}
 		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
 	} else {
+		_ = service.LoadTags(file)
+		note, metas, errMeta := service.GetFileMetadata(file, user, c)
+		if errMeta != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(errMeta)})
+			return
+		}
 		resFolderInfo := gin.H{
+			"ID":       file.ID,
 			"Name":     file.Name,
 			"Position": file.Position,
+			"Tags":     getTagsInfo(file.Tags),
+			"Note":     note,
+			"Metadata": getMetadataInfo(metas),
 		}
 		if file.IsDir == 1 {
-			c.JSON(http.StatusOK, gin.H{"success": 0, "type": "folder", "root": file.ParentId == uuid.Nil, "info": resFolderInfo})
+			jsonWithETag(c, gin.H{"success": 0, "type": "folder", "root": file.ParentId == uuid.Nil, "info": resFolderInfo})
 		} else {
 			var folder *models.File
-			folder, err = service.GetFileOrFolderInfoByID(file.ParentId, user)
+			folder, err = service.GetFileOrFolderInfoByID(file.ParentId, user, c)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
 			} else {
 				resFileInfo := gin.H{
+					"ID":        file.ID,
 					"Name":      file.Name,
 					"Position":  file.Position,
 					"Size":      file.Size,
 					"FileType":  file.FileType,
+					"MimeType":  file.MimeType,
 					"UpdatedAt": file.UpdatedAt,
 					"CreatedAt": file.CreatedAt,
 					"CreatorId": service.GetUserNameByID(file.CreatorId),
 					"OwnerId":   service.GetUserNameByID(file.OwnerId),
 					"Favorite":  file.Favorite,
+					"Revision":  file.Revision,
+					"ETag":      service.FileETag(file, ""),
+					"Tags":      getTagsInfo(file.Tags),
+					"Note":      note,
+					"Metadata":  getMetadataInfo(metas),
+				}
+				if photo := service.GetPhotoInfo(file); photo != nil {
+					resFileInfo["Photo"] = getPhotoInfo(photo)
 				}
 				resParentFolderInfo := gin.H{
+					"ID":       folder.ID,
 					"Name":     folder.Name,
 					"Position": folder.Position,
 				}
 
-				c.JSON(http.StatusOK, gin.H{"success": 0, "type": "file", "info": resFileInfo, "parent_root": file.ParentId == uuid.Nil, "parent_info": resParentFolderInfo})
+				jsonWithETag(c, gin.H{"success": 0, "type": "file", "info": resFileInfo, "parent_root": file.ParentId == uuid.Nil, "parent_info": resParentFolderInfo})
 			}
 		}
 	}
@@ -269,9 +645,8 @@ func GetFileOrFolderInfoByPath(c *gin.Context) {
 // DeleteFile delete a file or folder and its children in the system
 func DeleteFile(c *gin.Context) {
 	user := c.Value("user").(*models.User)
-	vDir := c.Value("vDir").([]string)
 
-	file, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	file, err := getRequestFile(c, user)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -284,19 +659,31 @@ func DeleteFile(c *gin.Context) {
 		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
 		return
 	}
+	if !checkIfMatch(c, service.FileETag(file, "")) {
+		return
+	}
 
-	err = service.DeleteFile(file, user)
+	var job *models.Job
+	// The file is only deleted if it is still the version the entity tag was checked against
+	job, err = service.DeleteFile(file, user, c.GetHeader("If-Match") != "", c)
 	//Will not raise error after starting to delete files
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
 			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrDeleting) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
 		} else if errors.Is(err, service.ErrSystem) {
 			status = http.StatusInternalServerError
 		} else {
 			status = http.StatusBadRequest
 		}
 		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else if job != nil {
+		// Large folders are deleted in the background, the progress can be found by /api/job/get
+		c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
 	} else {
 		c.JSON(http.StatusOK, gin.H{"success": 0})
 	}
@@ -305,9 +692,8 @@ func DeleteFile(c *gin.Context) {
 // ToggleFavorite change the favorite status of a file or a folder
 func ToggleFavorite(c *gin.Context) {
 	user := c.Value("user").(*models.User)
-	vDir := c.Value("vDir").([]string)
 
-	file, err := service.GetFileOrFolderInfoByPath(vDir, user)
+	file, err := getRequestFile(c, user)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -320,7 +706,7 @@ func ToggleFavorite(c *gin.Context) {
 		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
 		return
 	}
-	err = service.ChangeFavoriteStatus(file, user)
+	err = service.ChangeFavoriteStatus(file, user, c)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -340,7 +726,7 @@ func ToggleFavorite(c *gin.Context) {
 func GetFavorites(c *gin.Context) {
 	user := c.Value("user").(*models.User)
 
-	files, err := service.GetFavorites(user)
+	files, err := service.GetFavorites(user, c)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -355,6 +741,7 @@ func GetFavorites(c *gin.Context) {
 		resFileInfo := make([]gin.H, len(files))
 		for i, v := range files {
 			resFileInfo[i] = gin.H{
+				"ID":       v.ID,
 				"Name":     v.Name,
 				"Position": v.Position,
 				"IsDir":    v.IsDir,
@@ -368,10 +755,20 @@ func GetFavorites(c *gin.Context) {
 func SearchFiles(c *gin.Context) {
 	user := c.Value("user").(*models.User)
 	keyword := c.PostForm("keyword")
-	if keyword == "" {
+	tags, err := parseTagIDs(c.PostForm("tags"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Tags"})
+		return
+	}
+	if keyword == "" && len(tags) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Please input keyword"})
+		return
+	}
+	var files []*models.File
+	files, err = service.SearchFiles(user, keyword, tags, c)
+	if err == nil {
+		err = service.LoadTags(files...)
 	}
-	files, err := service.SearchFiles(user, keyword)
 	if err != nil {
 		var status int
 		if errors.Is(err, service.ErrInvalidOrPermission) {
@@ -386,9 +783,11 @@ func SearchFiles(c *gin.Context) {
 		resFileInfo := make([]gin.H, len(files))
 		for i, v := range files {
 			resFileInfo[i] = gin.H{
+				"ID":       v.ID,
 				"Name":     v.Name,
 				"Position": v.Position,
 				"IsDir":    v.IsDir,
+				"Tags":     getTagsInfo(v.Tags),
 			}
 		}
 		c.JSON(http.StatusOK, gin.H{"success": 0, "result": resFileInfo})
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strconv"
+)
+
+// getJobErrorStatus map the errors of the job services to the HTTP status
+func getJobErrorStatus(err error) int {
+	if errors.Is(err, service.ErrInvalidOrPermission) {
+		return http.StatusNotFound
+	} else if errors.Is(err, service.ErrInProgress) {
+		return http.StatusConflict
+	} else if errors.Is(err, service.ErrSystem) || errors.Is(err, service.ErrSave) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// getJobInfo the fields of the job in the response
+func getJobInfo(job *models.Job) gin.H {
+	var status string
+	switch job.Status {
+	case 0:
+		status = "queued"
+	case 1:
+		status = "running"
+	case 2:
+		status = "completed"
+	case 3:
+		status = "failed"
+	case 4:
+		status = "cancelled"
+	default:
+		status = "waiting"
+	}
+	return gin.H{
+		"ID":         job.ID,
+		"Owner":      service.GetUserNameByID(job.OwnerId),
+		"Type":       job.Type,
+		"Status":     status,
+		"Total":      job.Total,
+		"Done":       job.Done,
+		"Bytes":      job.Bytes,
+		"Result":     job.Result,
+		"Error":      job.Error,
+		"CreatedAt":  job.CreatedAt,
+		"StartedAt":  job.StartedAt,
+		"FinishedAt": job.FinishedAt,
+	}
+}
+
+// getJobPage parse the page and the page size in the query
+func getJobPage(c *gin.Context) (int, int, bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page"})
+		return 0, 0, false
+	}
+	var pageSize int
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page Size"})
+		return 0, 0, false
+	}
+	return page, pageSize, true
+}
+
+// writeJobs write a page of jobs
+func writeJobs(c *gin.Context, jobs []*models.Job, total int64, err error) {
+	if err != nil {
+		c.JSON(getJobErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resJobs := make([]gin.H, len(jobs))
+	for i, v := range jobs {
+		resJobs[i] = getJobInfo(v)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "jobs": resJobs, "total": total})
+}
+
+// GetJobs get the background jobs of the user
+func GetJobs(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	page, pageSize, ok := getJobPage(c)
+	if !ok {
+		return
+	}
+	jobs, total, err := service.GetJobs(user, page, pageSize)
+	writeJobs(c, jobs, total, err)
+}
+
+// GetAllJobs get the background jobs of all users
+func GetAllJobs(c *gin.Context) {
+	page, pageSize, ok := getJobPage(c)
+	if !ok {
+		return
+	}
+	jobs, total, err := service.GetAllJobs(page, pageSize)
+	writeJobs(c, jobs, total, err)
+}
+
+// GetJob get the status and the progress of a job
+func GetJob(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Job"})
+		return
+	}
+	var job *models.Job
+	job, err = service.GetJob(user, uint(id))
+	if err != nil {
+		c.JSON(getJobErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "job": getJobInfo(job)})
+}
+
+// CancelJob cancel a job of the user, admins can cancel the jobs of all users
+func CancelJob(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	id, err := strconv.ParseUint(c.PostForm("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Job"})
+		return
+	}
+	if err = service.CancelJob(user, uint(id)); err != nil {
+		c.JSON(getJobErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
+
+// ResumeJobs continue the jobs of the user waiting for the file encryption key after a restart
+func ResumeJobs(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	if err := service.ResumeWaitingJobs(user, c.Value("encryptionKey").([]byte)); err != nil {
+		c.JSON(getJobErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
+
+// StartScrub verify the stored files of the user in the background
+func StartScrub(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	job, err := service.StartScrub(user, c)
+	if err != nil {
+		c.JSON(getJobErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
+}
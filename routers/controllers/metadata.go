@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+)
+
+// getMetadataInfo convert the custom properties to response
+func getMetadataInfo(metas []*models.FileMeta) gin.H {
+	res := make(gin.H, len(metas))
+	for _, v := range metas {
+		res[v.Key] = v.Value
+	}
+	return res
+}
+
+// getFileForMetadata find the file or folder in the dir parameter, it will write the error response if fails
+func getFileForMetadata(c *gin.Context) (*models.File, bool) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return nil, false
+	}
+	return file, true
+}
+
+// writeMetadataResult write the response of the operations on custom properties
+func writeMetadataResult(c *gin.Context, err error) {
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) || errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
+
+// GetFileMetadata get the note and the custom properties of a file or folder
+func GetFileMetadata(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, ok := getFileForMetadata(c)
+	if !ok {
+		return
+	}
+	note, metas, err := service.GetFileMetadata(file, user, c)
+	if err != nil {
+		writeMetadataResult(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "note": note, "metadata": getMetadataInfo(metas)})
+}
+
+// SetFileMeta create or replace a custom property of a file or folder
+func SetFileMeta(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, ok := getFileForMetadata(c)
+	if !ok {
+		return
+	}
+	writeMetadataResult(c, service.SetFileMeta(file, user, c.PostForm("key"), c.PostForm("value"), c))
+}
+
+// DeleteFileMeta delete a custom property of a file or folder
+func DeleteFileMeta(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, ok := getFileForMetadata(c)
+	if !ok {
+		return
+	}
+	writeMetadataResult(c, service.DeleteFileMeta(file, user, c.PostForm("key")))
+}
+
+// SetFileNote save the note of a file or folder
+func SetFileNote(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	file, ok := getFileForMetadata(c)
+	if !ok {
+		return
+	}
+	writeMetadataResult(c, service.SetFileNote(file, user, c.PostForm("note"), c))
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"home-cloud/utils"
+	"net/http"
+)
+
+// GetArtists get the artists in the music library
+func GetArtists(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	artists, err := service.GetArtists(user, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resArtists := make([]gin.H, len(artists))
+	for i, v := range artists {
+		resArtists[i] = gin.H{
+			"Artist": v.Artist,
+			"Albums": v.Albums,
+			"Tracks": v.Tracks,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "artists": resArtists})
+}
+
+// GetAlbums get the albums in the music library, filtered by artist if the artist parameter exists
+func GetAlbums(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	artist, byArtist := c.GetQuery("artist")
+	albums, err := service.GetAlbums(user, artist, byArtist, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resAlbums := make([]gin.H, len(albums))
+	for i, v := range albums {
+		resAlbums[i] = gin.H{
+			"Album":  v.Album,
+			"Artist": v.Artist,
+			"Year":   v.Year,
+			"Tracks": v.Tracks,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "albums": resAlbums})
+}
+
+// GetAlbumTracks get the tracks in the album
+func GetAlbumTracks(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	files, err := service.GetAlbumTracks(user, c.Query("artist"), c.Query("album"), c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resTracks := make([]gin.H, len(files))
+	for i, v := range files {
+		resTracks[i] = gin.H{
+			"ID":          v.ID,
+			"Name":        v.Name,
+			"Position":    v.Position,
+			"Size":        v.Size,
+			"Title":       v.Track.Title,
+			"Artist":      v.Track.Artist,
+			"Album":       v.Track.Album,
+			"AlbumArtist": v.Track.AlbumArtist,
+			"Year":        v.Track.Year,
+			"TrackNumber": v.Track.TrackNumber,
+			"Duration":    v.Track.Duration,
+			"HasCover":    v.Track.HasCover,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "tracks": resTracks})
+}
+
+// GetPlaylist get the M3U playlist of the album
+func GetPlaylist(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	artist := c.Query("artist")
+	album := c.Query("album")
+	files, err := service.GetAlbumTracks(user, artist, album, c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		return
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	playlist := service.BuildPlaylist(files, fmt.Sprintf("%s://%s", scheme, c.Request.Host))
+	name := album
+	if name == "" {
+		name = "playlist"
+	}
+	c.Header("Content-Disposition", utils.GetContentDisposition("attachment", name+".m3u"))
+	c.Data(http.StatusOK, "audio/x-mpegurl; charset=utf-8", []byte(playlist))
+}
+
+// GetCover get the embedded cover art of an audio file
+func GetCover(c *gin.Context) {
+	//This will only return error page in plain text because it is used in img tags
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			c.String(http.StatusNotFound, "404 Not Found")
+		} else if errors.Is(err, service.ErrSystem) {
+			c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		} else {
+			c.String(http.StatusBadRequest, "400 Bad Request")
+		}
+		return
+	}
+	var cover []byte
+	var mimeType string
+	cover, mimeType, err = service.GetCover(file, user, c)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			c.String(http.StatusNotFound, "404 Not Found")
+		} else if errors.Is(err, service.ErrSystem) {
+			c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		} else {
+			c.String(http.StatusBadRequest, "400 Bad Request")
+		}
+		return
+	}
+	c.Header("Content-Security-Policy", previewCSP)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, mimeType, cover)
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifyHeartbeat the interval of comments keeping the connection alive through proxies
+const notifyHeartbeat = 30 * time.Second
+
+// WatchFolder push the changes in the folder to the client as Server-Sent Events
+// With recursive=1 the changes in the sub folders are pushed too
+func WatchFolder(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	folder, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err == nil && folder.IsDir != 1 {
+		err = service.ErrRequestPara
+	}
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	sub := service.Subscribe(user.ID, "/"+strings.Join(vDir, "/"), c.Query("recursive") == "1")
+	defer service.Unsubscribe(sub)
+
+	heartbeat := time.NewTicker(notifyHeartbeat)
+	defer heartbeat.Stop()
+	c.Header("Cache-Control", "no-cache")
+	// disable the response buffering of nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Render(http.StatusOK, sse.Event{Event: "ready", Data: gin.H{"folder": "/" + strings.Join(vDir, "/")}})
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			// comment lines are ignored by EventSource
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case notification, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			if sub.Overflowed() {
+				// some changes have been dropped, the client should reload the folder
+				c.Render(-1, sse.Event{Event: "resync", Data: gin.H{}})
+			}
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(notification.ID, 10),
+				Event: notification.Type,
+				Data:  notification,
+			})
+			return true
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strconv"
+)
+
+// getPhotoInfo convert the EXIF metadata to response
+func getPhotoInfo(photo *models.Photo) gin.H {
+	return gin.H{
+		"TakenAt":     photo.TakenAt,
+		"CameraMake":  photo.CameraMake,
+		"CameraModel": photo.CameraModel,
+		"Orientation": photo.Orientation,
+		"Width":       photo.Width,
+		"Height":      photo.Height,
+		"Latitude":    photo.Latitude,
+		"Longitude":   photo.Longitude,
+	}
+}
+
+// GetPhotoTimeline get the photos in all folders grouped by capture month
+func GetPhotoTimeline(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page"})
+		return
+	}
+	var pageSize int
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page Size"})
+		return
+	}
+	files, total, err := service.GetPhotoTimeline(user, page, pageSize, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	// The photos are ordered by capture date, so photos in the same month are adjacent
+	groups := make([]gin.H, 0)
+	var photos []gin.H
+	var month string
+	for _, v := range files {
+		m := v.Photo.TakenAt.Format("2006-01")
+		if m != month {
+			if len(photos) > 0 {
+				groups = append(groups, gin.H{"month": month, "photos": photos})
+			}
+			month = m
+			photos = nil
+		}
+		info := getPhotoInfo(v.Photo)
+		info["ID"] = v.ID
+		info["Name"] = v.Name
+		info["Position"] = v.Position
+		info["Size"] = v.Size
+		photos = append(photos, info)
+	}
+	if len(photos) > 0 {
+		groups = append(groups, gin.H{"month": month, "photos": photos})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "total": total, "page": page, "page_size": pageSize, "groups": groups})
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"github.com/gin-gonic/gin"
 	"home-cloud/models"
+	"home-cloud/service"
+	"home-cloud/utils"
 	"net/http"
 )
 
@@ -24,5 +26,17 @@ func GetUserStatus(c *gin.Context) {
 		"account_salt":    user.AccountSalt,
 		"encryption":      encryption,
 		"encryption_algo": user.Encryption,
+		// true until the blobs are re-encrypted by the new file encryption key
+		"key_rotation":    user.OldEncryptionKey != "",
+		"recovery_key":    user.RecoveryKey != "",
+		"escrow":          user.EscrowKey != "",
+		"encrypted_names": user.NameKey != "",
+		// the blobs not encrypted by the user are encrypted by the master key of the server
+		"encryption_at_rest": utils.GetMasterKey() != nil,
+		// the files are encrypted and decrypted by the client only
+		"vault": user.Vault == 1,
+		// the migration of the algorithm, it only continues after a restart when the user logs in again
+		"migration":               user.Migration != 0,
+		"migration_waiting_login": user.Migration == 1 && service.IsMigrationWaitingLogin(user.ID),
 	})
 }
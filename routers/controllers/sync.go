@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxChangesWait the longest time of a long-poll request in seconds
+const maxChangesWait = 60
+
+// GetLatestCursor get the cursor of the latest change, used by a new client before listing the tree
+func GetLatestCursor(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	cursor, err := service.GetLatestCursor(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "cursor": strconv.FormatUint(cursor, 10)})
+}
+
+// GetChanges get the changes after the cursor
+// With wait > 0 the request is held until a change happens or wait seconds pass
+func GetChanges(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Cursor"})
+		return
+	}
+	var limit int
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", "500"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Limit"})
+		return
+	}
+	var wait int
+	wait, err = strconv.Atoi(c.DefaultQuery("wait", "0"))
+	if err != nil || wait < 0 || wait > maxChangesWait {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Wait"})
+		return
+	}
+	changes, next, err := service.GetChanges(c.Request.Context(), user, cursor, limit, time.Duration(wait)*time.Second, c)
+	if errors.Is(err, service.ErrResync) {
+		// The client lists the tree again from a new cursor
+		c.JSON(http.StatusGone, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resChanges := make([]gin.H, len(changes))
+	for i, v := range changes {
+		resChanges[i] = gin.H{
+			"Cursor":      strconv.FormatUint(v.Seq, 10),
+			"Type":        v.Type,
+			"ID":          v.FileId,
+			"ParentId":    v.ParentId,
+			"Name":        v.Name,
+			"Position":    v.Position,
+			"OldPosition": v.OldPosition,
+			"IsDir":       v.IsDir,
+			"Size":        v.Size,
+			"Revision":    v.Revision,
+			"Time":        v.CreatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":  0,
+		"changes":  resChanges,
+		"cursor":   strconv.FormatUint(next, 10),
+		"has_more": len(changes) == limit,
+	})
+}
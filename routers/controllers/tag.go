@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strings"
+)
+
+// getTagsInfo convert the tags to response
+func getTagsInfo(tags []*models.Tag) []gin.H {
+	res := make([]gin.H, len(tags))
+	for i, v := range tags {
+		res[i] = gin.H{
+			"ID":    v.ID,
+			"Name":  v.Name,
+			"Color": v.Color,
+		}
+	}
+	return res
+}
+
+// parseTagIDs parse the comma separated tag IDs, the repeated IDs are removed
+// since the files must have all the tags
+func parseTagIDs(tags string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+	for _, v := range strings.Split(tags, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// GetTags get the tags of the user
+func GetTags(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	tags, counts, err := service.GetTags(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resTags := getTagsInfo(tags)
+	for i, v := range tags {
+		resTags[i]["Count"] = counts[v.ID]
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "tags": resTags})
+}
+
+// NewTag create a tag
+func NewTag(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	tag, err := service.CreateTag(user, c.PostForm("name"), c.PostForm("color"))
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrDuplicate) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0, "tag": getTagsInfo([]*models.Tag{tag})[0]})
+	}
+}
+
+// UpdateTag change the name and color of a tag
+func UpdateTag(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	tagID, err := uuid.Parse(c.PostForm("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Tag"})
+		return
+	}
+	err = service.UpdateTag(user, tagID, c.PostForm("name"), c.PostForm("color"))
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrDuplicate) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
+
+// DeleteTag delete a tag
+func DeleteTag(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	tagID, err := uuid.Parse(c.PostForm("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Tag"})
+		return
+	}
+	err = service.DeleteTag(user, tagID)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
+
+// GetFilesByTag get the files and folders with the tag
+func GetFilesByTag(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	tagID, err := uuid.Parse(c.Query("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Tag"})
+		return
+	}
+	var files []*models.File
+	files, err = service.GetFilesByTag(user, tagID, c)
+	if err == nil {
+		err = service.LoadTags(files...)
+	}
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resFileInfo := make([]gin.H, len(files))
+	for i, v := range files {
+		resFileInfo[i] = gin.H{
+			"ID":       v.ID,
+			"Name":     v.Name,
+			"Position": v.Position,
+			"IsDir":    v.IsDir,
+			"Tags":     getTagsInfo(v.Tags),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "files": resFileInfo})
+}
+
+// AttachTag attach a tag to a file or folder
+func AttachTag(c *gin.Context) {
+	toggleTag(c, true)
+}
+
+// DetachTag detach a tag from a file or folder
+func DetachTag(c *gin.Context) {
+	toggleTag(c, false)
+}
+
+func toggleTag(c *gin.Context, attach bool) {
+	user := c.Value("user").(*models.User)
+	vDir := c.Value("vDir").([]string)
+
+	file, err := service.GetFileOrFolderInfoByPath(vDir, user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSystem) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	var tagID uuid.UUID
+	tagID, err = uuid.Parse(c.PostForm("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Tag"})
+		return
+	}
+	if attach {
+		err = service.AttachTag(file, user, tagID)
+	} else {
+		err = service.DetachTag(file, user, tagID)
+	}
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrInvalidOrPermission) {
+			status = http.StatusNotFound
+		} else if errors.Is(err, service.ErrSave) {
+			status = http.StatusInternalServerError
+		} else {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
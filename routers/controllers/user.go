@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"encoding/hex"
 	"errors"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -37,9 +38,14 @@ func UserLogin(c *gin.Context) {
 
 	if validation {
 		if user.Migration == 1 {
+			// The migration needs the key of the user to continue after a restart
+			message := "Migration in progress! You are not allowed to log in! "
+			if service.ResumeMigration(user, encryptionKey) == nil {
+				message = "Migration in progress! It is resumed with your key, please log in again after it is completed! "
+			}
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"success": 1,
-				"message": "Migration in progress! You are not allowed to log in! ",
+				"message": message,
 			})
 			return
 		} else if user.Migration == 2 {
@@ -47,6 +53,16 @@ func UserLogin(c *gin.Context) {
 				"success": 1,
 				"message": "Migration error occurred! Please contact the admin! ",
 			})
+			return
+		}
+		// The key derived from the password should never leave the client in the vault mode,
+		// a client sending it is not a vault client and should not be given a session
+		if user.Vault == 1 && encryptionKey != "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": 1,
+				"message": "The account is in the vault mode, the encryption key must not be sent! ",
+			})
+			return
 		}
 		session := sessions.Default(c)
 		session.Set("user", username)
@@ -68,6 +84,10 @@ func UserLogin(c *gin.Context) {
 			return
 		}
 		utils.GetLogger().Info("User " + username + " successfully log in")
+		// The jobs needing the key of the user are waiting for it after a restart
+		if encryptedKey, err := hex.DecodeString(encryptionKey); err == nil && user.Vault == 0 {
+			_ = service.ResumeWaitingJobs(user, encryptedKey)
+		}
 		c.JSON(http.StatusOK, gin.H{"success": 0})
 	} else {
 		c.JSON(http.StatusUnauthorized, gin.H{"success": 1, "message": "Authentication error! "})
@@ -101,12 +121,14 @@ func UserRegister(c *gin.Context) {
 	password := c.PostForm("password")
 	accountSalt := c.PostForm("accountSalt")
 	encryptionKey := c.PostForm("encryption")
+	// The file encryption key generated and wrapped by the client for the vault mode
+	wrappedKey := c.PostForm("wrapped_key")
 
 	if len(accountSalt) < 64 || len(password) < 64 {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Request!"})
 		return
 	}
-	if err := service.RegisterUser(username, password, accountSalt, encryptionKey); err != nil {
+	if err := service.RegisterUser(username, password, accountSalt, encryptionKey, wrappedKey); err != nil {
 		if errors.Is(err, service.ErrUsernameInvalid) {
 			c.JSON(http.StatusForbidden, gin.H{"success": 1, "message": "Invalid Username!"})
 		} else if errors.Is(err, service.ErrRequestPara) {
@@ -130,10 +152,21 @@ func ChangePassword(c *gin.Context) {
 	validation, _ := service.LoginValidate(user.Username, oldPassword)
 
 	if validation {
-		err := service.ChangePassword(user, newAccountSalt, newPassword, oldEncryption, newEncryption)
+		var err error
+		if user.Vault == 1 {
+			// The client wraps the file encryption key again, the session keeps no key
+			err = service.ChangeVaultPassword(user, newAccountSalt, newPassword, c.PostForm("new_wrapped_key"))
+			newEncryption = ""
+		} else {
+			err = service.ChangePassword(user, newAccountSalt, newPassword, oldEncryption, newEncryption)
+		}
 		if err != nil {
 			if errors.Is(err, service.ErrRequestPara) {
 				c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": GetErrorMessage(err)})
+			} else if errors.Is(err, service.ErrInProgress) {
+				c.JSON(http.StatusConflict, gin.H{"success": 1, "message": GetErrorMessage(err)})
+			} else if errors.Is(err, service.ErrPrecondition) {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"success": 1, "message": GetErrorMessage(err)})
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": "Server Error"})
 			}
@@ -199,10 +232,28 @@ func ChangeEncryptionAlgorithm(c *gin.Context) {
 	algo, err := strconv.Atoi(newAlgorithm)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Parameters!"})
+		return
 	}
-	err = service.ChangeEncryptionAlgorithm(user, algo, c)
+	// lazy=1 keeps the existing files in the old algorithm, so no migration and no need to log in again
+	lazy := c.PostForm("lazy") == "1"
+	err = service.ChangeEncryptionAlgorithm(user, algo, lazy, c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": "Server Error"})
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	if lazy {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+		return
 	}
 	session := sessions.Default(c)
 	session.Delete("user")
@@ -221,3 +272,160 @@ func ChangeEncryptionAlgorithm(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"success": 0})
 	}
 }
+
+// RotateFileKey replace the file encryption key of the user and re-encrypt the files in the background
+func RotateFileKey(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	job, err := service.RotateFileKey(user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
+}
+
+// EncryptNames enable the encryption of the file and folder names of the user, the existing names are encrypted
+// in the background. It can be called again to continue an unfinished job
+func EncryptNames(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	job, err := service.EncryptNames(user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"success": 0, "job": job.ID})
+}
+
+// CreateRecoveryKey generate a one-time recovery key of the user, it is only shown once
+func CreateRecoveryKey(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	recoveryKey, err := service.CreateRecoveryKey(user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "result": recoveryKey})
+}
+
+// RecoverPassword set a new password with the recovery key, the user should log in again
+func RecoverPassword(c *gin.Context) {
+	username := c.PostForm("username")
+	recoveryKey := c.PostForm("recovery_key")
+	newPassword := c.PostForm("new")
+	newAccountSalt := c.PostForm("new_account_salt")
+	newEncryption := c.PostForm("new_encryption")
+	if username == "" || newPassword == "" || newAccountSalt == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": GetErrorMessage(service.ErrRequestPara)})
+		return
+	}
+	err := service.RecoverPassword(username, recoveryKey, newAccountSalt, newPassword, newEncryption)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
+
+// EnrollEscrow seal the file encryption key of the user to the admin escrow
+func EnrollEscrow(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	err := service.EnrollEscrow(user, c)
+	if err != nil {
+		var status int
+		if errors.Is(err, service.ErrRequestPara) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
+
+// EnableVault switch the user to the end-to-end encrypted vault mode, the key in the session is dropped
+func EnableVault(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	if err := service.EnableVault(user); err != nil {
+		var status int
+		if errors.Is(err, service.ErrInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, service.ErrPrecondition) {
+			status = http.StatusPreconditionFailed
+		} else {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	session := sessions.Default(c)
+	session.Set("encryptionKey", "")
+	if err := session.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": "Save session error! "})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
+
+// GetVaultKey return the file encryption key wrapped by the client in the vault mode
+func GetVaultKey(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	wrappedKey, keyID, err := service.GetVaultKey(user)
+	if err != nil {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "wrapped_key": wrappedKey, "key_id": keyID})
+}
+
+// WithdrawEscrow remove the escrowed file encryption key of the user
+func WithdrawEscrow(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	if err := service.WithdrawEscrow(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0})
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/service"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// getWebhookInfo convert the webhook to response, the secret is only returned on creation
+func getWebhookInfo(webhook *models.Webhook) gin.H {
+	return gin.H{
+		"ID":        webhook.ID,
+		"URL":       webhook.URL,
+		"Events":    strings.Split(webhook.Events, ","),
+		"Admin":     webhook.Admin == 1,
+		"CreatedAt": webhook.CreatedAt,
+	}
+}
+
+// getWebhookErrorStatus return the HTTP status of webhook service errors
+func getWebhookErrorStatus(err error) int {
+	if errors.Is(err, service.ErrInvalidOrPermission) {
+		return http.StatusNotFound
+	} else if errors.Is(err, service.ErrSave) || errors.Is(err, service.ErrSystem) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// GetWebhookEvents get the events which can be subscribed
+func GetWebhookEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"success": 0, "events": service.WebhookEvents})
+}
+
+// GetWebhooks get the webhooks of the user
+func GetWebhooks(c *gin.Context) {
+	getWebhooks(c, false)
+}
+
+// GetAdminWebhooks get all the admin-level webhooks
+func GetAdminWebhooks(c *gin.Context) {
+	getWebhooks(c, true)
+}
+
+func getWebhooks(c *gin.Context, admin bool) {
+	user := c.Value("user").(*models.User)
+	webhooks, err := service.GetWebhooks(user, admin)
+	if err != nil {
+		c.JSON(getWebhookErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resWebhooks := make([]gin.H, len(webhooks))
+	for i, v := range webhooks {
+		resWebhooks[i] = getWebhookInfo(v)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "webhooks": resWebhooks})
+}
+
+// NewWebhook create a webhook of the user
+func NewWebhook(c *gin.Context) {
+	newWebhook(c, false)
+}
+
+// NewAdminWebhook create an admin-level webhook receiving the events of all users
+func NewAdminWebhook(c *gin.Context) {
+	newWebhook(c, true)
+}
+
+func newWebhook(c *gin.Context, admin bool) {
+	user := c.Value("user").(*models.User)
+	var events []string
+	for _, v := range strings.Split(c.PostForm("events"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			events = append(events, v)
+		}
+	}
+	webhook, err := service.CreateWebhook(user, c.PostForm("url"), events, admin)
+	if err != nil {
+		c.JSON(getWebhookErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resWebhook := getWebhookInfo(webhook)
+	resWebhook["Secret"] = webhook.Secret
+	c.JSON(http.StatusOK, gin.H{"success": 0, "webhook": resWebhook})
+}
+
+// DeleteWebhook delete a webhook
+func DeleteWebhook(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	webhookID, err := uuid.Parse(c.PostForm("webhook"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Webhook"})
+		return
+	}
+	if err = service.DeleteWebhook(user, webhookID); err != nil {
+		c.JSON(getWebhookErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
+
+// PingWebhook send a ping event to the webhook
+func PingWebhook(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	webhookID, err := uuid.Parse(c.PostForm("webhook"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Webhook"})
+		return
+	}
+	if err = service.PingWebhook(user, webhookID); err != nil {
+		c.JSON(getWebhookErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"success": 0})
+	}
+}
+
+// GetWebhookDeliveries get the delivery log of a webhook
+func GetWebhookDeliveries(c *gin.Context) {
+	user := c.Value("user").(*models.User)
+	webhookID, err := uuid.Parse(c.Query("webhook"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Webhook"})
+		return
+	}
+	var page int
+	page, err = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page"})
+		return
+	}
+	var pageSize int
+	pageSize, err = strconv.Atoi(c.DefaultQuery("page_size", "50"))
+	if err != nil || pageSize < 1 || pageSize > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"success": 1, "message": "Invalid Page Size"})
+		return
+	}
+	deliveries, total, err := service.GetWebhookDeliveries(user, webhookID, page, pageSize)
+	if err != nil {
+		c.JSON(getWebhookErrorStatus(err), gin.H{"success": 1, "message": GetErrorMessage(err)})
+		return
+	}
+	resDeliveries := make([]gin.H, len(deliveries))
+	for i, v := range deliveries {
+		var status string
+		switch v.Status {
+		case 0:
+			status = "pending"
+		case 1:
+			status = "delivered"
+		default:
+			status = "failed"
+		}
+		resDeliveries[i] = gin.H{
+			"ID":             v.ID,
+			"Event":          v.Event,
+			"Payload":        v.Payload,
+			"Status":         status,
+			"Attempts":       v.Attempts,
+			"NextAttemptAt":  v.NextAttemptAt,
+			"LastStatusCode": v.LastStatusCode,
+			"LastError":      v.LastError,
+			"CreatedAt":      v.CreatedAt,
+			"UpdatedAt":      v.UpdatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": 0, "total": total, "page": page, "page_size": pageSize, "deliveries": resDeliveries})
+}
@@ -22,6 +22,8 @@ func InitRouter(router *gin.Engine) {
 		api.POST("/pre-login", controllers.UserPreLogin)
 		api.POST("/login", controllers.UserLogin)
 		api.GET("/logout", controllers.UserLogout)
+		//Set a new password with the recovery key if the password is forgotten
+		api.POST("/recover", controllers.RecoverPassword)
 
 		statusAPI := api.Group("/status")
 		statusAPI.Use(middleware.AuthSession())
@@ -40,21 +42,112 @@ func InitRouter(router *gin.Engine) {
 				dirGroup.POST("/upload", controllers.UploadFiles)
 				//Get child in folder (Use folder ID)
 				dirGroup.POST("/list_dir", controllers.GetFolder)
+				//GET variants allow conditional requests with the ETag
+				dirGroup.GET("/list_dir", controllers.GetFolder)
 				//New file or Folder
 				dirGroup.POST("/new", controllers.NewFileOrFolder)
+				//Rename file or folder
+				dirGroup.POST("/rename", controllers.RenameFile)
+				//Move file or folder into another folder
+				dirGroup.POST("/move", controllers.MoveFile)
+				//Save content of a text or markdown file
+				dirGroup.POST("/save", controllers.SaveFileContent)
 
 				dirGroup.POST("/get_info", controllers.GetFileOrFolderInfoByPath)
+				dirGroup.GET("/get_info", controllers.GetFileOrFolderInfoByPath)
 				//Get file (Use file name)
 				dirGroup.POST("/get_file", controllers.GetFile)
+				//Get file by query string, used to display file inline
+				dirGroup.GET("/get_file", controllers.GetFile)
+				//Stream file with range requests, used by media players
+				dirGroup.GET("/stream", controllers.StreamFile)
+				//Get the stored blob and its keys, decrypted by the client in the vault mode
+				dirGroup.GET("/get_blob", controllers.GetFileBlob)
+				//Get embedded cover art of audio file
+				dirGroup.GET("/cover", controllers.GetCover)
 				//delete file
 				dirGroup.POST("/delete", controllers.DeleteFile)
 				//Add favorite file
 				dirGroup.PUT("/favorite", controllers.ToggleFavorite)
+				//Attach or detach tag
+				dirGroup.POST("/tag", controllers.AttachTag)
+				dirGroup.POST("/untag", controllers.DetachTag)
+				//Note and custom properties
+				dirGroup.POST("/meta", controllers.GetFileMetadata)
+				dirGroup.POST("/meta/set", controllers.SetFileMeta)
+				dirGroup.POST("/meta/delete", controllers.DeleteFileMeta)
+				dirGroup.POST("/note", controllers.SetFileNote)
+				//Live changes in the folder as Server-Sent Events
+				dirGroup.GET("/watch", controllers.WatchFolder)
+			}
+			//ID-based variants of the file endpoints, the ID is stable across renames and moves
+			idGroup := fileAPI.Group("/id")
+			idGroup.Use(middleware.ValidateFileID())
+			{
+				idGroup.GET("/get_info", controllers.GetFileOrFolderInfoByPath)
+				idGroup.GET("/list_dir", controllers.GetFolder)
+				idGroup.GET("/get_file", controllers.GetFile)
+				idGroup.POST("/get_file", controllers.GetFile)
+				idGroup.GET("/stream", controllers.StreamFile)
+				idGroup.GET("/get_blob", controllers.GetFileBlob)
+				idGroup.POST("/delete", controllers.DeleteFile)
+				idGroup.PUT("/favorite", controllers.ToggleFavorite)
 			}
 			//Search file by keywords
 			fileAPI.POST("/search", controllers.SearchFiles)
 			//Get Favorites List
 			fileAPI.GET("/get_favorite", controllers.GetFavorites)
+			//Get photos grouped by capture month
+			fileAPI.GET("/timeline", controllers.GetPhotoTimeline)
+			//Get files recently uploaded, created or modified
+			fileAPI.GET("/recent", controllers.GetRecentFiles)
+			//Get activity feed
+			fileAPI.GET("/activity", controllers.GetActivities)
+			//Delta sync of the changes after a cursor, supports long-poll
+			fileAPI.GET("/changes", controllers.GetChanges)
+			fileAPI.GET("/changes/cursor", controllers.GetLatestCursor)
+		}
+		//Tags API
+		tagAPI := api.Group("/tag")
+		tagAPI.Use(middleware.AuthSession())
+		{
+			tagAPI.GET("/list", controllers.GetTags)
+			tagAPI.POST("/new", controllers.NewTag)
+			tagAPI.POST("/update", controllers.UpdateTag)
+			tagAPI.POST("/delete", controllers.DeleteTag)
+			//Get files and folders with the tag
+			tagAPI.GET("/files", controllers.GetFilesByTag)
+		}
+		//Music library API
+		musicAPI := api.Group("/music")
+		musicAPI.Use(middleware.AuthSession())
+		{
+			musicAPI.GET("/artists", controllers.GetArtists)
+			musicAPI.GET("/albums", controllers.GetAlbums)
+			musicAPI.GET("/tracks", controllers.GetAlbumTracks)
+			//M3U playlist of an album
+			musicAPI.GET("/playlist", controllers.GetPlaylist)
+		}
+		//Outgoing webhooks of the user
+		webhookAPI := api.Group("/webhook")
+		webhookAPI.Use(middleware.AuthSession())
+		{
+			webhookAPI.GET("/events", controllers.GetWebhookEvents)
+			webhookAPI.GET("/list", controllers.GetWebhooks)
+			webhookAPI.POST("/new", controllers.NewWebhook)
+			webhookAPI.POST("/delete", controllers.DeleteWebhook)
+			webhookAPI.POST("/ping", controllers.PingWebhook)
+			webhookAPI.GET("/deliveries", controllers.GetWebhookDeliveries)
+		}
+		//Background jobs of the user
+		jobAPI := api.Group("/job")
+		jobAPI.Use(middleware.AuthSession())
+		{
+			jobAPI.GET("/list", controllers.GetJobs)
+			jobAPI.GET("/get", controllers.GetJob)
+			jobAPI.POST("/cancel", controllers.CancelJob)
+			jobAPI.POST("/resume", controllers.ResumeJobs)
+			jobAPI.POST("/scrub", controllers.StartScrub)
 		}
 		userAPI := api.Group("/user")
 		userAPI.Use(middleware.AuthSession())
@@ -62,6 +155,15 @@ func InitRouter(router *gin.Engine) {
 			userAPI.PUT("/password", controllers.ChangePassword)
 			userAPI.POST("/profile", controllers.UpdateProfile)
 			userAPI.POST("/change_algorithm", controllers.ChangeEncryptionAlgorithm)
+			userAPI.POST("/rotate_key", controllers.RotateFileKey)
+			userAPI.POST("/encrypt_names", controllers.EncryptNames)
+			//One-time recovery key and the admin escrow of the file encryption key
+			userAPI.POST("/recovery_key", controllers.CreateRecoveryKey)
+			userAPI.POST("/escrow", controllers.EnrollEscrow)
+			userAPI.POST("/escrow/withdraw", controllers.WithdrawEscrow)
+			//End-to-end encrypted vault mode
+			userAPI.POST("/vault", controllers.EnableVault)
+			userAPI.GET("/vault/key", controllers.GetVaultKey)
 		}
 
 		adminAPI := api.Group("/admin")
@@ -73,6 +175,20 @@ func InitRouter(router *gin.Engine) {
 			adminAPI.POST("/set_user_quota", controllers.SetUserQuota)
 			adminAPI.POST("/toggle_admin", controllers.ToggleAdmin)
 			adminAPI.POST("/reset_password", controllers.ResetUserPassword)
+			//Public key of the admin escrow, the private key is only provided when resetting the password
+			adminAPI.GET("/escrow_key", controllers.GetEscrowKey)
+			adminAPI.POST("/escrow_key", controllers.NewEscrowKey)
+			adminAPI.POST("/backfill_file_types", controllers.BackfillFileTypes)
+			//Encrypt the existing plain blobs by the master key, the progress is in /jobs
+			adminAPI.POST("/encrypt_at_rest", controllers.EncryptAtRest)
+			adminAPI.GET("/migrations", controllers.GetMigrationJobs)
+			adminAPI.POST("/migration/retry", controllers.RetryMigration)
+			adminAPI.POST("/migration/rollback", controllers.RollbackMigration)
+			//Jobs of all users, admins can cancel them by /job/cancel
+			adminAPI.GET("/jobs", controllers.GetAllJobs)
+			//Admin-level webhooks receive the events of all users, managed by /webhook/delete and /webhook/deliveries
+			adminAPI.GET("/webhooks", controllers.GetAdminWebhooks)
+			adminAPI.POST("/new_webhook", controllers.NewAdminWebhook)
 		}
 	}
 }
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+)
+
+func init() {
+	RegisterFileEventHook(recordActivity)
+}
+
+// recordActivity save the file event to the activity log of the owner
+func recordActivity(event *FileEvent) {
+	activity := &models.Activity{
+		OwnerId:   event.File.OwnerId,
+		ActorId:   event.User.ID,
+		Action:    event.Action,
+		FileId:    event.File.ID,
+		Name:      storedName(event.File),
+		Position:  storedPosition(event.File),
+		IsDir:     event.File.IsDir,
+		ClientIP:  event.ClientIP,
+		CreatedAt: event.Time,
+	}
+	if err := activity.CreateActivity(); err != nil {
+		utils.GetLogger().Error("Save activity of " + event.File.ID.String() + " error: " + err.Error())
+	}
+}
+
+// GetActivities return a page of the activity log of the user, page starts from 1
+func GetActivities(user *models.User, page int, pageSize int, c *gin.Context) ([]*models.Activity, int64, error) {
+	if page < 1 || pageSize < 1 {
+		return nil, 0, ErrRequestPara
+	}
+	activities, total, err := models.GetActivities(user.ID, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	if err = decryptActivityNames(user, c, activities); err != nil {
+		return nil, 0, err
+	}
+	return activities, total, nil
+}
+
+// GetRecentFiles return the files recently uploaded, created or modified, newest first
+// Files that have been deleted will be skipped
+func GetRecentFiles(user *models.User, limit int, c *gin.Context) ([]*models.File, error) {
+	ids, err := models.GetRecentFileIDs(user.ID, []string{ActionUpload, ActionOverwrite, ActionCreate, ActionEdit}, limit)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	var found []*models.File
+	found, err = models.GetFilesByIDs(user.ID, ids)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	fileMap := make(map[uuid.UUID]*models.File, len(found))
+	for _, v := range found {
+		fileMap[v.ID] = v
+	}
+	files := make([]*models.File, 0, len(found))
+	for _, id := range ids {
+		file, ok := fileMap[id]
+		if !ok {
+			continue
+		}
+		if err = file.TraceRoot(); err != nil {
+			return nil, ErrSystem
+		}
+		files = append(files, file)
+	}
+	if err = decryptFileNames(user, c, files...); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// The blobs of the users without encryption are encrypted at rest by the master key of the instance if it is
+// configured, so they are not readable from the disk or the backups. Unlike the encryption of the users, the
+// server can always decrypt them, so it protects the data at rest only
+
+func init() {
+	registerJobHandler(JobEncryptAtRest, false, runEncryptAtRest, nil)
+}
+
+// encryptPlainBlob return the blob of the content not encrypted by the user,
+// it is encrypted by the master key if it is configured
+func encryptPlainBlob(content []byte) ([]byte, error) {
+	if masterKey := utils.GetMasterKey(); masterKey != nil {
+		return masterKey.EncryptBlob(content)
+	}
+	return utils.EncryptBlob(0, 0, nil, content)
+}
+
+// decryptMasterBlob decrypt the blob encrypted at rest by the master key
+func decryptMasterBlob(blob []byte) ([]byte, error) {
+	masterKey := utils.GetMasterKey()
+	if masterKey == nil {
+		utils.GetLogger().Error("A blob is encrypted at rest but the master key is not configured")
+		return nil, ErrSystem
+	}
+	content, err := masterKey.DecryptBlob(blob)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	return content, nil
+}
+
+// EncryptAtRest queue a job encrypting the existing plain blobs of all the users by the master key
+// The blobs encrypted by the users are not changed
+func EncryptAtRest(admin *models.User) (*models.Job, error) {
+	if utils.GetMasterKey() == nil {
+		return nil, ErrPrecondition
+	}
+	if _, err := models.GetActiveJob(admin.ID, JobEncryptAtRest); err == nil {
+		return nil, ErrInProgress
+	}
+	return enqueueJob(admin.ID, JobEncryptAtRest, struct{}{}, nil)
+}
+
+// runEncryptAtRest encrypt the plain blobs in the data folders of all the users
+func runEncryptAtRest(ctx *JobContext) error {
+	masterKey := utils.GetMasterKey()
+	if masterKey == nil {
+		return errors.New("the master key is not configured")
+	}
+	users, err := models.GetAllUsers()
+	if err != nil {
+		return err
+	}
+	userItems := make([][]*models.MigrationItem, len(users))
+	var total int64
+	for i, user := range users {
+		if userItems[i], err = listUserBlobs(user); err != nil {
+			return err
+		}
+		total += int64(len(userItems[i]))
+	}
+	ctx.SetTotal(total)
+	encrypted, failed := 0, 0
+	var lastError error
+	for i, user := range users {
+		for _, item := range userItems[i] {
+			if ctx.Cancelled() {
+				return ctx.Err()
+			}
+			size, changed, err := encryptBlobAtRest(masterKey, user, item)
+			if err != nil {
+				utils.GetLogger().Error("Encrypt " + item.Folder + "/" + item.Name + " at rest for user " + user.Username + " error: " + err.Error())
+				failed++
+				lastError = err
+			} else if changed {
+				encrypted++
+			}
+			ctx.Progress(1, uint64(size))
+		}
+	}
+	utils.GetLogger().Infof("Encryption at rest completes, %d blobs encrypted and %d failed", encrypted, failed)
+	// The job can be started again, the encrypted blobs are skipped
+	if failed > 0 {
+		return fmt.Errorf("%d blobs cannot be encrypted: %s", failed, lastError.Error())
+	}
+	return nil
+}
+
+// encryptBlobAtRest replace the plain blob by the one encrypted by the master key
+// changed is false if the blob is encrypted already, by the master key or by the user
+// The blob is locked like the rotation, so it is not removed or replaced until the encrypted one is written
+func encryptBlobAtRest(masterKey *utils.MasterKey, user *models.User, item *models.MigrationItem) (size int, changed bool, err error) {
+	filePath := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", item.Folder, item.Name)
+	unlock := lockBlob(filePath)
+	defer unlock()
+	var blob []byte
+	if blob, err = ioutil.ReadFile(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if utils.IsMasterBlob(blob) {
+		return len(blob), false, nil
+	}
+	algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, blob)
+	if algorithm != 0 {
+		return len(blob), false, nil
+	}
+	var newBlob []byte
+	if newBlob, err = masterKey.EncryptBlob(content); err != nil {
+		return len(blob), false, err
+	}
+	return len(blob), true, utils.WriteFileAtomic(filePath, newBlob, 0644)
+}
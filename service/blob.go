@@ -0,0 +1,59 @@
+package service
+
+import (
+	"home-cloud/utils"
+	"os"
+	"sync"
+)
+
+// The jobs re-encrypting the blobs in place hold the lock of a blob from reading it to writing it back.
+// The blobs are only written or removed by others with the lock held, so a blob re-encrypted by a job never
+// overwrites the content written at the same time or restores a removed blob
+
+var (
+	// blobLocks the locks of the blobs in use, by the path of the blob
+	blobLocks     = make(map[string]*blobLock)
+	blobLocksLock sync.Mutex
+)
+
+// blobLock the lock of a blob and the number of its holders and waiters
+type blobLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockBlob lock the blob at the path, it is unlocked by the returned function
+func lockBlob(filePath string) func() {
+	blobLocksLock.Lock()
+	lock, ok := blobLocks[filePath]
+	if !ok {
+		lock = &blobLock{}
+		blobLocks[filePath] = lock
+	}
+	lock.refs++
+	blobLocksLock.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		blobLocksLock.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(blobLocks, filePath)
+		}
+		blobLocksLock.Unlock()
+	}
+}
+
+// writeBlob write the blob atomically with its lock held
+func writeBlob(filePath string, blob []byte) error {
+	unlock := lockBlob(filePath)
+	defer unlock()
+	return utils.WriteFileAtomic(filePath, blob, 0644)
+}
+
+// removeBlob remove the blob with its lock held
+func removeBlob(filePath string) error {
+	unlock := lockBlob(filePath)
+	defer unlock()
+	return os.Remove(filePath)
+}
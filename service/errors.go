@@ -15,4 +15,11 @@ var (
 	ErrStorage             = errors.New("no enough storage quota")
 	ErrOnlyAdmin           = errors.New("need at least one admin")
 	ErrResetForbidden      = errors.New("cannot reset password for user enabling encryption")
+	ErrModified            = errors.New("file has been modified")
+	ErrInProgress          = errors.New("task in progress")
+	ErrPrecondition        = errors.New("precondition failed")
+	ErrSkipped             = errors.New("file skipped")
+	ErrVault               = errors.New("end-to-end encrypted by the client")
+	ErrDeleting            = errors.New("folder is being deleted")
+	ErrResync              = errors.New("change journal incomplete")
 )
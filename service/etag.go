@@ -0,0 +1,47 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"home-cloud/models"
+	"strconv"
+	"strings"
+)
+
+// FileETag return the strong entity tag of the file, which changes when the content or the name is changed
+// variant distinguishes the representations of the same content, e.g. "view" for the rendered preview
+func FileETag(file *models.File, variant string) string {
+	h := sha256.New()
+	h.Write([]byte(file.ID.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatUint(file.Revision, 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(file.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(variant))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// MatchETag check if the entity tag is in the If-Match or If-None-Match header
+// If weak is true, the W/ prefix is ignored, otherwise weak tags never match
+func MatchETag(header string, etag string, weak bool) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if weak {
+			v = strings.TrimPrefix(v, "W/")
+		}
+		if v == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"time"
+)
+
+// Actions of the file events
+const (
+	ActionUpload     = "upload"
+	ActionOverwrite  = "overwrite"
+	ActionCreate     = "create"
+	ActionEdit       = "edit"
+	ActionRename     = "rename"
+	ActionMove       = "move"
+	ActionDelete     = "delete"
+	ActionFavorite   = "favorite"
+	ActionUnfavorite = "unfavorite"
+	ActionDownload   = "download"
+)
+
+// FileEvent an operation on a file or folder
+type FileEvent struct {
+	Action string
+	// File the file or folder, Position is set
+	File *models.File
+	// OldPosition the position before the file is renamed or moved
+	OldPosition string
+	// OldPath the stored path before the file is renamed or moved, the names in it may be encrypted
+	OldPath string
+	// User the user performing the operation
+	User *models.User
+	// ClientIP empty if the operation is not from a request
+	ClientIP string
+	Time     time.Time
+}
+
+// FileEventHook will be called synchronously after the operation succeeds
+type FileEventHook func(event *FileEvent)
+
+var fileEventHooks []FileEventHook
+
+// RegisterFileEventHook add a hook for file events, should be called in init
+func RegisterFileEventHook(hook FileEventHook) {
+	fileEventHooks = append(fileEventHooks, hook)
+}
+
+// publishFileEvent call the hooks with the event
+func publishFileEvent(action string, file *models.File, user *models.User, c *gin.Context) {
+	event := &FileEvent{
+		Action: action,
+		File:   file,
+		User:   user,
+		Time:   time.Now(),
+	}
+	if c != nil {
+		event.ClientIP = c.ClientIP()
+	}
+	publish(event)
+}
+
+// storedOldPosition return the position before the file is renamed or moved as it was saved
+func (event *FileEvent) storedOldPosition() string {
+	if event.OldPath == "" {
+		return event.OldPosition
+	}
+	return event.OldPath
+}
+
+func publish(event *FileEvent) {
+	for _, hook := range fileEventHooks {
+		hook(event)
+	}
+}
+
+// PublishDownload publish the download event after the file is sent to the client
+func PublishDownload(file *models.File, user *models.User, c *gin.Context) {
+	publishFileEvent(ActionDownload, file, user, c)
+}
@@ -1,135 +1,509 @@
 package service
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"home-cloud/models"
 	"home-cloud/utils"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 )
 
-// UploadFile upload file to the folder
-func UploadFile(upFile *multipart.FileHeader, user *models.User, folder *models.File, c *gin.Context) (err error) {
+// Policies when the uploaded file name already exists in the folder
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+	ConflictSkip      = "skip"
+	ConflictFail      = "fail"
+)
+
+// maxRenameAttempts the max number appended to the name when keeping both files
+const maxRenameAttempts = 1000
+
+// UploadFile upload file to the folder and return the stored file, whose name may be changed by the conflict policy
+// conflict is the policy when the name exists, ErrSkipped with the existing file or ErrDuplicate is returned for skip and fail
+// If ifMatch is not empty, the file must exist and its entity tag must match, otherwise ErrPrecondition is returned
+// In the vault mode, the content is encrypted by the client and dataKey is its data key wrapped by the client
+func UploadFile(upFile *multipart.FileHeader, user *models.User, folder *models.File, conflict string, ifMatch string,
+	dataKey string, c *gin.Context) (file *models.File, err error) {
 	if folder.OwnerId != user.ID {
-		return ErrInvalidOrPermission
+		return nil, ErrInvalidOrPermission
 	}
 	if folder.IsDir != 1 {
-		return ErrRequestPara
+		return nil, ErrRequestPara
+	}
+	if ifMatch != "" && conflict != ConflictOverwrite {
+		return nil, ErrRequestPara
 	}
+	if (user.Vault == 1) != (dataKey != "") || (dataKey != "" && !isWrappedKey(dataKey)) {
+		return nil, ErrRequestPara
+	}
+	// The quota of the vault is counted on the size of the ciphertext
 	if user.UsedStorage+uint64(upFile.Size) > user.Storage {
-		return ErrStorage
+		return nil, ErrStorage
 	}
-	file := models.NewFile()
+	name, err := storeName(user, c, upFile.Filename)
+	if err != nil {
+		return nil, err
+	}
+	switch conflict {
+	case ConflictOverwrite:
+		if ifMatch != "" {
+			if _, err = models.GetFileByName(name, user, folder.ID); err != nil {
+				return nil, ErrPrecondition
+			}
+		}
+	case ConflictSkip, ConflictFail:
+		// Check before saving the content, the unique index will still be checked when creating
+		var existing *models.File
+		if existing, err = models.GetFileByName(name, user, folder.ID); err == nil {
+			if conflict == ConflictSkip {
+				existing.Position = path.Join(folder.Position, upFile.Filename)
+				existing.Name = upFile.Filename
+				return existing, ErrSkipped
+			}
+			return nil, ErrDuplicate
+		}
+	case ConflictRename:
+	default:
+		return nil, ErrRequestPara
+	}
+	file = models.NewFile()
 	file.ID = uuid.New()
 	file.RealPath = file.ID.String()
 	file.IsDir = 0
-	file.Name = upFile.Filename
+	file.Name = name
 	file.OwnerId = user.ID
 	file.CreatorId = user.ID
 	file.Size = uint64(upFile.Size)
 	file.ParentId = folder.ID
-	file.FileType = utils.GetFileTypeByName(file.Name)
+	if user.Vault == 1 {
+		file.MimeType = utils.GetMimeType(upFile.Filename, "application/octet-stream")
+		file.FileType = utils.GetFileType(upFile.Filename, file.MimeType)
+	} else {
+		file.MimeType, file.FileType = detectUploadFileType(upFile)
+	}
 
 	dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
 		"data", "files", file.RealPath)
 	utils.GetLogger().Infof("Save file to %s", dst)
 
 	if user.Encryption > 3 || user.Encryption < 0 {
-		return ErrSystem
+		return nil, ErrSystem
 	}
-	if err = saveUploadFileEncryption(upFile, dst, user, c); err != nil {
-		return err
+	if err = saveUploadFileEncryption(upFile, dst, file, user, dataKey, c); err != nil {
+		return nil, err
+	}
+	action := ActionUpload
+	plainName := upFile.Filename
+	fileType, mimeType := file.FileType, file.MimeType
+	if file.FileType, file.MimeType, err = storeFileType(user, c, fileType, mimeType); err != nil {
+		_ = removeBlob(dst)
+		return nil, err
 	}
 	err = file.CreateFile()
+	var mysqlErr *mysql.MySQLError
+	for i := 1; err != nil && conflict == ConflictRename && i <= maxRenameAttempts; i++ {
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+			break
+		}
+		// Keep both files, e.g. "report (1).pdf"
+		plainName = numberedName(upFile.Filename, i)
+		if file.Name, err = storeName(user, c, plainName); err != nil {
+			_ = removeBlob(dst)
+			return nil, err
+		}
+		err = file.CreateFile()
+	}
 	if err != nil {
-		var mysqlErr *mysql.MySQLError
-		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
-			// Duplicate entry error, try to update file
-			file, err = updateFile(upFile, user, folder.ID, dst)
+		if errors.Is(err, models.ErrPendingDeletion) {
+			_ = removeBlob(dst)
+			return nil, ErrDeleting
+		}
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+			_ = removeBlob(dst)
+			return nil, ErrSave
+		}
+		// Duplicate entry error
+		switch conflict {
+		case ConflictOverwrite:
+			file, err = updateFile(upFile, user, folder.ID, dst, file, ifMatch)
 			if err != nil {
-				return err
+				return nil, err
 			}
-		} else {
-			return ErrSave
+			action = ActionOverwrite
+		case ConflictSkip:
+			_ = removeBlob(dst)
+			existing, errFind := models.GetFileByName(name, user, folder.ID)
+			if errFind != nil {
+				return nil, ErrFoundFile
+			}
+			existing.Position = path.Join(folder.Position, upFile.Filename)
+			existing.Name = upFile.Filename
+			return existing, ErrSkipped
+		default:
+			_ = removeBlob(dst)
+			return nil, ErrDuplicate
 		}
 	}
+	file.Name = plainName
+	file.Position = path.Join(folder.Position, plainName)
+	file.FileType, file.MimeType = fileType, mimeType
 	user.UpdateUsedStorage(user.UsedStorage + file.Size)
-	return nil
+	if user.Vault == 0 {
+		savePhotoInfo(upFile, file, user)
+		saveTrackInfo(upFile, file, user, c)
+	}
+	publishFileEvent(action, file, user, c)
+	return file, nil
+}
+
+// numberedName append the number to the name before the extension, e.g. "report (1).pdf"
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	// Names like ".bashrc" have no base name
+	if base == "" {
+		base, ext = name, ""
+	}
+	return fmt.Sprintf("%s (%d)%s", base, n, ext)
 }
 
 //Update files when detected duplicate entry in uploading process
-func updateFile(upFile *multipart.FileHeader, user *models.User, folderID uuid.UUID, newFilePath string) (*models.File, error) {
-	file, err := models.GetFileByName(upFile.Filename, user, folderID)
+//uploaded is the file not saved because of the duplicate entry, its type and data key are used
+func updateFile(upFile *multipart.FileHeader, user *models.User, folderID uuid.UUID, newFilePath string,
+	uploaded *models.File, ifMatch string) (*models.File, error) {
+	fileType, mimeType := uploaded.FileType, uploaded.MimeType
+	// The name of the uploaded file is the stored one
+	file, err := models.GetFileByName(uploaded.Name, user, folderID)
 	if err != nil {
+		_ = removeBlob(newFilePath)
 		return nil, ErrFoundFile
 	}
 	if file.IsDir == 1 {
+		_ = removeBlob(newFilePath)
 		return nil, ErrConflict
 	}
+	if uploaded.Name != upFile.Filename {
+		// The entity tag is computed with the decrypted name
+		file.Name = upFile.Filename
+	}
+	if ifMatch != "" && !MatchETag(ifMatch, FileETag(file, ""), false) {
+		_ = removeBlob(newFilePath)
+		return nil, ErrPrecondition
+	}
 	oldSize := file.Size
+	old := *file
 	oldFilePath := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
 		"data", "files", file.RealPath)
-	// Will replace the old file
-	err = os.Rename(newFilePath, oldFilePath)
-	if err != nil {
-		return nil, ErrSystem
+	// Only update if the file is not overwritten by others since it is loaded. The file is switched to the
+	// uploaded blob with its data key at once, so the blob always matches the key read with it
+	var ok bool
+	ok, err = file.UpdateContent(file.Revision, uint64(upFile.Size), uploaded.RealPath, uploaded.DataKey, uploaded.DataKeyId)
+	if err != nil || !ok {
+		_ = removeBlob(newFilePath)
+		if err != nil {
+			return nil, ErrSave
+		}
+		if ifMatch != "" {
+			return nil, ErrPrecondition
+		}
+		return nil, ErrModified
 	}
-	file.Size = uint64(upFile.Size)
-	err = file.UpdateFile()
-	if err != nil {
-		err = ErrSave
+	if err = removeBlob(oldFilePath); err != nil {
+		utils.GetLogger().Error("Delete " + oldFilePath + " error: " + err.Error())
+	}
+	// The cover is stored by the real path, the new one is saved with the track
+	removeCover(&old, user)
+	if fileType != file.FileType || mimeType != file.MimeType {
+		if err = file.UpdateFileType(fileType, mimeType); err != nil {
+			utils.GetLogger().Error("Update file type of " + file.ID.String() + " error: " + err.Error())
+		}
+		file.FileType = fileType
+		file.MimeType = mimeType
 	}
 	user.UpdateUsedStorage(user.UsedStorage - oldSize)
-	return file, err
+	return file, nil
 }
 
-// saveUploadFileEncryption will save the upload file to the local file system
-// If user setting encryption is enabled, it will encrypt the file before writing to the system
-func saveUploadFileEncryption(upFile *multipart.FileHeader, dst string, user *models.User, c *gin.Context) error {
+// getFileEncryptionKey decrypt the file encryption key of the user with the key derived from the password in the session
+func getFileEncryptionKey(user *models.User, c *gin.Context) ([]byte, error) {
 	encryptedKey := c.Value("encryptionKey").([]byte)
 	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
 	if err != nil {
-		return ErrRequestPara
+		return nil, ErrRequestPara
+	}
+	return fileEncryptionKey, nil
+}
+
+// getFileKeyByID return the current or the old file encryption key by the key ID
+// The old key is only available during key rotation
+func getFileKeyByID(user *models.User, keyID uint32, c *gin.Context) ([]byte, error) {
+	if keyID == user.KeyId {
+		return getFileEncryptionKey(user, c)
+	}
+	if user.OldEncryptionKey == "" || keyID != user.OldKeyId {
+		return nil, ErrSystem
+	}
+	encryptedKey := c.Value("encryptionKey").([]byte)
+	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, user.OldEncryptionKey)
+	if err != nil {
+		return nil, ErrRequestPara
+	}
+	return fileEncryptionKey, nil
+}
+
+// getCurrentFileKey return the current file encryption key and its ID
+// The key is loaded again, since it may be rotated after the user of the request is loaded
+func getCurrentFileKey(user *models.User, c *gin.Context) ([]byte, uint32, error) {
+	current, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	var fileEncryptionKey []byte
+	if fileEncryptionKey, err = getFileEncryptionKey(current, c); err != nil {
+		return nil, 0, err
+	}
+	return fileEncryptionKey, current.KeyId, nil
+}
+
+// encryptBlob encrypt the content with the algorithm in the user setting and prefix the format header
+// The content of the users without encryption is encrypted at rest if the master key is configured
+func encryptBlob(content []byte, user *models.User, c *gin.Context) ([]byte, error) {
+	if user.Vault == 1 {
+		return nil, ErrVault
+	}
+	if user.Encryption > 3 || user.Encryption < 0 {
+		return nil, ErrSystem
+	}
+	if user.Encryption == 0 {
+		blob, err := encryptPlainBlob(content)
+		if err != nil {
+			return nil, ErrSystem
+		}
+		return blob, nil
 	}
-	var file multipart.File
-	file, err = upFile.Open()
+	fileEncryptionKey, keyID, err := getCurrentFileKey(user, c)
+	if err != nil {
+		return nil, err
+	}
+	var blob []byte
+	if blob, err = utils.EncryptBlob(user.Encryption, keyID, fileEncryptionKey, content); err != nil {
+		return nil, ErrSystem
+	}
+	return blob, nil
+}
+
+// decryptBlob decrypt the blob with the algorithm in its format header rather than the user setting,
+// so the blobs written before the setting is changed can still be read
+// The server has no key of the users in the vault mode, only their plain blobs can be read
+func decryptBlob(blob []byte, user *models.User, c *gin.Context) ([]byte, error) {
+	if utils.IsMasterBlob(blob) {
+		return decryptMasterBlob(blob)
+	}
+	algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, blob)
+	if algorithm == 0 {
+		return content, nil
+	}
+	if user.Vault == 1 || utils.IsClientBlob(blob) {
+		return nil, ErrVault
+	}
+	fileEncryptionKey, err := getFileKeyByID(user, utils.GetBlobKeyID(blob), c)
+	if err != nil {
+		return nil, err
+	}
+	var plainContent []byte
+	plainContent, err = utils.DecryptFile(algorithm, fileEncryptionKey, content)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	return plainContent, nil
+}
+
+// encryptFileBlob encrypt the content of a file by a new random data key, so each file has its own key.
+// The data key is encrypted by the current file encryption key and returned to be saved with the file,
+// it is empty if encryption is disabled
+func encryptFileBlob(content []byte, user *models.User, c *gin.Context) (blob []byte, dataKey string, dataKeyID uint32, err error) {
+	if user.Encryption > 3 || user.Encryption < 0 {
+		return nil, "", 0, ErrSystem
+	}
+	if user.Encryption == 0 || user.Vault == 1 {
+		blob, err = encryptBlob(content, user, c)
+		return blob, "", 0, err
+	}
+	var fileEncryptionKey, key []byte
+	if fileEncryptionKey, dataKeyID, err = getCurrentFileKey(user, c); err != nil {
+		return nil, "", 0, err
+	}
+	if key, err = utils.GenerateFileEncryptionKey(); err != nil {
+		return nil, "", 0, ErrSystem
+	}
+	if dataKey, err = utils.EncryptEncryptionKey(fileEncryptionKey, key); err != nil {
+		return nil, "", 0, ErrSystem
+	}
+	if blob, err = utils.EncryptEnvelopeBlob(user.Encryption, key, content); err != nil {
+		return nil, "", 0, ErrSystem
+	}
+	return blob, dataKey, dataKeyID, nil
+}
+
+// getDataKey decrypt the data key of the file by the file encryption key of the owner
+func getDataKey(file *models.File, user *models.User, c *gin.Context) ([]byte, error) {
+	if file.DataKey == "" {
+		return nil, ErrSystem
+	}
+	fileEncryptionKey, err := getFileKeyByID(user, file.DataKeyId, c)
+	if err != nil {
+		return nil, err
+	}
+	var dataKey []byte
+	if dataKey, err = utils.DecryptEncryptionKey(fileEncryptionKey, file.DataKey); err != nil {
+		return nil, ErrSystem
+	}
+	return dataKey, nil
+}
+
+// decryptFileBlob decrypt the blob of the file, the envelope blobs are decrypted by the data key of the file
+// and the others in the same way as decryptBlob
+func decryptFileBlob(blob []byte, file *models.File, user *models.User, c *gin.Context) ([]byte, error) {
+	header, content, ok := utils.ParseBlobHeader(blob)
+	if !ok || header.Version != utils.BlobVersionEnvelope {
+		return decryptBlob(blob, user, c)
+	}
+	if header.Algorithm == 0 {
+		return content, nil
+	}
+	if user.Vault == 1 {
+		return nil, ErrVault
+	}
+	dataKey, err := getDataKey(file, user, c)
+	if err != nil {
+		return nil, err
+	}
+	var plainContent []byte
+	plainContent, err = utils.DecryptFile(header.Algorithm, dataKey, content)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	return plainContent, nil
+}
+
+// detectUploadFileType detect the MIME type and the type of the uploaded file from its first bytes
+// It will fall back to the extension if the file cannot be read
+func detectUploadFileType(upFile *multipart.FileHeader) (mimeType string, fileType string) {
+	head := make([]byte, utils.SniffLength)
+	n := 0
+	if f, err := upFile.Open(); err == nil {
+		n, _ = io.ReadFull(f, head)
+		_ = f.Close()
+	}
+	if n == 0 {
+		mimeType = utils.GetMimeType(upFile.Filename, "application/octet-stream")
+	} else {
+		mimeType = utils.GetMimeType(upFile.Filename, utils.DetectMimeType(head[:n]))
+	}
+	return mimeType, utils.GetFileType(upFile.Filename, mimeType)
+}
+
+// saveUploadFileEncryption will save the upload file to the local file system
+// If user setting encryption is enabled, it will encrypt the file by a new data key before writing to the system,
+// the data key is set to the file. In the vault mode, the content encrypted by the client is saved as it is
+// with dataKey wrapped by the client
+func saveUploadFileEncryption(upFile *multipart.FileHeader, dst string, file *models.File, user *models.User,
+	dataKey string, c *gin.Context) error {
+	uploaded, err := upFile.Open()
 	if err != nil {
 		return ErrRequestPara
 	}
 	var fileContent []byte
-	fileContent, err = ioutil.ReadAll(file)
-	errClose := file.Close()
+	fileContent, err = ioutil.ReadAll(uploaded)
+	errClose := uploaded.Close()
 	if err != nil || errClose != nil {
 		return ErrRequestPara
 	}
 	var encryptedContent []byte
-	var errEncrypt error
-	if user.Encryption == 1 {
-		encryptedContent, errEncrypt = utils.EncryptFileAES(fileEncryptionKey, fileContent)
-	} else if user.Encryption == 2 {
-		encryptedContent, errEncrypt = utils.EncryptFileChaCha(fileEncryptionKey, fileContent)
-	} else if user.Encryption == 3 {
-		encryptedContent, errEncrypt = utils.EncryptFileXChaCha(fileEncryptionKey, fileContent)
-	} else {
-		encryptedContent = fileContent
+	if user.Vault == 1 {
+		encryptedContent, file.DataKey, file.DataKeyId = utils.WrapClientBlob(fileContent), dataKey, user.KeyId
+	} else if encryptedContent, file.DataKey, file.DataKeyId, err = encryptFileBlob(fileContent, user, c); err != nil {
+		return err
+	}
+	err = writeBlob(dst, encryptedContent)
+	if err != nil {
+		return ErrSave
+	}
+	return nil
+}
+
+// SaveFileContent overwrite the content of a text or markdown file
+// revision is the revision of the file when the client loaded it, ErrModified will be returned if it is changed
+func SaveFileContent(file *models.File, user *models.User, content []byte, revision uint64, c *gin.Context) (err error) {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if file.IsDir != 0 || (file.FileType != "txt" && file.FileType != "md") {
+		return ErrRequestPara
+	}
+	if file.Revision != revision {
+		return ErrModified
 	}
-	if errEncrypt != nil {
+	newSize := uint64(len(content))
+	// Compared without subtracting, the used storage may be less than the size of the file and wrap around
+	if user.UsedStorage+newSize > user.Storage+file.Size {
+		return ErrStorage
+	}
+	if user.Encryption > 3 || user.Encryption < 0 {
 		return ErrSystem
 	}
-	err = ioutil.WriteFile(dst, encryptedContent, 0644)
+	var encryptedContent []byte
+	var dataKey string
+	var dataKeyID uint32
+	encryptedContent, dataKey, dataKeyID, err = encryptFileBlob(content, user, c)
 	if err != nil {
+		return err
+	}
+	folder := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", "files")
+	oldPath := path.Join(folder, file.RealPath)
+	// The content is saved to a new blob and the file is switched to it with the revision,
+	// so the old content is kept if error occurs and the concurrent saves never write the same blob
+	realPath := uuid.New().String()
+	dst := path.Join(folder, realPath)
+	if err = writeBlob(dst, encryptedContent); err != nil {
 		return ErrSave
 	}
+	oldSize := file.Size
+	name, position := file.Name, file.Position
+	var ok bool
+	ok, err = file.UpdateContent(revision, newSize, realPath, dataKey, dataKeyID)
+	if err != nil || !ok {
+		_ = removeBlob(dst)
+		if err != nil {
+			return ErrSave
+		}
+		return ErrModified
+	}
+	file.Name, file.Position = name, position
+	if err = removeBlob(oldPath); err != nil {
+		utils.GetLogger().Error("Delete " + oldPath + " error: " + err.Error())
+	}
+	user.UpdateUsedStorage(user.UsedStorage - oldSize + newSize)
+	utils.GetLogger().Infof("Save content to %s", dst)
+	publishFileEvent(ActionEdit, file, user, c)
 	return nil
 }
 
 // GetFolder return children in the folder
-func GetFolder(folder *models.File, user *models.User) (files []*models.File, err error) {
+func GetFolder(folder *models.File, user *models.User, c *gin.Context) (files []*models.File, err error) {
 	if folder.IsDir != 1 {
 		return nil, ErrRequestPara
 	}
@@ -144,35 +518,54 @@ func GetFolder(folder *models.File, user *models.User) (files []*models.File, er
 	if err != nil {
 		return nil, ErrSystem
 	}
-	return files, err
+	if user.NameKey != "" {
+		if err = decryptFileNames(user, c, files...); err != nil {
+			return nil, err
+		}
+		// The children are sorted by the stored names, sort them again by the decrypted names
+		sort.SliceStable(files, func(i, j int) bool {
+			if files[i].IsDir != files[j].IsDir {
+				return files[i].IsDir > files[j].IsDir
+			}
+			return files[i].Name < files[j].Name
+		})
+	}
+	return files, nil
 }
 
 // NewFileOrFolder create a file or a folder in the current folder
-func NewFileOrFolder(folder *models.File, user *models.User, newName string, t string, c *gin.Context) (err error) {
+func NewFileOrFolder(folder *models.File, user *models.User, newName string, t string, c *gin.Context) (file *models.File, err error) {
 	if folder.OwnerId != user.ID {
-		return ErrInvalidOrPermission
+		return nil, ErrInvalidOrPermission
 	}
 	if folder.IsDir != 1 {
-		return ErrRequestPara
+		return nil, ErrRequestPara
 	}
-	file := models.NewFile()
+	file = models.NewFile()
 	if t == "file" {
 		file.IsDir = 0
 	} else if t == "folder" {
 		file.IsDir = 1
 	} else {
-		return ErrRequestPara
+		return nil, ErrRequestPara
 	}
 	file.ID = uuid.New()
 	file.RealPath = file.ID.String()
-	file.Name = newName
+	if file.Name, err = storeName(user, c, newName); err != nil {
+		return nil, err
+	}
 	file.OwnerId = user.ID
 	file.CreatorId = user.ID
 	// new file or folder size will be always 0, no need to update UsedStorage
 	file.Size = 0
 	file.ParentId = folder.ID
+	file.Position = path.Join(folder.Position, newName)
 	if file.IsDir == 0 {
-		file.FileType = utils.GetFileTypeByName(file.Name)
+		file.FileType, file.MimeType, err = storeFileType(user, c, utils.GetFileTypeByName(newName),
+			utils.GetMimeType(newName, "application/octet-stream"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if t == "file" {
@@ -180,43 +573,193 @@ func NewFileOrFolder(folder *models.File, user *models.User, newName string, t s
 			"data", "files", file.RealPath)
 		utils.GetLogger().Infof("Create file to %s", dst)
 		// If the user encryption setting is enabled, it will also encrypt the empty file
-		encryptedKey := c.Value("encryptionKey").([]byte)
-		var fileEncryptionKey []byte
-		fileEncryptionKey, err = utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
+		// In the vault mode the empty content has no data key, the client writes the first content with one
+		var encryptedContent []byte
+		if user.Vault == 1 {
+			encryptedContent = utils.WrapClientBlob(nil)
+		} else if encryptedContent, file.DataKey, file.DataKeyId, err = encryptFileBlob(make([]byte, 0), user, c); err != nil {
+			return nil, err
+		}
+		err = writeBlob(dst, encryptedContent)
 		if err != nil {
-			return ErrRequestPara
+			return nil, ErrSystem
 		}
-		fileContent := make([]byte, 0)
-		var encryptedContent []byte
-		var errEncrypt error
-		if user.Encryption == 1 {
-			encryptedContent, errEncrypt = utils.EncryptFileAES(fileEncryptionKey, fileContent)
-		} else if user.Encryption == 2 {
-			encryptedContent, errEncrypt = utils.EncryptFileChaCha(fileEncryptionKey, fileContent)
-		} else if user.Encryption == 3 {
-			encryptedContent, errEncrypt = utils.EncryptFileXChaCha(fileEncryptionKey, fileContent)
+	}
+
+	err = file.CreateFile()
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return nil, ErrDuplicate
+		} else if errors.Is(err, models.ErrPendingDeletion) {
+			return nil, ErrDeleting
 		} else {
-			encryptedContent = fileContent
+			return nil, ErrSave
 		}
-		if errEncrypt != nil {
-			return ErrSystem
+	}
+	if err = decryptFileNames(user, c, file); err != nil {
+		return nil, err
+	}
+	file.Name = newName
+	publishFileEvent(ActionCreate, file, user, c)
+	return file, nil
+}
+
+// MakeFolders return the folder at the relative path under the folder, the missing folders will be created like mkdir -p
+// It is safe when the same folders are created concurrently, the folder created by others will be used
+func MakeFolders(folder *models.File, user *models.User, names []string, c *gin.Context) (*models.File, error) {
+	if folder.OwnerId != user.ID {
+		return nil, ErrInvalidOrPermission
+	}
+	if folder.IsDir != 1 {
+		return nil, ErrRequestPara
+	}
+	for _, name := range names {
+		stored, err := storeName(user, c, name)
+		if err != nil {
+			return nil, err
 		}
-		err = ioutil.WriteFile(dst, encryptedContent, 0644)
+		var child *models.File
+		child, err = models.GetFileByName(stored, user, folder.ID)
 		if err != nil {
-			return ErrSystem
+			child = models.NewFile()
+			child.ID = uuid.New()
+			child.RealPath = child.ID.String()
+			child.IsDir = 1
+			child.Name = stored
+			child.OwnerId = user.ID
+			child.CreatorId = user.ID
+			child.ParentId = folder.ID
+			err = child.CreateFile()
+			if errors.Is(err, models.ErrPendingDeletion) {
+				return nil, ErrDeleting
+			}
+			if err != nil {
+				var mysqlErr *mysql.MySQLError
+				if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+					return nil, ErrSave
+				}
+				// Created by another upload at the same time
+				child, err = models.GetFileByName(stored, user, folder.ID)
+				if err != nil {
+					return nil, ErrSystem
+				}
+			} else {
+				child.Name = name
+				child.Position = path.Join(folder.Position, name)
+				publishFileEvent(ActionCreate, child, user, c)
+			}
+		}
+		if child.IsDir != 1 {
+			return nil, ErrConflict
 		}
+		child.Name = name
+		child.Position = path.Join(folder.Position, name)
+		folder = child
 	}
+	return folder, nil
+}
 
-	err = file.CreateFile()
+// RenameFile change the name of the file or folder, the root folder cannot be renamed
+func RenameFile(file *models.File, user *models.User, newName string, c *gin.Context) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if file.ParentId == uuid.Nil {
+		return ErrRequestPara
+	}
+	if file.Name == newName {
+		return nil
+	}
+	stored, err := storeName(user, c, newName)
+	if err != nil {
+		return err
+	}
+	var pending bool
+	if pending, err = file.IsPendingDeletion(); err != nil {
+		return ErrSystem
+	}
+	if pending {
+		return ErrDeleting
+	}
+	oldPath := file.Path
+	err = file.Rename(stored)
 	if err != nil {
 		var mysqlErr *mysql.MySQLError
 		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
 			return ErrDuplicate
-		} else {
-			return ErrSave
 		}
+		return ErrSave
 	}
+	file.Name = newName
+	oldPosition := file.Position
+	file.Position = path.Join(path.Dir(oldPosition), newName)
+	if file.IsDir == 0 {
+		fileType, mimeType := utils.GetFileType(newName, file.MimeType), file.MimeType
+		if fileType != file.FileType {
+			var storedType, storedMime string
+			if storedType, storedMime, err = storeFileType(user, c, fileType, mimeType); err == nil {
+				err = file.UpdateFileType(storedType, storedMime)
+			}
+			if err != nil {
+				utils.GetLogger().Error("Update file type of " + file.ID.String() + " error: " + err.Error())
+			}
+			file.FileType, file.MimeType = fileType, mimeType
+		}
+	}
+	publish(&FileEvent{
+		Action:      ActionRename,
+		File:        file,
+		OldPosition: oldPosition,
+		OldPath:     oldPath,
+		User:        user,
+		ClientIP:    c.ClientIP(),
+		Time:        time.Now(),
+	})
+	return nil
+}
 
+// MoveFile move the file or folder into another folder, the root folder cannot be moved
+// A folder cannot be moved into itself or its sub folders
+func MoveFile(file *models.File, folder *models.File, user *models.User, c *gin.Context) error {
+	if file.OwnerId != user.ID || folder.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if file.ParentId == uuid.Nil || folder.IsDir != 1 {
+		return ErrRequestPara
+	}
+	if file.ParentId == folder.ID {
+		return nil
+	}
+	if folder.Position == file.Position || strings.HasPrefix(folder.Position, file.Position+"/") {
+		return ErrRequestPara
+	}
+	oldPath := file.Path
+	err := file.Move(folder)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return ErrDuplicate
+		}
+		if errors.Is(err, models.ErrPendingDeletion) {
+			return ErrDeleting
+		}
+		if errors.Is(err, models.ErrMoveIntoItself) {
+			return ErrRequestPara
+		}
+		return ErrSave
+	}
+	oldPosition := file.Position
+	file.Position = path.Join(folder.Position, file.Name)
+	publish(&FileEvent{
+		Action:      ActionMove,
+		File:        file,
+		OldPosition: oldPosition,
+		OldPath:     oldPath,
+		User:        user,
+		ClientIP:    c.ClientIP(),
+		Time:        time.Now(),
+	})
 	return nil
 }
 
@@ -236,64 +779,101 @@ func GetFile(file *models.File, user *models.User) (dst, filename string, err er
 	return
 }
 
-// GetFileEncrypted will decrypt the file and return the original file content
-func GetFileEncrypted(dst string, user *models.User, c *gin.Context) ([]byte, error) {
-	encryptedKey := c.Value("encryptionKey").([]byte)
-	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
-	if err != nil {
-		return nil, ErrRequestPara
+// GetFilePreview return the content type and the content used to display the file inline
+// Markdown files will be rendered to HTML
+func GetFilePreview(file *models.File, content []byte) (contentType string, preview []byte, err error) {
+	if file.FileType == "md" {
+		preview, err = utils.RenderMarkdown(content, file.Name)
+		if err != nil {
+			return "", nil, ErrSystem
+		}
+		return "text/html; charset=utf-8", preview, nil
 	}
-	var encryptedFile []byte
-	encryptedFile, err = ioutil.ReadFile(dst)
+	return utils.GetMimeTypeByName(file.Name, file.FileType, file.MimeType), content, nil
+}
+
+// GetFileEncrypted will decrypt the file and return the original file content
+// The algorithm and the key are decided by the format header of the blob
+func GetFileEncrypted(dst string, file *models.File, user *models.User, c *gin.Context) ([]byte, error) {
+	encryptedFile, err := readFileBlob(dst, file)
 	if err != nil {
 		return nil, ErrSystem
 	}
-	var decryptedContent []byte
-	if user.Encryption == 1 {
-		decryptedContent, err = utils.DecryptFileAES(fileEncryptionKey, encryptedFile)
-	} else if user.Encryption == 2 {
-		decryptedContent, err = utils.DecryptFileChaCha(fileEncryptionKey, encryptedFile)
-	} else if user.Encryption == 3 {
-		decryptedContent, err = utils.DecryptFileXChaCha(fileEncryptionKey, encryptedFile)
+	return decryptFileBlob(encryptedFile, file, user, c)
+}
+
+// OpenFileContent open the content of the file to be sent with range requests
+// The plain blobs are read from the disk as they are sent, the encrypted ones are decrypted in memory first.
+// The returned file is nil if the content is decrypted, otherwise it should be closed by the caller
+func OpenFileContent(dst string, file *models.File, user *models.User, c *gin.Context) (io.ReadSeeker, *os.File, error) {
+	// The blobs are replaced by renaming, so the opened one is not changed while it is sent
+	if f, err := os.Open(dst); err == nil {
+		head := make([]byte, utils.BlobHeaderSize)
+		n, _ := io.ReadFull(f, head)
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil && !utils.IsMasterBlob(head[:n]) {
+			if algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, head[:n]); algorithm == 0 {
+				offset := int64(n - len(content))
+				return io.NewSectionReader(f, offset, info.Size()-offset), f, nil
+			}
+		}
+		_ = f.Close()
 	}
+	content, err := GetFileEncrypted(dst, file, user, c)
 	if err != nil {
-		return nil, ErrSystem
+		return nil, nil, err
 	}
-	return decryptedContent, nil
+	return bytes.NewReader(content), nil, nil
+}
 
+// readFileBlob read the blob of the file at dst
+// New content is saved to a new blob and the old one is removed, so the file is loaded again if the blob
+// is replaced after the file is loaded, the data key of the new blob is loaded with it
+func readFileBlob(dst string, file *models.File) ([]byte, error) {
+	blob, err := ioutil.ReadFile(dst)
+	if !os.IsNotExist(err) {
+		return blob, err
+	}
+	latest, errFind := models.GetFileByID(file.ID)
+	if errFind != nil || latest.RealPath == file.RealPath {
+		return nil, err
+	}
+	file.RealPath, file.DataKey, file.DataKeyId = latest.RealPath, latest.DataKey, latest.DataKeyId
+	file.Size, file.Revision, file.UpdatedAt = latest.Size, latest.Revision, latest.UpdatedAt
+	return ioutil.ReadFile(path.Join(path.Dir(dst), latest.RealPath))
 }
 
 // GetFileOrFolderInfoByPath return file or folder
-func GetFileOrFolderInfoByPath(paths []string, user *models.User) (*models.File, error) {
-	rootFolder, err := user.GetRootFolder()
+func GetFileOrFolderInfoByPath(paths []string, user *models.User, c *gin.Context) (*models.File, error) {
+	storedPath, err := storePath(user, c, paths)
 	if err != nil {
-		return nil, ErrSystem
-	}
-	//root folder
-	if len(paths) == 0 {
-		err = rootFolder.TraceRoot()
-		if err != nil {
-			return nil, ErrSystem
+		if errors.Is(err, ErrRequestPara) {
+			// Too long to be encrypted, so it cannot exist
+			return nil, ErrInvalidOrPermission
 		}
-		return rootFolder, nil
+		return nil, err
 	}
+	// The materialized path is indexed, so the file is found in one query regardless of its depth
 	var file *models.File
-	for _, p := range paths {
-		file, err = rootFolder.GetChildInFolderByName(p)
-		if err != nil || file.OwnerId != user.ID {
-			return nil, ErrInvalidOrPermission
-		}
-		rootFolder = file
+	file, err = models.GetFileByPath(user.ID, storedPath)
+	if errors.Is(err, gorm.ErrRecordNotFound) && user.NameKey != "" {
+		// Some names may not be encrypted yet
+		file, err = findFileByNames(user, c, paths)
 	}
-	err = file.TraceRoot()
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidOrPermission
+		}
 		return nil, ErrSystem
 	}
+	if err = decryptFileNames(user, c, file); err != nil {
+		return nil, err
+	}
 	return file, nil
 }
 
 // GetFileOrFolderInfoByID return file or folder
-func GetFileOrFolderInfoByID(vFileID uuid.UUID, user *models.User) (*models.File, error) {
+func GetFileOrFolderInfoByID(vFileID uuid.UUID, user *models.User, c *gin.Context) (*models.File, error) {
 	file, err := models.GetFileByID(vFileID)
 	if err != nil {
 		return nil, ErrInvalidOrPermission
@@ -305,78 +885,265 @@ func GetFileOrFolderInfoByID(vFileID uuid.UUID, user *models.User) (*models.File
 	if err != nil {
 		return nil, ErrSystem
 	}
+	if err = decryptFileNames(user, c, file); err != nil {
+		return nil, err
+	}
 	return file, nil
 }
 
+// deleteJobThreshold folders containing more files and folders than it are deleted by a background job
+const deleteJobThreshold = 500
+
+// deletePayload the parameters of the delete job
+type deletePayload struct {
+	File uuid.UUID `json:"file"`
+}
+
+func init() {
+	registerJobHandler(JobDelete, false, runDelete, cancelDelete)
+	// The name key decrypts the position of the folder in the events of the owners with encrypted names
+	registerJobKeyNeeded(JobDelete, deleteNeedsKey)
+	registerJobUnlock(JobDelete, unlockNameKey)
+}
+
+// deleteNeedsKey check whether the names of the owner of the delete job are encrypted
+func deleteNeedsKey(job *models.Job) bool {
+	user, err := models.GetUserByID(job.OwnerId)
+	return err == nil && user.NameKey != ""
+}
+
 // DeleteFile delete a folder or file
-func DeleteFile(file *models.File, user *models.User) (err error) {
+// Large folders are deleted by a background job, the job is returned in that case
+// If checkVersion is true, it is only deleted if its revision and name are not changed since it is loaded,
+// ErrPrecondition is returned otherwise
+func DeleteFile(file *models.File, user *models.User, checkVersion bool, c *gin.Context) (job *models.Job, err error) {
 	if file.OwnerId != user.ID {
 		err = ErrInvalidOrPermission
 		return
 	}
+	// The files in it are deleted by the job, the used storage would be reduced twice
+	var pending bool
+	if pending, err = file.IsPendingDeletion(); err != nil {
+		return nil, ErrSystem
+	}
+	if pending {
+		return nil, ErrDeleting
+	}
+	if file.IsDir == 1 {
+		var count int64
+		if count, err = models.CountSubtree(file); err != nil {
+			return nil, ErrSystem
+		}
+		if count > deleteJobThreshold {
+			return startDelete(file, user, checkVersion, c)
+		}
+		if checkVersion {
+			// Marked like the large folders, so it is not renamed or moved before it is deleted
+			if err = markDeleting(file, true); err != nil {
+				return nil, err
+			}
+		}
+	} else if checkVersion {
+		var ok bool
+		if ok, err = file.DeleteFileIf(file.Revision, storedName(file)); err != nil {
+			return nil, ErrSave
+		}
+		if !ok {
+			return nil, ErrPrecondition
+		}
+		removeStoredData(file, user)
+		publishFileEvent(ActionDelete, file, user, c)
+		return nil, nil
+	}
 	//Will not raise error
 	DeleteFileRecursively(file, user)
-	return nil
+	publishFileEvent(ActionDelete, file, user, c)
+	return nil, nil
 }
 
 // DeleteFileRecursively help to delete a file or folder recursively
 func DeleteFileRecursively(file *models.File, user *models.User) {
-	deleteQueue := []*models.File{file}
-	//Max 65536 level
-	level := 0
-	count := 1
-	for len(deleteQueue) > 0 && level < 65536 {
-		count--
-		root := deleteQueue[0]
-		if root.IsDir == 1 {
-			child, err := root.GetChildInFolder()
-			if err == nil {
-				deleteQueue = append(deleteQueue, child...)
+	// The folder and all its children are found by the materialized path in one query
+	files, err := models.GetSubtree(file)
+	if err != nil {
+		utils.GetLogger().Error("Find files in " + file.ID.String() + " error: " + err.Error())
+		if file.Deleting == 1 {
+			_ = file.UnmarkDeleting()
+		}
+		return
+	}
+	for _, v := range files {
+		deleteStoredFile(v, user)
+	}
+}
+
+// deleteStoredFile delete the record and the blob of a file or folder, its children are not deleted
+func deleteStoredFile(file *models.File, user *models.User) {
+	file.DeleteFile()
+	removeStoredData(file, user)
+}
+
+// removeStoredData remove the blob of the deleted file or folder and reduce the used storage
+func removeStoredData(file *models.File, user *models.User) {
+	if file.IsDir == 0 {
+		// Reduce used storage
+		user.UpdateUsedStorage(user.UsedStorage - file.Size)
+	}
+	dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
+		"data", "files", file.RealPath)
+	err := removeBlob(dst)
+	utils.GetLogger().Info("Delete file in " + dst)
+	if file.IsDir == 0 {
+		removeCover(file, user)
+	}
+	//Will skip deleting the file if error
+	if err != nil {
+		utils.GetLogger().Error("Error deleting " + dst)
+	}
+}
+
+// markDeleting mark the folder as being deleted
+// If checkVersion is true, it is only marked if its revision and name are not changed since it is loaded
+func markDeleting(folder *models.File, checkVersion bool) error {
+	var ok bool
+	var err error
+	if checkVersion {
+		ok, err = folder.MarkDeletingIf(folder.Revision, storedName(folder))
+	} else {
+		ok, err = folder.MarkDeleting()
+	}
+	if err != nil {
+		return ErrSave
+	}
+	if !ok {
+		if checkVersion {
+			// Renamed or deleted by others rather than being deleted
+			if latest, err := models.GetFileByID(folder.ID); err != nil || latest.Deleting == 0 {
+				return ErrPrecondition
 			}
-		} else {
-			// Reduce used storage
-			user.UpdateUsedStorage(user.UsedStorage - root.Size)
 		}
-		root.DeleteFile()
-		dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
-			"data", "files", root.RealPath)
-		err := os.Remove(dst)
-		utils.GetLogger().Info("Delete file in " + dst)
-		//Will skip deleting the file if error
+		return ErrDeleting
+	}
+	return nil
+}
+
+// startDelete mark the folder and queue the job deleting it
+// The folder is hidden until the job is done, and nothing can be created in it or moved into or out of it
+// If checkVersion is true, it is only deleted if it is not changed since it is loaded
+func startDelete(folder *models.File, user *models.User, checkVersion bool, c *gin.Context) (*models.Job, error) {
+	var key []byte
+	if user.NameKey != "" {
+		nameKey, err := decryptNameKey(user, c.Value("encryptionKey").([]byte))
 		if err != nil {
-			utils.GetLogger().Error("Error deleting " + dst)
+			return nil, ErrRequestPara
 		}
-		deleteQueue = deleteQueue[1:]
+		key = nameKey
+	}
+	if err := markDeleting(folder, checkVersion); err != nil {
+		return nil, err
+	}
+	job, err := enqueueJob(user.ID, JobDelete, &deletePayload{File: folder.ID}, key)
+	if err != nil {
+		_ = folder.UnmarkDeleting()
+		return nil, err
+	}
+	return job, nil
+}
 
-		if count == 0 {
-			level++
-			count = len(deleteQueue)
+// cancelDelete show the folder again if the job is cancelled before it runs
+func cancelDelete(job *models.Job) {
+	var payload deletePayload
+	if err := parseJobPayload(job, &payload); err != nil {
+		return
+	}
+	if file, err := models.GetFileByID(payload.File); err == nil {
+		_ = file.UnmarkDeleting()
+	}
+}
+
+// runDelete delete the folder of the job, the deepest files are deleted first,
+// so the folder is still complete if the job is cancelled
+func runDelete(ctx *JobContext) (err error) {
+	var payload deletePayload
+	if err := parseJobPayload(ctx.Job, &payload); err != nil {
+		return err
+	}
+	file, err := models.GetFileByID(payload.File)
+	if err != nil {
+		// Deleted before the restart
+		return nil
+	}
+	defer func() {
+		// The remaining files are kept if the job is cancelled or failed
+		if err != nil {
+			_ = file.UnmarkDeleting()
+		}
+	}()
+	if err = file.TraceRoot(); err != nil {
+		return err
+	}
+	var files []*models.File
+	if files, err = models.GetSubtree(file); err != nil {
+		return err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Count(files[i].Path, "/") > strings.Count(files[j].Path, "/")
+	})
+	ctx.SetTotal(int64(len(files)))
+	var user *models.User
+	for _, v := range files {
+		if ctx.Cancelled() {
+			return ctx.Err()
+		}
+		// Reload the user every time since the used storage may be changed by others during the job
+		if user, err = models.GetUserByID(ctx.Job.OwnerId); err != nil {
+			return err
 		}
+		deleteStoredFile(v, user)
+		ctx.Progress(1, v.Size)
 	}
+	if user == nil {
+		return nil
+	}
+	// The events carry the decrypted names and positions like the events of the requests
+	if ctx.Key != nil {
+		var nc *utils.NameCipher
+		if nc, err = utils.NewNameCipher(ctx.Key); err != nil {
+			return err
+		}
+		file.Name, _ = nc.DecryptName(path.Base(file.Path))
+		file.Position = decryptPath(nc, file.Path)
+	}
+	publishFileEvent(ActionDelete, file, user, nil)
+	return nil
 }
 
 // ChangeFavoriteStatus change the favorite setting in the system
-func ChangeFavoriteStatus(file *models.File, user *models.User) (err error) {
+func ChangeFavoriteStatus(file *models.File, user *models.User, c *gin.Context) (err error) {
 	if file.OwnerId != user.ID {
 		err = ErrInvalidOrPermission
 		return
 	}
+	action := ActionFavorite
 	if file.Favorite == 0 {
 		err = file.AddFavorite()
 	} else {
 		err = file.CancelFavorite()
+		action = ActionUnfavorite
 	}
 	if err != nil {
-		err = ErrFavorite
+		return ErrFavorite
 	}
-	return err
+	publishFileEvent(action, file, user, c)
+	return nil
 }
 
 // GetFavorites return files and folders that are set favorite
-func GetFavorites(user *models.User) (files []*models.File, err error) {
+func GetFavorites(user *models.User, c *gin.Context) (files []*models.File, err error) {
 	files, err = user.FindFavorites()
 	if err != nil {
 		err = ErrSystem
+		return
 	}
 	for _, v := range files {
 		err = v.TraceRoot()
@@ -385,12 +1152,30 @@ func GetFavorites(user *models.User) (files []*models.File, err error) {
 			return
 		}
 	}
+	err = decryptFileNames(user, c, files...)
 	return
 }
 
-// SearchFiles return files based on keyword
-func SearchFiles(user *models.User, keyword string) (files []*models.File, err error) {
-	files, err = user.SearchFiles(keyword)
+// SearchFiles return files based on keyword in the name, the custom properties and the note
+// If tags is not empty, only files with all the tags will be returned
+func SearchFiles(user *models.User, keyword string, tags []uuid.UUID, c *gin.Context) (files []*models.File, err error) {
+	var matchedIDs []uuid.UUID
+	// The encrypted names are matched after decrypted rather than in the database
+	searchName := keyword == "" || user.NameKey == ""
+	if keyword != "" {
+		matchedIDs, err = searchEncryptedMetas(user, keyword, c)
+		if err != nil {
+			return nil, err
+		}
+		if !searchName {
+			var matchedNames []uuid.UUID
+			if matchedNames, err = searchEncryptedNames(user, keyword, c); err != nil {
+				return nil, err
+			}
+			matchedIDs = append(matchedIDs, matchedNames...)
+		}
+	}
+	files, err = user.SearchFiles(keyword, searchName, tags, matchedIDs)
 	if err != nil {
 		err = ErrSystem
 		return
@@ -402,5 +1187,6 @@ func SearchFiles(user *models.User, keyword string) (files []*models.File, err e
 			return
 		}
 	}
+	err = decryptFileNames(user, c, files...)
 	return
 }
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io"
+	"os"
+	"path"
+)
+
+func init() {
+	registerJobHandler(JobBackfillTypes, false, runBackfillFileTypes, nil)
+}
+
+// BackfillFileTypes queue a job detecting the MIME type and the type of the existing files of all the users
+func BackfillFileTypes(admin *models.User) (*models.Job, error) {
+	if _, err := models.GetActiveJob(admin.ID, JobBackfillTypes); err == nil {
+		return nil, ErrInProgress
+	}
+	return enqueueJob(admin.ID, JobBackfillTypes, struct{}{}, nil)
+}
+
+// runBackfillFileTypes detect the MIME type and the type of all existing files and apply the mapping in the config file
+// Files of users enabling encryption cannot be decrypted without the user password,
+// so the MIME type detected when uploading or the extension will be used
+func runBackfillFileTypes(ctx *JobContext) error {
+	users, err := models.GetAllUsers()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, user := range users {
+		var count int64
+		if count, err = models.CountFilesByOwner(user.ID); err != nil {
+			return err
+		}
+		total += count
+	}
+	ctx.SetTotal(total)
+	count := 0
+	for _, user := range users {
+		lastID := uuid.Nil
+		for {
+			if ctx.Cancelled() {
+				return ctx.Err()
+			}
+			var files []*models.File
+			if files, err = models.GetFilesByOwner(user.ID, lastID, 100); err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				break
+			}
+			for _, file := range files {
+				if backfillFileType(file, user) {
+					count++
+				}
+				ctx.Progress(1, 0)
+			}
+			lastID = files[len(files)-1].ID
+		}
+	}
+	utils.GetLogger().Infof("Backfill file types completes, %d files updated", count)
+	return nil
+}
+
+// backfillFileType detect the type of the file again, it returns true if the type is changed
+func backfillFileType(file *models.File, user *models.User) bool {
+	// The types of the files with encrypted names are detected when uploading,
+	// they are encrypted too and cannot be compared without the name key
+	if utils.IsEncryptedName(file.Name) || utils.IsEncryptedName(file.FileType) {
+		return false
+	}
+	mimeType := detectStoredFileMimeType(file, user)
+	if mimeType == "" {
+		mimeType = file.MimeType
+	}
+	if mimeType == "" {
+		mimeType = utils.GetMimeType(file.Name, "application/octet-stream")
+	}
+	fileType := utils.GetFileType(file.Name, mimeType)
+	if fileType == file.FileType && mimeType == file.MimeType {
+		return false
+	}
+	if err := file.UpdateFileType(fileType, mimeType); err != nil {
+		utils.GetLogger().Error("Update file type of " + file.ID.String() + " error: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// detectStoredFileMimeType detect the MIME type from the first bytes of a file not encrypted
+// It returns an empty string if the file is encrypted
+func detectStoredFileMimeType(file *models.File, user *models.User) string {
+	dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
+		"data", "files", file.RealPath)
+	// Not read while a job is writing the blob back
+	unlock := lockBlob(dst)
+	defer unlock()
+	f, err := os.Open(dst)
+	if err != nil {
+		utils.GetLogger().Error("Read file " + dst + " error: " + err.Error())
+		return utils.GetMimeType(file.Name, "application/octet-stream")
+	}
+	defer f.Close()
+	head := make([]byte, utils.BlobHeaderSize+utils.SniffLength)
+	n, _ := io.ReadFull(f, head)
+	algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, head[:n])
+	if algorithm != 0 {
+		return ""
+	}
+	if len(content) == 0 {
+		return utils.GetMimeType(file.Name, "application/octet-stream")
+	}
+	return utils.GetMimeType(file.Name, utils.DetectMimeType(content))
+}
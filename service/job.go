@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"sync"
+	"time"
+)
+
+// Job types
+const (
+	JobMigration     = "migration"
+	JobDelete        = "delete"
+	JobScrub         = "scrub"
+	JobRotateKey     = "rotate_key"
+	JobEncryptNames  = "encrypt_names"
+	JobEncryptAtRest = "encrypt_at_rest"
+	JobBackfillTypes = "backfill_types"
+)
+
+// jobWorkers the number of jobs run at the same time
+const jobWorkers = 2
+
+// jobProgressInterval the minimum interval between saving the progress of a job
+const jobProgressInterval = time.Second
+
+// JobHandler run the job, it should report the progress by the context and stop when it is cancelled
+// The job runs again after a restart, so the handler should skip the items finished before
+type JobHandler func(ctx *JobContext) error
+
+type jobHandler struct {
+	handle JobHandler
+	// needKey the job needs the file encryption key of the owner, which is only kept in memory
+	needKey bool
+	// cancelled clean up the job cancelled before it runs, can be nil
+	cancelled func(job *models.Job)
+	// unlock return the key of the job from the key derived from the password of the owner,
+	// the file encryption key is used if it is nil
+	unlock func(user *models.User, encryptedKey []byte) ([]byte, error)
+	// keyNeeded decide whether the job needs the key for the types needing it only for some owners,
+	// needKey is used if it is nil
+	keyNeeded func(job *models.Job) bool
+}
+
+// JobContext the context passed to the handler, it is cancelled when the cancellation is requested
+type JobContext struct {
+	context.Context
+	Job *models.Job
+	// Key the file encryption key of the owner, nil if the handler does not need it
+	Key      []byte
+	lastSave time.Time
+}
+
+var (
+	jobHandlers   = make(map[string]*jobHandler)
+	jobWorkerOnce sync.Once
+	// jobNotify wake up the workers when a job is queued
+	jobNotify = make(chan struct{}, 1)
+	// jobKeys the file encryption keys of the jobs needing them, by job ID
+	jobKeys sync.Map
+	// runningJobs the cancel functions of the jobs running in this process, by job ID
+	runningJobs sync.Map
+)
+
+// registerJobHandler register the handler of the job type, it should be called in init
+// cancelled is called if the job is cancelled before it runs, it can be nil
+func registerJobHandler(jobType string, needKey bool, handle JobHandler, cancelled func(job *models.Job)) {
+	jobHandlers[jobType] = &jobHandler{handle: handle, needKey: needKey, cancelled: cancelled}
+}
+
+// registerJobUnlock set how the key of the job type is found when the owner logs in again
+func registerJobUnlock(jobType string, unlock func(user *models.User, encryptedKey []byte) ([]byte, error)) {
+	jobHandlers[jobType].unlock = unlock
+}
+
+// registerJobKeyNeeded set how the job type decides whether a job needs the key of the owner
+func registerJobKeyNeeded(jobType string, keyNeeded func(job *models.Job) bool) {
+	jobHandlers[jobType].keyNeeded = keyNeeded
+}
+
+// SetTotal set the number of items of the job
+func (ctx *JobContext) SetTotal(total int64) {
+	ctx.Job.Total = total
+	ctx.save(true)
+}
+
+// Progress add the items and bytes processed, it is saved at most once a second
+func (ctx *JobContext) Progress(items int64, bytes uint64) {
+	ctx.Job.Done += items
+	ctx.Job.Bytes += bytes
+	ctx.save(false)
+}
+
+// save the progress and check the cancellation requested by another process
+func (ctx *JobContext) save(force bool) {
+	if !force && time.Since(ctx.lastSave) < jobProgressInterval {
+		return
+	}
+	ctx.lastSave = time.Now()
+	if err := ctx.Job.UpdateJobProgress(); err != nil {
+		utils.GetLogger().Error("Save progress of job " + ctx.Job.Type + " error: " + err.Error())
+	}
+	if models.IsJobCancelled(ctx.Job.ID) {
+		cancelRunningJob(ctx.Job.ID)
+	}
+}
+
+// Cancelled return true if the cancellation is requested, the handler should stop as soon as possible
+func (ctx *JobContext) Cancelled() bool {
+	return ctx.Err() != nil
+}
+
+// StartJobWorkers requeue the jobs interrupted by the last shutdown and start the workers
+func StartJobWorkers() {
+	jobWorkerOnce.Do(func() {
+		if err := models.RequeueRunningJobs(); err != nil {
+			utils.GetLogger().Error("Requeue jobs error: " + err.Error())
+		}
+		for i := 0; i < jobWorkers; i++ {
+			go func() {
+				ticker := time.NewTicker(10 * time.Second)
+				defer ticker.Stop()
+				for {
+					runQueuedJobs()
+					select {
+					case <-ticker.C:
+					case <-jobNotify:
+					}
+				}
+			}()
+		}
+	})
+}
+
+// notifyJobWorkers wake up a worker without blocking
+func notifyJobWorkers() {
+	select {
+	case jobNotify <- struct{}{}:
+	default:
+	}
+}
+
+// runQueuedJobs run the queued jobs until the queue is empty
+func runQueuedJobs() {
+	for {
+		job, err := models.ClaimQueuedJob()
+		if err != nil {
+			return
+		}
+		runJob(job)
+	}
+}
+
+// runJob run the job by its handler and save the result
+func runJob(job *models.Job) {
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		finishJob(job, 3, "unknown job type")
+		return
+	}
+	// Cancelled before it is claimed
+	if job.Cancel == 1 {
+		finishJob(job, 4, "")
+		if handler.cancelled != nil {
+			handler.cancelled(job)
+		}
+		return
+	}
+	needKey := handler.needKey
+	if handler.keyNeeded != nil {
+		needKey = handler.keyNeeded(job)
+	}
+	var key []byte
+	if needKey {
+		value, ok := jobKeys.Load(job.ID)
+		if !ok {
+			// Lost after a restart, it continues when the owner logs in again
+			job.Status = 5
+			if err := job.UpdateJobStatus(); err != nil {
+				utils.GetLogger().Error("Save job status error: " + err.Error())
+			}
+			return
+		}
+		key = value.([]byte)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runningJobs.Store(job.ID, cancel)
+	defer func() {
+		runningJobs.Delete(job.ID)
+		cancel()
+	}()
+	jobCtx := &JobContext{Context: ctx, Job: job, Key: key, lastSave: time.Now()}
+	err := runJobHandler(handler.handle, jobCtx)
+	if err == nil {
+		finishJob(job, 2, "")
+	} else if jobCtx.Cancelled() {
+		finishJob(job, 4, "")
+	} else {
+		utils.GetLogger().Error("Job " + job.Type + " error: " + err.Error())
+		finishJob(job, 3, err.Error())
+	}
+}
+
+// runJobHandler call the handler, a panic fails the job instead of stopping the worker
+func runJobHandler(handle JobHandler, ctx *JobContext) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("job panicked")
+		}
+	}()
+	return handle(ctx)
+}
+
+// finishJob save the final status of the job and forget its key
+func finishJob(job *models.Job, status int, message string) {
+	jobKeys.Delete(job.ID)
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	if len(message) > 512 {
+		message = message[:512]
+	}
+	job.Error = message
+	if err := job.UpdateJobStatus(); err != nil {
+		utils.GetLogger().Error("Save job status error: " + err.Error())
+	}
+}
+
+// cancelRunningJob cancel the context of the job if it is running in this process
+func cancelRunningJob(id uint) {
+	if cancel, ok := runningJobs.Load(id); ok {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+// enqueueJob save a queued job and wake up the workers
+// key is the file encryption key of the owner if the handler needs it
+func enqueueJob(owner uuid.UUID, jobType string, payload interface{}, key []byte) (*models.Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	job := &models.Job{OwnerId: owner, Type: jobType, Payload: string(data)}
+	if err = job.CreateJob(); err != nil {
+		return nil, ErrSave
+	}
+	if key != nil {
+		jobKeys.Store(job.ID, key)
+	}
+	notifyJobWorkers()
+	return job, nil
+}
+
+// resumeJob give the key to the job and queue it again if it is waiting for the key
+func resumeJob(job *models.Job, key []byte) error {
+	jobKeys.Store(job.ID, key)
+	if job.Status != 5 {
+		return nil
+	}
+	job.Status = 0
+	if err := job.UpdateJobStatus(); err != nil {
+		return ErrSave
+	}
+	notifyJobWorkers()
+	return nil
+}
+
+// ResumeWaitingJobs queue the jobs of the user waiting for the key again with the key in the session
+func ResumeWaitingJobs(user *models.User, encryptedKey []byte) error {
+	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
+	if err != nil {
+		return ErrRequestPara
+	}
+	var jobs []*models.Job
+	jobs, err = models.GetWaitingJobs(user.ID)
+	if err != nil {
+		return ErrSystem
+	}
+	for _, job := range jobs {
+		key := fileEncryptionKey
+		if handler, ok := jobHandlers[job.Type]; ok && handler.unlock != nil {
+			if key, err = handler.unlock(user, encryptedKey); err != nil {
+				return ErrRequestPara
+			}
+		}
+		if err = resumeJob(job, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseJobPayload decode the parameters of the job
+func parseJobPayload(job *models.Job, payload interface{}) error {
+	return json.Unmarshal([]byte(job.Payload), payload)
+}
+
+// GetJob return the job of the user, admins can get the jobs of all users
+func GetJob(user *models.User, id uint) (*models.Job, error) {
+	job, err := models.GetJobByID(id)
+	if err != nil {
+		return nil, ErrInvalidOrPermission
+	}
+	if job.OwnerId != user.ID && user.Status != 1 {
+		return nil, ErrInvalidOrPermission
+	}
+	return job, nil
+}
+
+// GetJobs return a page of the jobs of the user, page starts from 1
+func GetJobs(user *models.User, page int, pageSize int) ([]*models.Job, int64, error) {
+	return getJobs(user.ID, page, pageSize)
+}
+
+// GetAllJobs return a page of the jobs of all users, page starts from 1
+func GetAllJobs(page int, pageSize int) ([]*models.Job, int64, error) {
+	return getJobs(uuid.Nil, page, pageSize)
+}
+
+func getJobs(uid uuid.UUID, page int, pageSize int) ([]*models.Job, int64, error) {
+	if page < 1 || pageSize < 1 {
+		return nil, 0, ErrRequestPara
+	}
+	jobs, total, err := models.GetJobs(uid, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	return jobs, total, nil
+}
+
+// CancelJob request the cancellation of the job, the handler stops at the next item
+func CancelJob(user *models.User, id uint) error {
+	job, err := GetJob(user, id)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	ok, err = models.CancelPendingJob(job.ID)
+	if err != nil {
+		return ErrSave
+	}
+	if ok {
+		jobKeys.Delete(job.ID)
+		if handler, found := jobHandlers[job.Type]; found && handler.cancelled != nil {
+			handler.cancelled(job)
+		}
+		return nil
+	}
+	ok, err = models.RequestJobCancel(job.ID)
+	if err != nil {
+		return ErrSave
+	}
+	if !ok {
+		// Finished already
+		return ErrRequestPara
+	}
+	cancelRunningJob(job.ID)
+	return nil
+}
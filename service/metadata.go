@@ -0,0 +1,182 @@
+package service
+
+import (
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"strings"
+)
+
+// maxMetaValueLength the max length of the property value or the note
+const maxMetaValueLength = 16384
+
+// encryptMetaValue encrypt the value with the user setting, return the algorithm and the key ID used
+// The values of the users in the vault mode are saved as they are sent, the client encrypts them if needed
+func encryptMetaValue(user *models.User, value string, c *gin.Context) (string, int, uint32, error) {
+	if user.Encryption == 0 || user.Vault == 1 {
+		return value, 0, 0, nil
+	}
+	fileEncryptionKey, keyID, err := getCurrentFileKey(user, c)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	var encrypted []byte
+	encrypted, err = utils.EncryptFile(user.Encryption, fileEncryptionKey, []byte(value))
+	if err != nil {
+		return "", 0, 0, ErrSystem
+	}
+	return hex.EncodeToString(encrypted), user.Encryption, keyID, nil
+}
+
+// decryptMetaValues decrypt the values of the properties in place
+func decryptMetaValues(metas []*models.FileMeta, user *models.User, c *gin.Context) error {
+	// The values encrypted before the vault mode is enabled are returned with their algorithm and key ID,
+	// the client decrypts them by the file encryption key
+	if user.Vault == 1 {
+		return nil
+	}
+	// The values may be encrypted by the old key during key rotation
+	fileEncryptionKeys := make(map[uint32][]byte)
+	for _, meta := range metas {
+		if meta.Encryption == 0 {
+			continue
+		}
+		fileEncryptionKey, ok := fileEncryptionKeys[meta.KeyId]
+		if !ok {
+			var err error
+			fileEncryptionKey, err = getFileKeyByID(user, meta.KeyId, c)
+			if err != nil {
+				return err
+			}
+			fileEncryptionKeys[meta.KeyId] = fileEncryptionKey
+		}
+		encrypted, err := hex.DecodeString(meta.Value)
+		if err != nil {
+			return ErrSystem
+		}
+		var value []byte
+		value, err = utils.DecryptFile(meta.Encryption, fileEncryptionKey, encrypted)
+		if err != nil {
+			return ErrSystem
+		}
+		meta.Value = string(value)
+		meta.Encryption = 0
+	}
+	return nil
+}
+
+// SetFileMeta create or replace a custom property of the file or folder
+func SetFileMeta(file *models.File, user *models.User, key string, value string, c *gin.Context) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if len(key) == 0 || len(key) > 100 {
+		return ErrRequestPara
+	}
+	return saveFileMeta(file, user, key, value, c)
+}
+
+// SetFileNote save the note of the file or folder, the note will be removed if it is empty
+func SetFileNote(file *models.File, user *models.User, note string, c *gin.Context) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if note == "" {
+		if _, err := models.DeleteFileMeta(file.ID, ""); err != nil {
+			return ErrSave
+		}
+		return nil
+	}
+	return saveFileMeta(file, user, "", note, c)
+}
+
+func saveFileMeta(file *models.File, user *models.User, key string, value string, c *gin.Context) error {
+	if len(value) > maxMetaValueLength {
+		return ErrRequestPara
+	}
+	encrypted, encryption, keyID, err := encryptMetaValue(user, value, c)
+	if err != nil {
+		return err
+	}
+	meta := &models.FileMeta{
+		FileId:     file.ID,
+		OwnerId:    user.ID,
+		Key:        key,
+		Value:      encrypted,
+		Encryption: encryption,
+		KeyId:      keyID,
+	}
+	if err = meta.SaveFileMeta(); err != nil {
+		return ErrSave
+	}
+	return nil
+}
+
+// DeleteFileMeta delete a custom property of the file or folder
+func DeleteFileMeta(file *models.File, user *models.User, key string) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if len(key) == 0 {
+		return ErrRequestPara
+	}
+	ok, err := models.DeleteFileMeta(file.ID, key)
+	if err != nil {
+		return ErrSave
+	}
+	if !ok {
+		return ErrInvalidOrPermission
+	}
+	return nil
+}
+
+// GetFileMetadata return the note and the decrypted custom properties of the file or folder
+func GetFileMetadata(file *models.File, user *models.User, c *gin.Context) (note string, metas []*models.FileMeta, err error) {
+	if file.OwnerId != user.ID {
+		return "", nil, ErrInvalidOrPermission
+	}
+	var all []*models.FileMeta
+	all, err = models.GetFileMetas(file.ID)
+	if err != nil {
+		return "", nil, ErrSystem
+	}
+	if err = decryptMetaValues(all, user, c); err != nil {
+		return "", nil, err
+	}
+	metas = make([]*models.FileMeta, 0, len(all))
+	for _, v := range all {
+		if v.Key == "" {
+			note = v.Value
+		} else {
+			metas = append(metas, v)
+		}
+	}
+	return note, metas, nil
+}
+
+// searchEncryptedMetas return the files whose encrypted properties or note contain the keyword
+func searchEncryptedMetas(user *models.User, keyword string, c *gin.Context) ([]uuid.UUID, error) {
+	if user.Vault == 1 {
+		return nil, nil
+	}
+	metas, err := models.GetEncryptedFileMetas(user.ID)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	if len(metas) == 0 {
+		return nil, nil
+	}
+	if err = decryptMetaValues(metas, user, c); err != nil {
+		return nil, err
+	}
+	keyword = strings.ToLower(keyword)
+	var ids []uuid.UUID
+	for _, v := range metas {
+		if strings.Contains(strings.ToLower(v.Value), keyword) {
+			ids = append(ids, v.FileId)
+		}
+	}
+	return ids, nil
+}
@@ -1,74 +1,531 @@
 package service
 
 import (
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"home-cloud/models"
 	"home-cloud/utils"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
-// MigrateAlgorithm will enter the current user data path, decrypt the file and encrypt it using new algorithm
-// then, it will set back the Migration status of the user to normal
-func MigrateAlgorithm(user *models.User, oldAlgorithm int, newAlgorithm int, fileEncryptionKey []byte) {
-	utils.GetLogger().Info("Migrating encryption algorithm for user " + user.Username)
+// migrationFolders the folders in the user data folder containing encrypted blobs
+// covers contain the cover art extracted from audio files
+var migrationFolders = []string{"files", "covers"}
+
+// migrationBatch the number of items loaded at a time
+const migrationBatch = 200
+
+// errUndecryptable the blob cannot be decrypted by the source algorithms of the migration
+var errUndecryptable = errors.New("cannot be decrypted with the source algorithm")
+
+// migrationPayload the parameters of the migration job
+type migrationPayload struct {
+	Migration uint `json:"migration"`
+}
+
+func init() {
+	registerJobHandler(JobMigration, true, runMigration, cancelMigration)
+}
+
+// startMigration persist a migration job of all the blobs of the user and run it
+// The key is only kept in memory, the job will wait for the user to log in again if the process restarts
+func startMigration(user *models.User, oldAlgorithm int, newAlgorithm int, fileEncryptionKey []byte) error {
+	if _, err := models.GetActiveMigrationJob(user.ID); err == nil {
+		return ErrInProgress
+	}
+	// Set first, so the user will be found by RecoverMigrations if the process crashes before the job is saved.
+	// The update is conditional, two requests passing the check above cannot both start a migration
+	ok, err := user.StartMigration()
+	if err != nil {
+		return ErrSave
+	}
+	if !ok {
+		return ErrInProgress
+	}
+	job, err := createMigrationJob(user, oldAlgorithm, newAlgorithm)
+	if err != nil {
+		user.SetMigration(0)
+		return ErrSave
+	}
+	// New blobs will be written with the new algorithm during migration
 	user.SetEncryption(newAlgorithm)
-	userFilePath := path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
-		"data", "files")
-	files, err := os.ReadDir(userFilePath)
+	if _, err = enqueueJob(user.ID, JobMigration, &migrationPayload{Migration: job.ID}, fileEncryptionKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// listUserBlobs return the blobs in the user data folder as items, the temp files are skipped
+func listUserBlobs(user *models.User) ([]*models.MigrationItem, error) {
+	var items []*models.MigrationItem
+	for _, folder := range migrationFolders {
+		entries, err := os.ReadDir(path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", folder))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			// Skip the temp files left by a crash
+			if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+				continue
+			}
+			items = append(items, &models.MigrationItem{Folder: folder, Name: entry.Name()})
+		}
+	}
+	return items, nil
+}
+
+// createMigrationJob save the job with an item for each blob in the user data folder
+func createMigrationJob(user *models.User, oldAlgorithm int, newAlgorithm int) (*models.MigrationJob, error) {
+	items, err := listUserBlobs(user)
 	if err != nil {
-		utils.GetLogger().Fatal("Migration encrypted file for user " + user.Username + " error: " + err.Error())
-		user.SetMigration(2)
+		return nil, err
+	}
+	job := &models.MigrationJob{
+		UserId:       user.ID,
+		OldAlgorithm: oldAlgorithm,
+		NewAlgorithm: newAlgorithm,
+	}
+	if err = models.CreateMigrationJob(job, items); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// RecoverMigrations find the migrations interrupted by a restart when starting
+// The jobs need the file encryption key, so they will wait for ResumeMigration when the users log in
+func RecoverMigrations() {
+	users, err := models.GetUsersInMigration()
+	if err != nil {
+		utils.GetLogger().Error("Find users in migration error: " + err.Error())
 		return
 	}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	for _, user := range users {
+		var job *models.MigrationJob
+		if job, err = models.GetActiveMigrationJob(user.ID); err != nil {
+			// Interrupted before jobs were persisted, the old algorithm is unknown
+			if job, err = createMigrationJob(user, -1, user.Encryption); err != nil {
+				utils.GetLogger().Error("Create migration job for user " + user.Username + " error: " + err.Error())
+				continue
+			}
 		}
-		filePath := path.Join(userFilePath, file.Name())
-		var fileContent []byte
-		fileContent, err = ioutil.ReadFile(filePath)
+		if _, err = models.GetActiveJob(user.ID, JobMigration); err != nil {
+			if _, err = enqueueJob(user.ID, JobMigration, &migrationPayload{Migration: job.ID}, nil); err != nil {
+				utils.GetLogger().Error("Queue migration job for user " + user.Username + " error: " + err.Error())
+				continue
+			}
+		}
+		utils.GetLogger().Info("Migration for user " + user.Username + " will be resumed when the user logs in")
+	}
+}
+
+// ResumeMigration continue the unfinished migration of the user with the key sent when logging in
+// Failed jobs will not be resumed until an admin retries or rolls back them
+func ResumeMigration(user *models.User, encryptionKey string) error {
+	encryptedKey, err := hex.DecodeString(encryptionKey)
+	if err != nil {
+		return ErrRequestPara
+	}
+	var fileEncryptionKey []byte
+	fileEncryptionKey, err = utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
+	if err != nil {
+		return ErrRequestPara
+	}
+	var migration *models.MigrationJob
+	migration, err = models.GetActiveMigrationJob(user.ID)
+	if err != nil {
+		return ErrInvalidOrPermission
+	}
+	if migration.Status != 0 {
+		return ErrRequestPara
+	}
+	var job *models.Job
+	if job, err = models.GetActiveJob(user.ID, JobMigration); err == nil {
+		return resumeJob(job, fileEncryptionKey)
+	}
+	_, err = enqueueJob(user.ID, JobMigration, &migrationPayload{Migration: migration.ID}, fileEncryptionKey)
+	return err
+}
+
+// runMigration migrate the pending items of the migration, the progress is saved after each item
+// The blobs with the format header are decrypted by the algorithm in it, sources are only tried for legacy blobs
+func runMigration(ctx *JobContext) error {
+	var payload migrationPayload
+	if err := parseJobPayload(ctx.Job, &payload); err != nil {
+		return err
+	}
+	job, err := models.GetMigrationJobByID(payload.Migration)
+	if err != nil {
+		return err
+	}
+	var user *models.User
+	user, err = models.GetUserByID(job.UserId)
+	if err != nil {
+		return err
+	}
+	utils.GetLogger().Info("Migrating encryption algorithm for user " + user.Username)
+	target := job.NewAlgorithm
+	sources := []int{job.OldAlgorithm}
+	if job.Rollback == 1 {
+		target, sources = job.OldAlgorithm, []int{job.NewAlgorithm}
+	} else if job.OldAlgorithm < 0 {
+		sources = []int{1, 2, 3, 0}
+	}
+	// Count the items migrated before the restart
+	var count int64
+	if count, err = models.CountMigrationItems(job.ID, 1); err == nil {
+		job.Done = int(count)
+	}
+	if count, err = models.CountMigrationItems(job.ID, 2); err == nil {
+		job.Failed = int(count)
+	}
+	ctx.Job.Done = int64(job.Done + job.Failed)
+	ctx.SetTotal(int64(job.Total))
+	var lastID uint
+	for !ctx.Cancelled() {
+		var items []*models.MigrationItem
+		items, err = models.GetPendingMigrationItems(job.ID, lastID, migrationBatch)
 		if err != nil {
-			utils.GetLogger().Error("Read file " + filePath + " for user " + user.Username + " error: " + err.Error())
-			continue
+			job.LastError = err.Error()
+			break
 		}
-		var originContent []byte
-		var errorDecrypt error
-		if oldAlgorithm == 1 {
-			originContent, errorDecrypt = utils.DecryptFileAES(fileEncryptionKey, fileContent)
-		} else if oldAlgorithm == 2 {
-			originContent, errorDecrypt = utils.DecryptFileChaCha(fileEncryptionKey, fileContent)
-		} else if oldAlgorithm == 3 {
-			originContent, errorDecrypt = utils.DecryptFileXChaCha(fileEncryptionKey, fileContent)
-		} else {
-			originContent = fileContent
-		}
-		if errorDecrypt != nil {
-			utils.GetLogger().Error("Decrypt file " + filePath + " for user " + user.Username + " error: " + errorDecrypt.Error())
-			continue
+		if len(items) == 0 {
+			break
 		}
-		var newContent []byte
-		var errorEncrypt error
-		if newAlgorithm == 1 {
-			newContent, errorEncrypt = utils.EncryptFileAES(fileEncryptionKey, originContent)
-		} else if newAlgorithm == 2 {
-			newContent, errorEncrypt = utils.EncryptFileChaCha(fileEncryptionKey, originContent)
-		} else if newAlgorithm == 3 {
-			newContent, errorEncrypt = utils.EncryptFileXChaCha(fileEncryptionKey, originContent)
-		} else {
-			newContent = originContent
-		}
-		if errorEncrypt != nil {
-			utils.GetLogger().Error("Encrypt file " + filePath + " for user " + user.Username + " error: " + errorEncrypt.Error())
-			continue
+		for _, item := range items {
+			if ctx.Cancelled() {
+				break
+			}
+			lastID = item.ID
+			var size int
+			if size, err = migrateBlob(user, item, sources, target, ctx.Key); err != nil {
+				utils.GetLogger().Error("Migrate " + item.Folder + "/" + item.Name + " for user " + user.Username + " error: " + err.Error())
+				item.Status = 2
+				item.Error = err.Error()
+				if len(item.Error) > 512 {
+					item.Error = item.Error[:512]
+				}
+				job.Failed++
+				job.LastError = item.Error
+			} else {
+				item.Status = 1
+				job.Done++
+			}
+			if err = item.UpdateMigrationItem(); err != nil {
+				utils.GetLogger().Error("Save migration progress error: " + err.Error())
+			}
+			ctx.Progress(1, uint64(size))
+		}
+		if err = job.UpdateMigrationJob(); err != nil {
+			utils.GetLogger().Error("Save migration progress error: " + err.Error())
 		}
+	}
+	if ctx.Cancelled() {
+		finishCancelledMigration(job)
+		return ctx.Err()
+	}
+	// Reload the user since it may be changed during migration
+	if user, err = models.GetUserByID(job.UserId); err != nil {
+		return err
+	}
+	success := job.Failed == 0 && job.Done == job.Total
+	if success {
+		job.Status = 1
+		utils.GetLogger().Info("Migrating encryption algorithm for user " + user.Username + " completes")
+		user.SetMigration(0)
+	} else {
+		job.Status = 2
+		utils.GetLogger().Error("Migrating encryption algorithm for user " + user.Username + " failed: " + job.LastError)
+		user.SetMigration(2)
+	}
+	if err = job.UpdateMigrationJob(); err != nil {
+		utils.GetLogger().Error("Save migration job error: " + err.Error())
+	}
+	queueMigrationFinished(user, job.OldAlgorithm, job.NewAlgorithm, success)
+	if !success {
+		return errors.New(job.LastError)
+	}
+	return nil
+}
 
-		err = ioutil.WriteFile(filePath, newContent, 0644)
-		if err != nil {
-			utils.GetLogger().Error("Write file " + filePath + " for user " + user.Username + " error: " + err.Error())
+// cancelMigration finish the migration whose job is cancelled before it runs
+func cancelMigration(job *models.Job) {
+	var payload migrationPayload
+	if err := parseJobPayload(job, &payload); err != nil {
+		return
+	}
+	migration, err := models.GetMigrationJobByID(payload.Migration)
+	if err != nil || migration.Status != 0 {
+		return
+	}
+	finishCancelledMigration(migration)
+}
+
+// finishCancelledMigration let the user log in again after the migration is cancelled
+// The migrated blobs are kept, they are still readable since the algorithm is in their format header
+func finishCancelledMigration(job *models.MigrationJob) {
+	job.Status = 3
+	if err := job.UpdateMigrationJob(); err != nil {
+		utils.GetLogger().Error("Save migration job error: " + err.Error())
+	}
+	if user, err := models.GetUserByID(job.UserId); err == nil {
+		utils.GetLogger().Info("Migrating encryption algorithm for user " + user.Username + " is cancelled")
+		user.SetMigration(0)
+	}
+}
+
+// migrateBlob decrypt the blob and encrypt it with the target algorithm
+// The blobs of the files are encrypted by the data keys of the files, a data key is created for the file
+// written before it was introduced. The data key is saved before the blob is replaced, it is only used
+// after the blob is written in the envelope format.
+// The blob is replaced atomically, so it is either in the source or the target format after a crash.
+// It is locked until it is replaced, so it is not removed or replaced by others in the meantime
+// It returns the size of the blob read
+func migrateBlob(user *models.User, item *models.MigrationItem, sources []int, target int, fileEncryptionKey []byte) (int, error) {
+	filePath := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", item.Folder, item.Name)
+	unlock := lockBlob(filePath)
+	defer unlock()
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted after the job is created
+			return 0, nil
+		}
+		return 0, err
+	}
+	var file *models.File
+	if item.Folder == "files" {
+		if file, err = getBlobFile(user, item.Name); err != nil {
+			return 0, err
+		}
+	}
+	var originContent []byte
+	if utils.IsMasterBlob(content) {
+		// Encrypted at rest, it is the target format of disabling the encryption
+		if target == 0 {
+			return len(content), nil
+		}
+		if originContent, err = decryptMasterBlob(content); err != nil {
+			return 0, err
+		}
+	} else if header, body, ok := utils.ParseBlobHeader(content); ok {
+		envelope := header.Version == utils.BlobVersionEnvelope
+		// Replaced before the crash but the progress was not saved, or written after the setting is changed
+		// The plain blobs are encrypted at rest if the master key is configured
+		if header.Algorithm == target && ((target == 0 && utils.GetMasterKey() == nil) || (target != 0 && (file == nil || envelope))) {
+			return len(content), nil
+		}
+		key := fileEncryptionKey
+		if envelope && header.Algorithm != 0 {
+			if file == nil || file.DataKey == "" || file.DataKeyId != user.KeyId {
+				return 0, errUndecryptable
+			}
+			if key, err = utils.DecryptEncryptionKey(fileEncryptionKey, file.DataKey); err != nil {
+				return 0, err
+			}
+		}
+		if originContent, err = utils.DecryptFile(header.Algorithm, key, body); err != nil {
+			return 0, err
+		}
+	} else {
+		// The target is tried first for the blobs migrated before the header was introduced
+		candidates := append([]int{target}, sources...)
+		if user.LegacyEncryption >= 0 {
+			candidates = append(candidates, user.LegacyEncryption)
+		}
+		if originContent, err = decryptLegacyBlob(candidates, fileEncryptionKey, content); err != nil {
+			return 0, err
+		}
+	}
+	var newContent []byte
+	if target == 0 {
+		newContent, err = encryptPlainBlob(originContent)
+	} else if file == nil {
+		newContent, err = utils.EncryptBlob(target, user.KeyId, fileEncryptionKey, originContent)
+	} else {
+		var dataKey []byte
+		if dataKey, err = migrationDataKey(user, file, fileEncryptionKey); err != nil {
+			return 0, err
+		}
+		newContent, err = utils.EncryptEnvelopeBlob(target, dataKey, originContent)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(content), utils.WriteFileAtomic(filePath, newContent, 0644)
+}
+
+// getBlobFile return the file stored in the blob, nil if the blob belongs to no file
+func getBlobFile(user *models.User, name string) (*models.File, error) {
+	id, err := uuid.Parse(name)
+	if err != nil {
+		return nil, nil
+	}
+	var file *models.File
+	if file, err = models.GetFileByID(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if file.OwnerId != user.ID || file.RealPath != name {
+		return nil, nil
+	}
+	return file, nil
+}
+
+// migrationDataKey return the data key of the file, a new one is created and saved if the file has none
+func migrationDataKey(user *models.User, file *models.File, fileEncryptionKey []byte) ([]byte, error) {
+	if file.DataKey != "" {
+		if file.DataKeyId != user.KeyId {
+			return nil, errUndecryptable
+		}
+		return utils.DecryptEncryptionKey(fileEncryptionKey, file.DataKey)
+	}
+	dataKey, err := utils.GenerateFileEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	var encryptedDataKey string
+	if encryptedDataKey, err = utils.EncryptEncryptionKey(fileEncryptionKey, dataKey); err != nil {
+		return nil, err
+	}
+	var ok bool
+	if ok, err = file.SetDataKey("", encryptedDataKey, user.KeyId); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("the file is written during migration")
+	}
+	return dataKey, nil
+}
+
+// decryptLegacyBlob decrypt the blob without the format header by trying the candidate algorithms
+// It is only taken as plain content if 0 is a candidate and the others fail
+func decryptLegacyBlob(candidates []int, fileEncryptionKey []byte, content []byte) ([]byte, error) {
+	plain := false
+	for _, algorithm := range candidates {
+		if algorithm == 0 {
+			plain = true
 			continue
 		}
+		if originContent, err := utils.DecryptFile(algorithm, fileEncryptionKey, content); err == nil {
+			return originContent, nil
+		}
+	}
+	if plain {
+		return content, nil
+	}
+	return nil, errUndecryptable
+}
+
+// queueMigrationFinished notify the webhooks of the user and admins about the migration result
+func queueMigrationFinished(user *models.User, oldAlgorithm int, newAlgorithm int, success bool) {
+	status := "success"
+	if !success {
+		status = "failed"
+	}
+	queueWebhookEvent(EventMigrationFinished, user.ID, user.Username, map[string]interface{}{
+		"old_algorithm": oldAlgorithm,
+		"new_algorithm": newAlgorithm,
+		"status":        status,
+	})
+}
+
+// GetMigrationJobs return a page of the migration jobs of all users, page starts from 1
+func GetMigrationJobs(page int, pageSize int) ([]*models.MigrationJob, int64, error) {
+	if page < 1 || pageSize < 1 {
+		return nil, 0, ErrRequestPara
+	}
+	jobs, total, err := models.GetMigrationJobs((page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	return jobs, total, nil
+}
+
+// getFailedMigrationJob return the failed migration job of the user
+func getFailedMigrationJob(username string) (*models.User, *models.MigrationJob, error) {
+	user, err := models.GetUserByUsername(username)
+	if err != nil {
+		return nil, nil, ErrInvalidOrPermission
+	}
+	var job *models.MigrationJob
+	job, err = models.GetActiveMigrationJob(user.ID)
+	if err != nil || job.Status != 2 || user.Migration != 2 {
+		return nil, nil, ErrInvalidOrPermission
+	}
+	return user, job, nil
+}
+
+// RetryMigration let the failed migration of the user retry the failed blobs when the user logs in
+func RetryMigration(username string) error {
+	user, job, err := getFailedMigrationJob(username)
+	if err != nil {
+		return err
+	}
+	if err = models.ResetMigrationItems(job.ID, false); err != nil {
+		return ErrSave
+	}
+	job.Status = 0
+	job.Failed = 0
+	job.LastError = ""
+	if err = job.UpdateMigrationJob(); err != nil {
+		return ErrSave
+	}
+	user.SetMigration(1)
+	return queueWaitingMigration(user, job)
+}
+
+// RollbackMigration let the failed migration of the user migrate all blobs back to the old algorithm
+// when the user logs in. It is not supported if the old algorithm is unknown
+func RollbackMigration(username string) error {
+	user, job, err := getFailedMigrationJob(username)
+	if err != nil {
+		return err
+	}
+	if job.OldAlgorithm < 0 || job.Rollback == 1 {
+		return ErrRequestPara
+	}
+	if err = models.ResetMigrationItems(job.ID, true); err != nil {
+		return ErrSave
+	}
+	job.Rollback = 1
+	job.Status = 0
+	job.Done = 0
+	job.Failed = 0
+	job.LastError = ""
+	if err = job.UpdateMigrationJob(); err != nil {
+		return ErrSave
+	}
+	user.SetEncryption(job.OldAlgorithm)
+	user.SetMigration(1)
+	return queueWaitingMigration(user, job)
+}
+
+// queueWaitingMigration queue the job of the migration without the key, it runs when the user logs in
+func queueWaitingMigration(user *models.User, migration *models.MigrationJob) error {
+	if _, err := models.GetActiveJob(user.ID, JobMigration); err == nil {
+		return nil
+	}
+	_, err := enqueueJob(user.ID, JobMigration, &migrationPayload{Migration: migration.ID}, nil)
+	return err
+}
+
+// IsMigrationWaitingLogin check if the migration of the user is queued without the key, the key is only known
+// when the user logs in, so the migrations recovered after a restart wait until then
+func IsMigrationWaitingLogin(uid uuid.UUID) bool {
+	job, err := models.GetActiveJob(uid, JobMigration)
+	if err != nil {
+		return false
 	}
-	utils.GetLogger().Info("Migrating encryption algorithm for user " + user.Username + " completes")
-	user.SetMigration(0)
+	_, ok := jobKeys.Load(job.ID)
+	return !ok
 }
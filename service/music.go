@@ -0,0 +1,252 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// getCoverPath return the path of the cover art extracted from the audio file
+func getCoverPath(file *models.File, user *models.User) string {
+	return path.Join(utils.GetConfig().UserDataPath, user.ID.String(),
+		"data", "covers", file.RealPath)
+}
+
+// removeCover remove the cover art of the audio file if exists
+func removeCover(file *models.File, user *models.User) {
+	err := removeBlob(getCoverPath(file, user))
+	if err != nil && !os.IsNotExist(err) {
+		utils.GetLogger().Error("Delete cover of " + file.ID.String() + " error: " + err.Error())
+	}
+}
+
+// saveTrackInfo read the tags of the uploaded audio file and save it in the music library
+// The cover art will be encrypted in the same way as the files
+// The track of an overwritten file which is no longer an audio file will be removed
+func saveTrackInfo(upFile *multipart.FileHeader, file *models.File, user *models.User, c *gin.Context) {
+	removeCover(file, user)
+	if file.FileType != "audio" {
+		models.DeleteTrack(file.ID)
+		return
+	}
+	f, err := upFile.Open()
+	if err != nil {
+		utils.GetLogger().Error("Read audio " + file.ID.String() + " error: " + err.Error())
+		return
+	}
+	var content []byte
+	content, err = ioutil.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		utils.GetLogger().Error("Read audio " + file.ID.String() + " error: " + err.Error())
+		return
+	}
+	track := &models.Track{FileId: file.ID, OwnerId: file.OwnerId}
+	// Files without tags will still be added to the library with its name as the title
+	if tag, errTag := utils.ReadAudioTag(content); errTag == nil {
+		track.Title = tag.Title
+		track.Artist = tag.Artist
+		track.Album = tag.Album
+		track.AlbumArtist = tag.AlbumArtist
+		track.Year = tag.Year
+		track.TrackNumber = tag.Track
+		track.Duration = tag.Duration
+		if tag.Cover != nil && saveCover(tag.Cover, file, user, c) == nil {
+			track.HasCover = 1
+			track.CoverMime = tag.CoverMime
+		}
+	}
+	if track.Title == "" {
+		track.Title = strings.TrimSuffix(file.Name, path.Ext(file.Name))
+	}
+	var nc *utils.NameCipher
+	if nc, err = getNameCipher(user, c); err != nil {
+		utils.GetLogger().Error("Save track " + file.ID.String() + " error: " + err.Error())
+		return
+	}
+	storeTrackTags(nc, track)
+	if err = track.SaveTrack(); err != nil {
+		utils.GetLogger().Error("Save track " + file.ID.String() + " error: " + err.Error())
+	}
+}
+
+// saveCover encrypt the cover art with the user setting and save it
+func saveCover(cover []byte, file *models.File, user *models.User, c *gin.Context) error {
+	encryptedContent, err := encryptBlob(cover, user, c)
+	if err != nil {
+		return err
+	}
+	dst := getCoverPath(file, user)
+	if err = os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return ErrSave
+	}
+	if err = writeBlob(dst, encryptedContent); err != nil {
+		return ErrSave
+	}
+	return nil
+}
+
+// GetCover return the cover art of the audio file and its MIME type
+func GetCover(file *models.File, user *models.User, c *gin.Context) ([]byte, string, error) {
+	if file.OwnerId != user.ID {
+		return nil, "", ErrInvalidOrPermission
+	}
+	if file.IsDir != 0 || file.FileType != "audio" {
+		return nil, "", ErrRequestPara
+	}
+	track, err := models.GetTrackByFileID(file.ID)
+	if err != nil || track.HasCover == 0 {
+		return nil, "", ErrInvalidOrPermission
+	}
+	var encryptedContent []byte
+	encryptedContent, err = ioutil.ReadFile(getCoverPath(file, user))
+	if err != nil {
+		return nil, "", ErrSystem
+	}
+	var cover []byte
+	cover, err = decryptBlob(encryptedContent, user, c)
+	if err != nil {
+		return nil, "", err
+	}
+	var nc *utils.NameCipher
+	if nc, err = getNameCipher(user, c); err != nil {
+		return nil, "", err
+	}
+	if nc != nil {
+		decryptTrackTags(nc, track)
+	}
+	return cover, track.CoverMime, nil
+}
+
+// GetArtists return the artists in the music library
+// The encrypted tags are sorted again after they are decrypted
+func GetArtists(user *models.User, c *gin.Context) ([]*models.Artist, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil {
+		return nil, err
+	}
+	var artists []*models.Artist
+	if artists, err = models.GetArtists(user.ID); err != nil {
+		return nil, ErrSystem
+	}
+	if nc != nil {
+		for _, v := range artists {
+			v.Artist, _ = nc.DecryptName(v.Artist)
+		}
+		sort.SliceStable(artists, func(i, j int) bool {
+			return artists[i].Artist < artists[j].Artist
+		})
+	}
+	return artists, nil
+}
+
+// GetAlbums return the albums in the music library, filtered by artist if byArtist is true
+func GetAlbums(user *models.User, artist string, byArtist bool, c *gin.Context) ([]*models.Album, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil {
+		return nil, err
+	}
+	var albums []*models.Album
+	if albums, err = models.GetAlbums(user.ID, storeMeta(nc, artist), byArtist); err != nil {
+		return nil, ErrSystem
+	}
+	if nc != nil {
+		for _, v := range albums {
+			v.Album, _ = nc.DecryptName(v.Album)
+			v.Artist, _ = nc.DecryptName(v.Artist)
+		}
+		sort.SliceStable(albums, func(i, j int) bool {
+			if albums[i].Artist != albums[j].Artist {
+				return albums[i].Artist < albums[j].Artist
+			}
+			return albums[i].Album < albums[j].Album
+		})
+	}
+	return albums, nil
+}
+
+// GetAlbumTracks return the audio files in the album ordered by track number, the Track field of each file will be set
+func GetAlbumTracks(user *models.User, artist string, album string, c *gin.Context) ([]*models.File, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []*models.Track
+	if tracks, err = models.GetTracks(user.ID, storeMeta(nc, artist), storeMeta(nc, album)); err != nil {
+		return nil, ErrSystem
+	}
+	if nc != nil {
+		for _, v := range tracks {
+			decryptTrackTags(nc, v)
+		}
+		sort.SliceStable(tracks, func(i, j int) bool {
+			if tracks[i].TrackNumber != tracks[j].TrackNumber {
+				return tracks[i].TrackNumber < tracks[j].TrackNumber
+			}
+			return tracks[i].Title < tracks[j].Title
+		})
+	}
+	ids := make([]uuid.UUID, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.FileId
+	}
+	var found []*models.File
+	if found, err = models.GetFilesByIDs(user.ID, ids); err != nil {
+		return nil, ErrSystem
+	}
+	byID := make(map[uuid.UUID]*models.File, len(found))
+	for _, file := range found {
+		byID[file.ID] = file
+	}
+	// In the order of the tracks
+	files := make([]*models.File, 0, len(tracks))
+	for _, track := range tracks {
+		file, ok := byID[track.FileId]
+		if !ok {
+			continue
+		}
+		if err = file.TraceRoot(); err != nil {
+			return nil, ErrSystem
+		}
+		file.Track = track
+		files = append(files, file)
+	}
+	if err = decryptFileNames(user, c, files...); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// BuildPlaylist build the M3U playlist of the audio files pointing to the streaming endpoint
+// baseURL is the scheme and host of the server, e.g. http://127.0.0.1:8080
+func BuildPlaylist(files []*models.File, baseURL string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, file := range files {
+		duration := -1
+		title := file.Name
+		if file.Track != nil {
+			if file.Track.Duration > 0 {
+				duration = file.Track.Duration
+			}
+			title = file.Track.Title
+			if file.Track.Artist != "" {
+				title = file.Track.Artist + " - " + title
+			}
+		}
+		// Line breaks in the title will break the playlist
+		title = strings.NewReplacer("\r", " ", "\n", " ").Replace(title)
+		b.WriteString(fmt.Sprintf("#EXTINF:%d,%s\n", duration, title))
+		b.WriteString(baseURL + "/api/file/stream?dir=" + url.QueryEscape(file.Position) + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// If the names are encrypted, the names and paths of the files and folders are stored encrypted by the name key
+// of the owner, which is encrypted by the file encryption key. Path is always the stored form, while Name and
+// Position are replaced by the decrypted ones after the file is loaded for the request.
+// The types of the files and the text tags of the tracks are encrypted by the same cipher, so they can still be
+// compared and grouped in the queries. Sizes and the numbers of the tracks are kept in plaintext
+
+func init() {
+	registerJobHandler(JobEncryptNames, true, runEncryptNames, nil)
+	registerJobUnlock(JobEncryptNames, unlockNameKey)
+}
+
+// decryptNameKey decrypt the name key of the user with the key derived from the password
+// The name key is encrypted by the old file encryption key if it is not rotated yet
+func decryptNameKey(user *models.User, encryptedKey []byte) ([]byte, error) {
+	wrapped := user.EncryptionKey
+	if user.NameKeyId != user.KeyId {
+		if user.OldEncryptionKey == "" || user.NameKeyId != user.OldKeyId {
+			return nil, errUnknownKey
+		}
+		wrapped = user.OldEncryptionKey
+	}
+	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return utils.DecryptEncryptionKey(fileEncryptionKey, user.NameKey)
+}
+
+// unlockNameKey the job encrypting the names keeps the name key
+func unlockNameKey(user *models.User, encryptedKey []byte) ([]byte, error) {
+	return decryptNameKey(user, encryptedKey)
+}
+
+// getNameCipher return the cipher of the names of the user, nil if the names are not encrypted
+// The cipher is cached in the request
+func getNameCipher(user *models.User, c *gin.Context) (*utils.NameCipher, error) {
+	if user.NameKey == "" {
+		return nil, nil
+	}
+	if nc, ok := c.Value("nameCipher").(*utils.NameCipher); ok {
+		return nc, nil
+	}
+	nameKey, err := decryptNameKey(user, c.Value("encryptionKey").([]byte))
+	if err != nil {
+		return nil, ErrRequestPara
+	}
+	var nc *utils.NameCipher
+	if nc, err = utils.NewNameCipher(nameKey); err != nil {
+		return nil, ErrSystem
+	}
+	c.Set("nameCipher", nc)
+	return nc, nil
+}
+
+// storeName return the name to be saved, it is encrypted if the names of the user are encrypted
+func storeName(user *models.User, c *gin.Context, name string) (string, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil || nc == nil {
+		return name, err
+	}
+	var stored string
+	if stored, err = nc.EncryptName(name); err != nil {
+		return "", ErrRequestPara
+	}
+	return stored, nil
+}
+
+// storePath return the stored path of the position
+func storePath(user *models.User, c *gin.Context, names []string) (string, error) {
+	stored := make([]string, len(names))
+	for i, name := range names {
+		var err error
+		if stored[i], err = storeName(user, c, name); err != nil {
+			return "", err
+		}
+	}
+	return "/" + strings.Join(stored, "/"), nil
+}
+
+// decryptPath decrypt each name in the stored path, the plain names are kept
+func decryptPath(nc *utils.NameCipher, stored string) string {
+	names := strings.Split(stored, "/")
+	for i, name := range names {
+		names[i], _ = nc.DecryptName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// storeMeta return the metadata to be saved, it is encrypted by the name cipher if it is not nil
+// The values too long to be encrypted are truncated, they are only displayed
+func storeMeta(nc *utils.NameCipher, value string) string {
+	if nc == nil || value == "" || utils.IsEncryptedName(value) {
+		return value
+	}
+	n := utils.MaxEncryptedNameLength
+	if len(value) > n {
+		for n > 0 && !utf8.RuneStart(value[n]) {
+			n--
+		}
+		value = value[:n]
+	}
+	stored, _ := nc.EncryptName(value)
+	return stored
+}
+
+// storeFileType return the type and the MIME type of the file to be saved
+func storeFileType(user *models.User, c *gin.Context, fileType string, mimeType string) (string, string, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil {
+		return "", "", err
+	}
+	return storeMeta(nc, fileType), storeMeta(nc, mimeType), nil
+}
+
+// storeTrackTags encrypt the text tags of the track to be saved
+func storeTrackTags(nc *utils.NameCipher, track *models.Track) {
+	track.Title = storeMeta(nc, track.Title)
+	track.Artist = storeMeta(nc, track.Artist)
+	track.Album = storeMeta(nc, track.Album)
+	track.AlbumArtist = storeMeta(nc, track.AlbumArtist)
+	track.CoverMime = storeMeta(nc, track.CoverMime)
+}
+
+// decryptTrackTags replace the text tags of the track by the decrypted ones
+func decryptTrackTags(nc *utils.NameCipher, track *models.Track) {
+	track.Title, _ = nc.DecryptName(track.Title)
+	track.Artist, _ = nc.DecryptName(track.Artist)
+	track.Album, _ = nc.DecryptName(track.Album)
+	track.AlbumArtist, _ = nc.DecryptName(track.AlbumArtist)
+	track.CoverMime, _ = nc.DecryptName(track.CoverMime)
+}
+
+// decryptFileNames replace the names, the positions and the types of the files by the decrypted ones
+// The name of the root folder is the username, which is never encrypted
+func decryptFileNames(user *models.User, c *gin.Context, files ...*models.File) error {
+	nc, err := getNameCipher(user, c)
+	if err != nil || nc == nil {
+		return err
+	}
+	for _, file := range files {
+		if file.ParentId != uuid.Nil {
+			file.Name, _ = nc.DecryptName(path.Base(file.Path))
+		}
+		file.FileType, _ = nc.DecryptName(file.FileType)
+		file.MimeType, _ = nc.DecryptName(file.MimeType)
+		if file.Path != "" {
+			file.Position = decryptPath(nc, file.Path)
+		} else {
+			file.Position = decryptPath(nc, file.Position)
+		}
+	}
+	return nil
+}
+
+// The events are saved with the stored names and positions, so the activities, the changes and the webhook deliveries
+// do not reveal the encrypted names. The activities and the changes are decrypted when they are returned
+
+// storedName return the name of the file as it is saved, Name may be replaced by the decrypted name
+func storedName(file *models.File) string {
+	if file.ParentId == uuid.Nil || file.Path == "" {
+		return file.Name
+	}
+	return path.Base(file.Path)
+}
+
+// storedPosition return the position of the file as it is saved
+func storedPosition(file *models.File) string {
+	if file.Path == "" {
+		return file.Position
+	}
+	return file.Path
+}
+
+// findFileByNames walk the names from the root folder, each name may be saved encrypted or not yet encrypted
+// It is only used when the file is not found by the stored path while the existing names are being encrypted
+func findFileByNames(user *models.User, c *gin.Context, names []string) (*models.File, error) {
+	file, err := models.GetFileByPath(user.ID, "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var stored string
+		if stored, err = storeName(user, c, name); err != nil {
+			return nil, err
+		}
+		var child *models.File
+		if child, err = models.GetFileByName(stored, user, file.ID); err != nil {
+			if child, err = models.GetFileByName(name, user, file.ID); err != nil {
+				return nil, err
+			}
+		}
+		file = child
+	}
+	file.Position = ""
+	return file, nil
+}
+
+// EncryptNames enable the encryption of the names of files and folders for the user, the new names are encrypted
+// at once and the existing names are encrypted in the background. It can be called again to continue the job
+func EncryptNames(user *models.User, c *gin.Context) (*models.Job, error) {
+	// Load again, the key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	if user.Encryption == 0 || user.Vault == 1 {
+		return nil, ErrPrecondition
+	}
+	if _, err = models.GetActiveJob(user.ID, JobEncryptNames); err == nil {
+		return nil, ErrInProgress
+	}
+	if user.NameKey == "" {
+		// The name key is always encrypted by the current key, so it is not enabled during the rotation
+		if user.OldEncryptionKey != "" {
+			return nil, ErrInProgress
+		}
+		var fileEncryptionKey, nameKey []byte
+		if fileEncryptionKey, err = getFileEncryptionKey(user, c); err != nil {
+			return nil, err
+		}
+		if nameKey, err = utils.GenerateFileEncryptionKey(); err != nil {
+			return nil, ErrSystem
+		}
+		var encryptedNameKey string
+		if encryptedNameKey, err = utils.EncryptEncryptionKey(fileEncryptionKey, nameKey); err != nil {
+			return nil, ErrSystem
+		}
+		var ok bool
+		if ok, err = user.EnableNameEncryption(encryptedNameKey, user.KeyId); err != nil {
+			return nil, ErrSave
+		}
+		if !ok {
+			return nil, ErrInProgress
+		}
+		utils.GetLogger().Info("Name encryption for user " + user.Username + " is enabled")
+	}
+	var nameKey []byte
+	if nameKey, err = decryptNameKey(user, c.Value("encryptionKey").([]byte)); err != nil {
+		return nil, ErrRequestPara
+	}
+	return enqueueJob(user.ID, JobEncryptNames, struct{}{}, nameKey)
+}
+
+// encryptNamesReport the result of the job encrypting the names
+type encryptNamesReport struct {
+	// TooLong the files and folders whose names are too long to be encrypted, they should be renamed
+	TooLong []uuid.UUID `json:"too_long"`
+}
+
+// runEncryptNames encrypt the names, the types and the track tags not encrypted yet, the deepest files are
+// renamed first, so the paths of the files not renamed yet are not changed by renaming their folders
+// The job fails if some names are too long to be encrypted, it can be started again after they are renamed
+func runEncryptNames(ctx *JobContext) error {
+	nc, err := utils.NewNameCipher(ctx.Key)
+	if err != nil {
+		return err
+	}
+	var files []*models.File
+	if files, err = models.GetFileNames(ctx.Job.OwnerId); err != nil {
+		return err
+	}
+	plain := files[:0]
+	for _, v := range files {
+		if v.ParentId != uuid.Nil && !utils.IsEncryptedName(v.Name) {
+			plain = append(plain, v)
+		}
+	}
+	sort.SliceStable(plain, func(i, j int) bool {
+		return strings.Count(plain[i].Path, "/") > strings.Count(plain[j].Path, "/")
+	})
+	var types []*models.File
+	if types, err = models.GetFileTypes(ctx.Job.OwnerId); err != nil {
+		return err
+	}
+	var tracks []*models.Track
+	if tracks, err = models.GetTracksByOwner(ctx.Job.OwnerId); err != nil {
+		return err
+	}
+	ctx.SetTotal(int64(len(plain) + len(types) + len(tracks)))
+	report := &encryptNamesReport{TooLong: []uuid.UUID{}}
+	for _, v := range plain {
+		if ctx.Cancelled() {
+			return ctx.Err()
+		}
+		var encrypted bool
+		if encrypted, err = encryptFileName(nc, v.ID); err != nil {
+			return err
+		}
+		if !encrypted {
+			report.TooLong = append(report.TooLong, v.ID)
+		}
+		ctx.Progress(1, 0)
+	}
+	for _, v := range types {
+		if ctx.Cancelled() {
+			return ctx.Err()
+		}
+		fileType, mimeType := storeMeta(nc, v.FileType), storeMeta(nc, v.MimeType)
+		if fileType != v.FileType || mimeType != v.MimeType {
+			// Skipped if it is changed at the same time, the new type is encrypted already
+			if err = v.ReplaceFileType(fileType, mimeType); err != nil {
+				return err
+			}
+		}
+		ctx.Progress(1, 0)
+	}
+	for _, v := range tracks {
+		if ctx.Cancelled() {
+			return ctx.Err()
+		}
+		stored := *v
+		storeTrackTags(nc, &stored)
+		if stored != *v {
+			if err = v.ReplaceTags(stored.Title, stored.Artist, stored.Album, stored.AlbumArtist, stored.CoverMime); err != nil {
+				return err
+			}
+		}
+		ctx.Progress(1, 0)
+	}
+	result, _ := json.Marshal(report)
+	ctx.Job.Result = string(result)
+	if len(report.TooLong) > 0 {
+		return fmt.Errorf("%d names are longer than %d bytes and cannot be encrypted, rename them and start it again",
+			len(report.TooLong), utils.MaxEncryptedNameLength)
+	}
+	return nil
+}
+
+// encryptFileName encrypt the name of the file, the file is loaded again since it may be renamed or moved
+// If the encrypted name exists in the folder, e.g. uploaded after enabling, the name is numbered like uploading
+// encrypted is false if the name is too long to be encrypted
+func encryptFileName(nc *utils.NameCipher, fileID uuid.UUID) (encrypted bool, err error) {
+	file, err := models.GetFileByID(fileID)
+	if err != nil || utils.IsEncryptedName(file.Name) {
+		// Deleted or renamed by the user
+		return true, nil
+	}
+	name := file.Name
+	var mysqlErr *mysql.MySQLError
+	for i := 0; i <= maxRenameAttempts; i++ {
+		if i > 0 {
+			name = numberedName(file.Name, i)
+		}
+		var stored string
+		if stored, err = nc.EncryptName(name); err != nil {
+			return false, nil
+		}
+		if err = file.Rename(stored); err == nil || !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+			return true, err
+		}
+	}
+	return true, err
+}
+
+// searchEncryptedNames return the files whose decrypted names contain the keyword, the root folder is skipped
+func searchEncryptedNames(user *models.User, keyword string, c *gin.Context) ([]uuid.UUID, error) {
+	nc, err := getNameCipher(user, c)
+	if err != nil || nc == nil {
+		return nil, err
+	}
+	var files []*models.File
+	if files, err = models.GetFileNames(user.ID); err != nil {
+		return nil, ErrSystem
+	}
+	keyword = strings.ToLower(keyword)
+	var ids []uuid.UUID
+	for _, v := range files {
+		if v.ParentId == uuid.Nil {
+			continue
+		}
+		name, _ := nc.DecryptName(v.Name)
+		if strings.Contains(strings.ToLower(name), keyword) {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids, nil
+}
+
+// decryptActivityNames replace the stored names and positions in the activities by the decrypted ones
+func decryptActivityNames(user *models.User, c *gin.Context, activities []*models.Activity) error {
+	nc, err := getNameCipher(user, c)
+	if err != nil || nc == nil {
+		return err
+	}
+	for _, v := range activities {
+		v.Name, _ = nc.DecryptName(v.Name)
+		v.Position = decryptPath(nc, v.Position)
+	}
+	return nil
+}
+
+// decryptChangeNames replace the stored names and positions in the changes by the decrypted ones
+func decryptChangeNames(user *models.User, c *gin.Context, changes []*models.Change) error {
+	nc, err := getNameCipher(user, c)
+	if err != nil || nc == nil {
+		return err
+	}
+	for _, v := range changes {
+		v.Name, _ = nc.DecryptName(v.Name)
+		v.Position = decryptPath(nc, v.Position)
+		v.OldPosition = decryptPath(nc, v.OldPosition)
+	}
+	return nil
+}
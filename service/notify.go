@@ -0,0 +1,166 @@
+package service
+
+import (
+	"github.com/google/uuid"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of the live notifications
+const (
+	NotifyCreate   = "create"
+	NotifyUpdate   = "update"
+	NotifyDelete   = "delete"
+	NotifyFavorite = "favorite"
+)
+
+// notifyTypes map the file event actions to the notification types, other actions are not pushed
+var notifyTypes = map[string]string{
+	ActionUpload:     NotifyCreate,
+	ActionCreate:     NotifyCreate,
+	ActionOverwrite:  NotifyUpdate,
+	ActionEdit:       NotifyUpdate,
+	ActionRename:     NotifyUpdate,
+	ActionMove:       NotifyUpdate,
+	ActionDelete:     NotifyDelete,
+	ActionFavorite:   NotifyFavorite,
+	ActionUnfavorite: NotifyFavorite,
+}
+
+// notificationBuffer the number of notifications kept for a slow subscriber
+const notificationBuffer = 64
+
+// Notification a change pushed to the sessions watching the folder
+type Notification struct {
+	// ID increases for each notification of the server
+	ID     uint64    `json:"-"`
+	Type   string    `json:"type"`
+	Action string    `json:"action"`
+	FileID uuid.UUID `json:"file_id"`
+	Name   string    `json:"name"`
+	// Folder the position of the parent folder
+	Folder   string `json:"folder"`
+	Position string `json:"position"`
+	// OldPosition the position before the file is renamed or moved
+	OldPosition string    `json:"old_position,omitempty"`
+	IsDir       bool      `json:"is_dir"`
+	Size        uint64    `json:"size"`
+	Favorite    bool      `json:"favorite"`
+	Revision    uint64    `json:"revision"`
+	Actor       string    `json:"actor"`
+	Time        time.Time `json:"time"`
+}
+
+// Subscription receives the notifications of the folders owned by a user
+type Subscription struct {
+	owner uuid.UUID
+	// folder only the changes in the folder will be received, "/" for all
+	folder    string
+	recursive bool
+	// C is closed when the subscription is cancelled
+	C chan *Notification
+	// overflow is set when notifications are dropped since C is full
+	overflow int32
+}
+
+var (
+	subscriptionsLock sync.RWMutex
+	subscriptions     = map[uuid.UUID]map[*Subscription]struct{}{}
+	notificationID    uint64
+)
+
+func init() {
+	RegisterFileEventHook(notifySubscribers)
+}
+
+// Subscribe start receiving the notifications of the changes in the folder of the owner
+// If recursive is true, the changes in all the sub folders will be received too
+func Subscribe(owner uuid.UUID, folder string, recursive bool) *Subscription {
+	sub := &Subscription{
+		owner:     owner,
+		folder:    path.Clean("/" + folder),
+		recursive: recursive,
+		C:         make(chan *Notification, notificationBuffer),
+	}
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	if subscriptions[owner] == nil {
+		subscriptions[owner] = map[*Subscription]struct{}{}
+	}
+	subscriptions[owner][sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stop the subscription and close its channel
+func Unsubscribe(sub *Subscription) {
+	subscriptionsLock.Lock()
+	defer subscriptionsLock.Unlock()
+	if _, ok := subscriptions[sub.owner][sub]; !ok {
+		return
+	}
+	delete(subscriptions[sub.owner], sub)
+	if len(subscriptions[sub.owner]) == 0 {
+		delete(subscriptions, sub.owner)
+	}
+	close(sub.C)
+}
+
+// Overflowed return true once if some notifications have been dropped, the client should reload the folder
+func (sub *Subscription) Overflowed() bool {
+	return atomic.SwapInt32(&sub.overflow, 0) == 1
+}
+
+// watches check if the change at the position is in the folder of the subscription
+func (sub *Subscription) watches(position string) bool {
+	if sub.recursive {
+		return sub.folder == "/" || position == sub.folder || strings.HasPrefix(position, sub.folder+"/")
+	}
+	return path.Dir(position) == sub.folder
+}
+
+// notifySubscribers push the file event to the subscriptions of the owner without blocking the operation
+func notifySubscribers(event *FileEvent) {
+	notifyType, ok := notifyTypes[event.Action]
+	if !ok || event.File.Position == "" {
+		return
+	}
+	subscriptionsLock.RLock()
+	defer subscriptionsLock.RUnlock()
+	subs := subscriptions[event.File.OwnerId]
+	if len(subs) == 0 {
+		return
+	}
+	notification := &Notification{
+		ID:          atomic.AddUint64(&notificationID, 1),
+		Type:        notifyType,
+		Action:      event.Action,
+		FileID:      event.File.ID,
+		Name:        event.File.Name,
+		Folder:      path.Dir(event.File.Position),
+		Position:    event.File.Position,
+		OldPosition: event.OldPosition,
+		IsDir:       event.File.IsDir == 1,
+		Size:        event.File.Size,
+		Favorite:    event.File.Favorite == 1,
+		Revision:    event.File.Revision,
+		Actor:       event.User.Username,
+		Time:        event.Time,
+	}
+	if notifyType == NotifyFavorite {
+		notification.Favorite = event.Action == ActionFavorite
+	}
+	for sub := range subs {
+		if !sub.watches(notification.Position) &&
+			(notification.OldPosition == "" || !sub.watches(notification.OldPosition)) {
+			continue
+		}
+		select {
+		case sub.C <- notification:
+		default:
+			atomic.StoreInt32(&sub.overflow, 1)
+		}
+	}
+}
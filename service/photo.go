@@ -0,0 +1,105 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"mime/multipart"
+	"time"
+)
+
+// savePhotoInfo extract the EXIF metadata of the uploaded image and save it
+// The metadata of an overwritten file which is no longer an image will be removed
+// For the encrypted accounts, only the dimensions and the orientation are saved. The location, the camera and
+// the capture date would reveal what the encrypted content protects, they are sorted by the upload time instead
+func savePhotoInfo(upFile *multipart.FileHeader, file *models.File, user *models.User) {
+	if file.FileType != "image" {
+		models.DeletePhoto(file.ID)
+		return
+	}
+	f, err := upFile.Open()
+	if err != nil {
+		utils.GetLogger().Error("Read photo " + file.ID.String() + " error: " + err.Error())
+		return
+	}
+	defer f.Close()
+	info := utils.ExtractPhotoInfo(f)
+	photo := &models.Photo{
+		FileId:      file.ID,
+		OwnerId:     file.OwnerId,
+		TakenAt:     time.Now(),
+		CameraMake:  info.CameraMake,
+		CameraModel: info.CameraModel,
+		Orientation: info.Orientation,
+		Width:       info.Width,
+		Height:      info.Height,
+		Latitude:    info.Latitude,
+		Longitude:   info.Longitude,
+	}
+	if info.TakenAt != nil {
+		photo.TakenAt = *info.TakenAt
+	}
+	if user.Encryption != 0 {
+		photo.TakenAt = time.Now()
+		photo.CameraMake, photo.CameraModel = "", ""
+		photo.Latitude, photo.Longitude = nil, nil
+	}
+	if err = photo.SavePhoto(); err != nil {
+		utils.GetLogger().Error("Save photo " + file.ID.String() + " error: " + err.Error())
+	}
+}
+
+// GetPhotoTimeline return a page of the photos of the user in all folders, ordered by capture date
+// page starts from 1, the Photo field of each file will be set
+func GetPhotoTimeline(user *models.User, page int, pageSize int, c *gin.Context) (files []*models.File, total int64, err error) {
+	if page < 1 || pageSize < 1 {
+		return nil, 0, ErrRequestPara
+	}
+	var photos []*models.Photo
+	photos, total, err = models.GetPhotoTimeline(user.ID, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	ids := make([]uuid.UUID, len(photos))
+	for i, v := range photos {
+		ids[i] = v.FileId
+	}
+	var found []*models.File
+	found, err = models.GetFilesByIDs(user.ID, ids)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	fileMap := make(map[uuid.UUID]*models.File, len(found))
+	for _, v := range found {
+		fileMap[v.ID] = v
+	}
+	files = make([]*models.File, 0, len(photos))
+	for _, photo := range photos {
+		file, ok := fileMap[photo.FileId]
+		if !ok {
+			continue
+		}
+		if err = file.TraceRoot(); err != nil {
+			return nil, 0, ErrSystem
+		}
+		file.Photo = photo
+		files = append(files, file)
+	}
+	if err = decryptFileNames(user, c, files...); err != nil {
+		return nil, 0, err
+	}
+	return files, total, nil
+}
+
+// GetPhotoInfo return the EXIF metadata of the image file, nil if it does not exist
+func GetPhotoInfo(file *models.File) *models.Photo {
+	if file.IsDir != 0 || file.FileType != "image" {
+		return nil
+	}
+	photo, err := models.GetPhotoByFileID(file.ID)
+	if err != nil {
+		return nil
+	}
+	return photo
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/utils"
+)
+
+// The file encryption key is only encrypted by the key derived from the password, so it is lost with the password.
+// Two more copies can be kept for recovery, neither of them can be opened by the server alone:
+// the copy encrypted by a random recovery key only known by the user, and the copy sealed to the public key
+// of the admin escrow, whose private key is only provided by the admins when resetting the password.
+
+// CreateRecoveryKey generate a new one-time recovery key for the user, the previous one becomes invalid
+// The recovery key is returned in hex format and it is not saved
+func CreateRecoveryKey(user *models.User, c *gin.Context) (string, error) {
+	// Load again, the file encryption key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return "", ErrSystem
+	}
+	// The file encryption key in the vault mode is never sent to the server
+	if user.Vault == 1 {
+		return "", ErrPrecondition
+	}
+	// The recovery key could not recover the old key, the blobs encrypted by it would be lost
+	if user.OldEncryptionKey != "" {
+		return "", ErrInProgress
+	}
+	var fileEncryptionKey []byte
+	fileEncryptionKey, err = utils.DecryptEncryptionKey(c.Value("encryptionKey").([]byte), user.EncryptionKey)
+	if err != nil {
+		return "", ErrRequestPara
+	}
+	var recoveryKey, key []byte
+	if recoveryKey, err = utils.GenerateFileEncryptionKey(); err != nil {
+		return "", ErrSystem
+	}
+	if key, err = utils.DeriveRecoveryKey(recoveryKey); err != nil {
+		return "", ErrSystem
+	}
+	var encryptedKey string
+	if encryptedKey, err = utils.EncryptEncryptionKey(key, fileEncryptionKey); err != nil {
+		return "", ErrSystem
+	}
+	if err = user.SetRecoveryKey(encryptedKey); err != nil {
+		return "", ErrSave
+	}
+	utils.GetLogger().Info("Recovery key for user " + user.Username + " is generated")
+	return hex.EncodeToString(recoveryKey), nil
+}
+
+// RecoverPassword set a new password with the recovery key, the new password information is derived by the client
+// in the same way as ChangePassword. The recovery key can only be used once
+func RecoverPassword(username string, recoveryKey string, newAccountSalt string, newPassword string, newEncryption string) error {
+	user, err := models.GetUserByUsername(username)
+	if err != nil || user.RecoveryKey == "" {
+		return ErrRequestPara
+	}
+	if user.OldEncryptionKey != "" {
+		return ErrInProgress
+	}
+	var recoveryKeyByte, key []byte
+	if recoveryKeyByte, err = hex.DecodeString(recoveryKey); err != nil || len(recoveryKeyByte) != 32 {
+		return ErrRequestPara
+	}
+	if key, err = utils.DeriveRecoveryKey(recoveryKeyByte); err != nil {
+		return ErrSystem
+	}
+	var fileEncryptionKey []byte
+	if fileEncryptionKey, err = utils.DecryptEncryptionKey(key, user.RecoveryKey); err != nil {
+		return ErrRequestPara
+	}
+	var newEncryptionKeyByte []byte
+	if newEncryptionKeyByte, err = hex.DecodeString(newEncryption); err != nil || len(newEncryptionKeyByte) != 32 {
+		return ErrRequestPara
+	}
+	var newEncryptionKey string
+	if newEncryptionKey, err = utils.EncryptEncryptionKey(newEncryptionKeyByte, fileEncryptionKey); err != nil {
+		return ErrRequestPara
+	}
+	newMacSalt := utils.GenerateSaltOrKey()
+	var ok bool
+	ok, err = user.RecoverPassword(utils.GetHashWithSalt(newPassword, newMacSalt), newAccountSalt, newMacSalt,
+		newEncryptionKey, "", user.RecoveryKey)
+	if err != nil {
+		return ErrSave
+	}
+	if !ok {
+		// Rotated or recovered at the same time, the recovery key is invalidated by either of them
+		return ErrInProgress
+	}
+	return nil
+}
+
+// GetEscrowKey return the latest admin escrow public key
+func GetEscrowKey() (*models.EscrowKey, error) {
+	key, err := models.GetLatestEscrowKey()
+	if err != nil {
+		return nil, ErrInvalidOrPermission
+	}
+	return key, nil
+}
+
+// CreateEscrowKey save a new admin escrow public key, new enrollments are sealed to it
+// If publicKey is empty, a key pair is generated and the private key is returned, it is not saved.
+// The users enrolled before still use the previous key pair until they enroll again
+func CreateEscrowKey(admin *models.User, publicKey string) (*models.EscrowKey, string, error) {
+	var privateKey string
+	if publicKey == "" {
+		var err error
+		if publicKey, privateKey, err = utils.GenerateEscrowKeyPair(); err != nil {
+			return nil, "", ErrSystem
+		}
+	} else if !utils.ValidateEscrowPublicKey(publicKey) {
+		return nil, "", ErrRequestPara
+	}
+	key := &models.EscrowKey{PublicKey: publicKey, CreatorId: admin.ID}
+	if err := key.CreateEscrowKey(); err != nil {
+		return nil, "", ErrSave
+	}
+	utils.GetLogger().Warn("Escrow key " + publicKey + " is created by " + admin.Username)
+	return key, privateKey, nil
+}
+
+// EnrollEscrow seal the file encryption key of the user to the latest admin escrow public key
+func EnrollEscrow(user *models.User, c *gin.Context) error {
+	escrowKey, err := models.GetLatestEscrowKey()
+	if err != nil {
+		return ErrPrecondition
+	}
+	// Load again, the file encryption key may be rotated after the user of the request is loaded
+	if user, err = models.GetUserByID(user.ID); err != nil {
+		return ErrSystem
+	}
+	// Enrolling would give the key of the vault to the admin
+	if user.Vault == 1 {
+		return ErrPrecondition
+	}
+	if user.OldEncryptionKey != "" {
+		return ErrInProgress
+	}
+	var fileEncryptionKey []byte
+	fileEncryptionKey, err = utils.DecryptEncryptionKey(c.Value("encryptionKey").([]byte), user.EncryptionKey)
+	if err != nil {
+		return ErrRequestPara
+	}
+	var sealed string
+	if sealed, err = utils.SealEscrowKey(escrowKey.PublicKey, fileEncryptionKey); err != nil {
+		return ErrSystem
+	}
+	if err = user.SetEscrowKey(sealed, escrowKey.ID); err != nil {
+		return ErrSave
+	}
+	utils.GetLogger().Info("User " + user.Username + " enrolls in the escrow")
+	return nil
+}
+
+// WithdrawEscrow remove the escrowed file encryption key of the user
+func WithdrawEscrow(user *models.User) error {
+	if err := user.SetEscrowKey("", 0); err != nil {
+		return ErrSave
+	}
+	utils.GetLogger().Info("User " + user.Username + " withdraws from the escrow")
+	return nil
+}
+
+// sealRotatedEscrowKey seal the new file encryption key to the escrow public key the user enrolled in,
+// return empty string if the user is not enrolled
+func sealRotatedEscrowKey(user *models.User, newFileEncryptionKey []byte) (string, error) {
+	if user.EscrowKey == "" {
+		return "", nil
+	}
+	escrowKey, err := models.GetEscrowKeyByID(user.EscrowKeyId)
+	if err != nil {
+		return "", err
+	}
+	return utils.SealEscrowKey(escrowKey.PublicKey, newFileEncryptionKey)
+}
+
+// resetUserPasswordByEscrow open the escrowed file encryption keys by the private key provided by the admin,
+// and encrypt them by a new random password. The keys are only in memory during the request
+func resetUserPasswordByEscrow(resetUser *models.User, escrowPrivateKey string) (string, error) {
+	if resetUser.EscrowKey == "" {
+		return "", ErrResetForbidden
+	}
+	escrowKey, err := models.GetEscrowKeyByID(resetUser.EscrowKeyId)
+	if err != nil {
+		return "", ErrSystem
+	}
+	var fileEncryptionKey, oldFileEncryptionKey []byte
+	fileEncryptionKey, err = utils.OpenEscrowKey(escrowKey.PublicKey, escrowPrivateKey, resetUser.EscrowKey)
+	if err != nil {
+		return "", ErrRequestPara
+	}
+	if resetUser.OldEncryptionKey != "" {
+		// Enrolled during the rotation is not allowed, so the old key is always escrowed
+		if resetUser.OldEscrowKey == "" {
+			return "", ErrResetForbidden
+		}
+		oldFileEncryptionKey, err = utils.OpenEscrowKey(escrowKey.PublicKey, escrowPrivateKey, resetUser.OldEscrowKey)
+		if err != nil {
+			return "", ErrRequestPara
+		}
+	}
+	var newPassword, newAccountSalt, newMacSalt, newSavePassword string
+	if newPassword, err = utils.GenerateRandomPassword(); err != nil {
+		return "", ErrSystem
+	}
+	var newEncryptKey []byte
+	newAccountSalt, newMacSalt, newSavePassword, newEncryptKey, err = utils.DerivePasswordInfo(newPassword)
+	if err != nil {
+		return "", ErrSystem
+	}
+	var newEncryptionKey, newOldEncryptionKey string
+	if newEncryptionKey, err = utils.EncryptEncryptionKey(newEncryptKey, fileEncryptionKey); err != nil {
+		return "", ErrSystem
+	}
+	if oldFileEncryptionKey != nil {
+		if newOldEncryptionKey, err = utils.EncryptEncryptionKey(newEncryptKey, oldFileEncryptionKey); err != nil {
+			return "", ErrSystem
+		}
+	}
+	var ok bool
+	ok, err = resetUser.RecoverPassword(newSavePassword, newAccountSalt, newMacSalt, newEncryptionKey, newOldEncryptionKey, "")
+	if err != nil {
+		return "", ErrSave
+	}
+	if !ok {
+		return "", ErrInProgress
+	}
+	return newPassword, nil
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// rotationPasses the maximum passes over the blobs, each pass after the first one checks that
+// no blob is written with the old key by the requests started before the rotation
+const rotationPasses = 3
+
+// errUnknownKey the blob is encrypted by neither the current nor the old key
+var errUnknownKey = errors.New("encrypted by an unknown key")
+
+func init() {
+	registerJobHandler(JobRotateKey, true, runKeyRotation, nil)
+	registerJobUnlock(JobRotateKey, unlockKeyRotation)
+}
+
+// unlockKeyRotation the rotation job keeps the key derived from the password rather than the file encryption key,
+// since both the old and the new file encryption keys are needed
+func unlockKeyRotation(user *models.User, encryptedKey []byte) ([]byte, error) {
+	if _, err := utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey); err != nil {
+		return nil, err
+	}
+	return encryptedKey, nil
+}
+
+// RotateFileKey generate a new file encryption key and re-encrypt all the blobs and properties with it in the background
+// The old key is kept until the job completes, so the files can still be read during rotation.
+// An unfinished rotation, e.g. a cancelled one, will be continued
+func RotateFileKey(user *models.User, c *gin.Context) (*models.Job, error) {
+	// Load again, the key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	// The blobs in the vault mode are encrypted by the client, so they are rotated by the client
+	if user.Vault == 1 {
+		return nil, ErrPrecondition
+	}
+	if user.Migration != 0 {
+		return nil, ErrInProgress
+	}
+	if _, err = models.GetActiveMigrationJob(user.ID); err == nil {
+		return nil, ErrInProgress
+	}
+	for _, jobType := range []string{JobRotateKey, JobScrub} {
+		if _, err = models.GetActiveJob(user.ID, jobType); err == nil {
+			return nil, ErrInProgress
+		}
+	}
+	encryptedKey := c.Value("encryptionKey").([]byte)
+	if _, err = utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey); err != nil {
+		return nil, ErrRequestPara
+	}
+	if user.OldEncryptionKey == "" {
+		var newFileEncryptionKey []byte
+		if newFileEncryptionKey, err = utils.GenerateFileEncryptionKey(); err != nil {
+			return nil, ErrSystem
+		}
+		// Wrapped by the same key derived from the password, so the sessions are still valid
+		var newEncryptionKey string
+		if newEncryptionKey, err = utils.EncryptEncryptionKey(encryptedKey, newFileEncryptionKey); err != nil {
+			return nil, ErrSystem
+		}
+		// The escrowed key is replaced at the same time, the recovery key is invalidated
+		var newEscrowKey string
+		if newEscrowKey, err = sealRotatedEscrowKey(user, newFileEncryptionKey); err != nil {
+			return nil, ErrSystem
+		}
+		var ok bool
+		if ok, err = user.StartKeyRotation(newEncryptionKey, newEscrowKey); err != nil {
+			return nil, ErrSave
+		}
+		if !ok {
+			return nil, ErrInProgress
+		}
+		utils.GetLogger().Info("File encryption key rotation for user " + user.Username + " starts")
+	}
+	return enqueueJob(user.ID, JobRotateKey, struct{}{}, encryptedKey)
+}
+
+// runKeyRotation re-encrypt the blobs, the data keys of the files and the properties encrypted by the old key,
+// then destroy the old key. Each pass lists them again, the rotation completes after a pass finding nothing to re-encrypt
+func runKeyRotation(ctx *JobContext) error {
+	user, err := models.GetUserByID(ctx.Job.OwnerId)
+	if err != nil {
+		return err
+	}
+	if user.OldEncryptionKey == "" {
+		// Completed before the restart
+		return nil
+	}
+	var oldKey, newKey []byte
+	if newKey, err = utils.DecryptEncryptionKey(ctx.Key, user.EncryptionKey); err != nil {
+		return err
+	}
+	if oldKey, err = utils.DecryptEncryptionKey(ctx.Key, user.OldEncryptionKey); err != nil {
+		return err
+	}
+	for pass := 0; ; pass++ {
+		if pass == rotationPasses {
+			return errors.New("blobs are still written by the old key")
+		}
+		var rotated int
+		if rotated, err = rotateBlobs(ctx, user, oldKey, newKey, pass == 0); err != nil {
+			return err
+		}
+		var rotatedDataKeys, rotatedMetas int
+		if rotatedDataKeys, err = rotateDataKeys(user, oldKey, newKey); err != nil {
+			return err
+		}
+		if rotatedMetas, err = rotateMetas(user, oldKey, newKey); err != nil {
+			return err
+		}
+		if pass > 0 && rotated+rotatedDataKeys+rotatedMetas == 0 {
+			break
+		}
+	}
+	if err = rotateNameKey(user, oldKey, newKey); err != nil {
+		return err
+	}
+	if err = user.FinishKeyRotation(); err != nil {
+		return err
+	}
+	utils.GetLogger().Info("File encryption key rotation for user " + user.Username + " completes, the old key is destroyed")
+	return nil
+}
+
+// rotateBlobs re-encrypt the blobs of the user encrypted by the old key, return the number of blobs re-encrypted
+// The progress is only reported in the first pass
+func rotateBlobs(ctx *JobContext, user *models.User, oldKey []byte, newKey []byte, report bool) (int, error) {
+	items, err := listUserBlobs(user)
+	if err != nil {
+		return 0, err
+	}
+	if report {
+		ctx.SetTotal(int64(len(items)))
+	}
+	rotated, failed := 0, 0
+	var lastError error
+	for _, item := range items {
+		if ctx.Cancelled() {
+			return 0, ctx.Err()
+		}
+		size, changed, err := rotateBlob(user, item, oldKey, newKey)
+		if err != nil {
+			utils.GetLogger().Error("Rotate key of " + item.Folder + "/" + item.Name + " for user " + user.Username + " error: " + err.Error())
+			failed++
+			lastError = err
+		} else if changed {
+			rotated++
+		}
+		if report {
+			ctx.Progress(1, uint64(size))
+		}
+	}
+	// The old key is kept, so the job can be started again after the problem is fixed
+	if failed > 0 {
+		return 0, fmt.Errorf("%d blobs cannot be re-encrypted: %s", failed, lastError.Error())
+	}
+	return rotated, nil
+}
+
+// rotateBlob re-encrypt the blob with the new key in the same algorithm, changed is true if it is re-encrypted
+// The blob is locked until it is written back, so it is not removed or replaced by others in the meantime
+func rotateBlob(user *models.User, item *models.MigrationItem, oldKey []byte, newKey []byte) (size int, changed bool, err error) {
+	filePath := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", item.Folder, item.Name)
+	unlock := lockBlob(filePath)
+	defer unlock()
+	var blob []byte
+	if blob, err = ioutil.ReadFile(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, blob)
+	keyID := utils.GetBlobKeyID(blob)
+	// The data keys of the envelope blobs are re-encrypted instead, the blobs are not changed
+	// The blobs encrypted at rest do not depend on the keys of the user
+	if algorithm == 0 || utils.IsEnvelopeBlob(blob) || utils.IsMasterBlob(blob) || keyID == user.KeyId {
+		return len(blob), false, nil
+	}
+	if keyID != user.OldKeyId {
+		return len(blob), false, errUnknownKey
+	}
+	var plainContent []byte
+	if plainContent, err = utils.DecryptFile(algorithm, oldKey, content); err != nil {
+		return len(blob), false, err
+	}
+	var newBlob []byte
+	if newBlob, err = utils.EncryptBlob(algorithm, user.KeyId, newKey, plainContent); err != nil {
+		return len(blob), false, err
+	}
+	return len(blob), true, utils.WriteFileAtomic(filePath, newBlob, 0644)
+}
+
+// rotateDataKeys re-encrypt the data keys of the files encrypted by the old key, return the number re-encrypted
+func rotateDataKeys(user *models.User, oldKey []byte, newKey []byte) (int, error) {
+	files, err := models.GetFilesByDataKeyID(user.ID, user.OldKeyId)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, file := range files {
+		var dataKey []byte
+		if dataKey, err = utils.DecryptEncryptionKey(oldKey, file.DataKey); err != nil {
+			return 0, err
+		}
+		var newDataKey string
+		if newDataKey, err = utils.EncryptEncryptionKey(newKey, dataKey); err != nil {
+			return 0, err
+		}
+		// Skipped if the file is written at the same time, the new data key is encrypted by the new key
+		if _, err = file.SetDataKey(file.DataKey, newDataKey, user.KeyId); err != nil {
+			return 0, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// rotateNameKey re-encrypt the name key if it is encrypted by the old key
+// The names encryption cannot be enabled during the rotation, so it is only checked once
+func rotateNameKey(user *models.User, oldKey []byte, newKey []byte) error {
+	if user.NameKey == "" || user.NameKeyId == user.KeyId {
+		return nil
+	}
+	nameKey, err := utils.DecryptEncryptionKey(oldKey, user.NameKey)
+	if err != nil {
+		return err
+	}
+	var newNameKey string
+	if newNameKey, err = utils.EncryptEncryptionKey(newKey, nameKey); err != nil {
+		return err
+	}
+	return user.UpdateNameKey(user.NameKey, newNameKey, user.KeyId)
+}
+
+// rotateMetas re-encrypt the properties of the user encrypted by the old key, return the number re-encrypted
+func rotateMetas(user *models.User, oldKey []byte, newKey []byte) (int, error) {
+	metas, err := models.GetEncryptedFileMetas(user.ID)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, meta := range metas {
+		if meta.KeyId == user.KeyId {
+			continue
+		}
+		if meta.KeyId != user.OldKeyId {
+			return 0, errUnknownKey
+		}
+		var encrypted []byte
+		if encrypted, err = hex.DecodeString(meta.Value); err != nil {
+			return 0, err
+		}
+		var value []byte
+		if value, err = utils.DecryptFile(meta.Encryption, oldKey, encrypted); err != nil {
+			return 0, err
+		}
+		if encrypted, err = utils.EncryptFile(meta.Encryption, newKey, value); err != nil {
+			return 0, err
+		}
+		oldValue := meta.Value
+		meta.Value = hex.EncodeToString(encrypted)
+		meta.KeyId = user.KeyId
+		// Skipped if it is changed at the same time, the new value is encrypted by the new key
+		if _, err = meta.UpdateFileMetaValue(oldValue); err != nil {
+			return 0, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// scrubReportLimit the maximum number of files listed in each field of the report
+const scrubReportLimit = 1000
+
+// scrubReport the result of the scrub job
+type scrubReport struct {
+	Checked int64 `json:"checked"`
+	// Missing the files whose blob is not found
+	Missing []uuid.UUID `json:"missing"`
+	// Corrupted the files whose blob cannot be decrypted or does not match the size
+	Corrupted []uuid.UUID `json:"corrupted"`
+}
+
+func init() {
+	registerJobHandler(JobScrub, true, runScrub, nil)
+}
+
+// StartScrub queue a job verifying that the blobs of all the files of the user can be read
+// The blobs encrypted by the old key cannot be checked, so it is not allowed during key rotation
+func StartScrub(user *models.User, c *gin.Context) (*models.Job, error) {
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	if user.Vault == 1 {
+		return nil, ErrPrecondition
+	}
+	if user.OldEncryptionKey != "" {
+		return nil, ErrInProgress
+	}
+	if _, err = models.GetActiveJob(user.ID, JobScrub); err == nil {
+		return nil, ErrInProgress
+	}
+	var fileEncryptionKey []byte
+	fileEncryptionKey, err = getFileEncryptionKey(user, c)
+	if err != nil {
+		return nil, err
+	}
+	return enqueueJob(user.ID, JobScrub, struct{}{}, fileEncryptionKey)
+}
+
+// runScrub read and decrypt the blob of every file of the owner, the problems found are saved as the result
+func runScrub(ctx *JobContext) error {
+	user, err := models.GetUserByID(ctx.Job.OwnerId)
+	if err != nil {
+		return err
+	}
+	var total int64
+	if total, err = models.CountFilesByOwner(user.ID); err != nil {
+		return err
+	}
+	ctx.SetTotal(total)
+	report := &scrubReport{Missing: []uuid.UUID{}, Corrupted: []uuid.UUID{}}
+	lastID := uuid.Nil
+	for !ctx.Cancelled() {
+		var files []*models.File
+		files, err = models.GetFilesByOwner(user.ID, lastID, 100)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, file := range files {
+			if ctx.Cancelled() {
+				break
+			}
+			size, missing, ok := scrubFile(file, user, ctx.Key)
+			if missing && len(report.Missing) < scrubReportLimit {
+				report.Missing = append(report.Missing, file.ID)
+			} else if !missing && !ok && len(report.Corrupted) < scrubReportLimit {
+				report.Corrupted = append(report.Corrupted, file.ID)
+			}
+			report.Checked++
+			ctx.Progress(1, uint64(size))
+		}
+		lastID = files[len(files)-1].ID
+	}
+	// The partial report is kept if it is cancelled
+	result, _ := json.Marshal(report)
+	ctx.Job.Result = string(result)
+	if ctx.Cancelled() {
+		return ctx.Err()
+	}
+	utils.GetLogger().Infof("Scrub for user %s completes, %d missing and %d corrupted",
+		user.Username, len(report.Missing), len(report.Corrupted))
+	return nil
+}
+
+// scrubFile check the blob of the file, it returns the size of the blob read
+func scrubFile(file *models.File, user *models.User, fileEncryptionKey []byte) (size int, missing bool, ok bool) {
+	dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", "files", file.RealPath)
+	blob, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return 0, os.IsNotExist(err), false
+	}
+	if utils.IsMasterBlob(blob) {
+		plainContent, errMaster := decryptMasterBlob(blob)
+		return len(blob), false, errMaster == nil && uint64(len(plainContent)) == file.Size
+	}
+	algorithm, content := utils.GetBlobAlgorithm(user.LegacyEncryption, blob)
+	key := fileEncryptionKey
+	if utils.IsEnvelopeBlob(blob) {
+		// The data key is only checked against the current key, scrub is not allowed during key rotation
+		if file.DataKey == "" || file.DataKeyId != user.KeyId {
+			return len(blob), false, false
+		}
+		if key, err = utils.DecryptEncryptionKey(fileEncryptionKey, file.DataKey); err != nil {
+			return len(blob), false, false
+		}
+	}
+	var plainContent []byte
+	if plainContent, err = utils.DecryptFile(algorithm, key, content); err != nil {
+		return len(blob), false, false
+	}
+	return len(blob), false, uint64(len(plainContent)) == file.Size
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"sync"
+	"time"
+)
+
+// Types of the changes in the journal
+const (
+	ChangeCreated  = "created"
+	ChangeModified = "modified"
+	ChangeMoved    = "moved"
+	ChangeDeleted  = "deleted"
+)
+
+// changeTypes map the file event actions to the change types, other actions are not journaled
+// Renaming is a move in the same folder. Moving or deleting a folder applies to all of its children
+var changeTypes = map[string]string{
+	ActionUpload:    ChangeCreated,
+	ActionCreate:    ChangeCreated,
+	ActionOverwrite: ChangeModified,
+	ActionEdit:      ChangeModified,
+	ActionRename:    ChangeMoved,
+	ActionMove:      ChangeMoved,
+	ActionDelete:    ChangeDeleted,
+}
+
+var (
+	changeSignalsLock sync.Mutex
+	// changeSignals the channel of each owner is closed when a change is journaled
+	changeSignals = map[uuid.UUID]chan struct{}{}
+)
+
+func init() {
+	RegisterFileEventHook(recordChange)
+}
+
+// recordChange append the file event to the change journal of the owner
+func recordChange(event *FileEvent) {
+	changeType, ok := changeTypes[event.Action]
+	if !ok {
+		return
+	}
+	change := &models.Change{
+		OwnerId:     event.File.OwnerId,
+		FileId:      event.File.ID,
+		Type:        changeType,
+		ParentId:    event.File.ParentId,
+		Name:        storedName(event.File),
+		Position:    storedPosition(event.File),
+		OldPosition: event.storedOldPosition(),
+		IsDir:       event.File.IsDir,
+		Size:        event.File.Size,
+		Revision:    event.File.Revision,
+		CreatedAt:   event.Time,
+	}
+	if err := change.CreateChange(); err != nil {
+		// The clients would miss the change, they are made to list the tree again
+		utils.GetLogger().Error("Save change of " + event.File.ID.String() + " error: " + err.Error())
+		if err = models.ResetChanges(event.File.OwnerId); err != nil {
+			utils.GetLogger().Error("Reset changes of " + event.File.OwnerId.String() + " error: " + err.Error() +
+				", the clients must list the tree again")
+		}
+	}
+	changeSignalsLock.Lock()
+	if signal, ok := changeSignals[event.File.OwnerId]; ok {
+		close(signal)
+		delete(changeSignals, event.File.OwnerId)
+	}
+	changeSignalsLock.Unlock()
+}
+
+// changeSignal return the channel which will be closed on the next change of the owner
+func changeSignal(owner uuid.UUID) <-chan struct{} {
+	changeSignalsLock.Lock()
+	defer changeSignalsLock.Unlock()
+	signal, ok := changeSignals[owner]
+	if !ok {
+		signal = make(chan struct{})
+		changeSignals[owner] = signal
+	}
+	return signal
+}
+
+// GetLatestCursor return the cursor of the latest change of the user
+// A new client should get the cursor before listing the tree, then sync the changes after it
+func GetLatestCursor(user *models.User) (uint64, error) {
+	cursor, err := models.GetLatestChangeSeq(user.ID)
+	if err != nil {
+		return 0, ErrSystem
+	}
+	return cursor, nil
+}
+
+// GetChanges return at most limit changes of the user after the cursor and the cursor of the last one
+// If there is no change, it waits until a change happens, wait expires or ctx is done
+// ErrResync is returned if a change after the cursor is missing from the journal
+func GetChanges(ctx context.Context, user *models.User, cursor uint64, limit int, wait time.Duration,
+	c *gin.Context) ([]*models.Change, uint64, error) {
+	if limit < 1 {
+		return nil, cursor, ErrRequestPara
+	}
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		// get the signal before querying so that a change between them is not missed
+		signal := changeSignal(user.ID)
+		sequence, err := models.GetChangeSequence(user.ID)
+		if err != nil {
+			return nil, cursor, ErrSystem
+		}
+		if cursor < sequence.ResetSeq {
+			return nil, cursor, ErrResync
+		}
+		changes, err := models.GetChanges(user.ID, cursor, limit)
+		if err != nil {
+			return nil, cursor, ErrSystem
+		}
+		if len(changes) > 0 {
+			if err = decryptChangeNames(user, c, changes); err != nil {
+				return nil, cursor, err
+			}
+			return changes, changes[len(changes)-1].Seq, nil
+		}
+		if timeout == nil {
+			return changes, cursor, nil
+		}
+		select {
+		case <-signal:
+		case <-timeout:
+			return changes, cursor, nil
+		case <-ctx.Done():
+			return changes, cursor, nil
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"regexp"
+)
+
+var colorRegexp = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// validateTag check the name and the color of the tag
+func validateTag(name string, color string) error {
+	if len(name) == 0 || len(name) > 50 || !colorRegexp.MatchString(color) {
+		return ErrRequestPara
+	}
+	return nil
+}
+
+// getUserTag return the tag if it belongs to the user
+func getUserTag(user *models.User, tagID uuid.UUID) (*models.Tag, error) {
+	tag, err := models.GetTagByID(tagID)
+	if err != nil || tag.OwnerId != user.ID {
+		return nil, ErrInvalidOrPermission
+	}
+	return tag, nil
+}
+
+// CreateTag create a tag for the user
+func CreateTag(user *models.User, name string, color string) (*models.Tag, error) {
+	if err := validateTag(name, color); err != nil {
+		return nil, err
+	}
+	tag := &models.Tag{
+		ID:      uuid.New(),
+		OwnerId: user.ID,
+		Name:    name,
+		Color:   color,
+	}
+	if err := tag.CreateTag(); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return nil, ErrDuplicate
+		}
+		return nil, ErrSave
+	}
+	return tag, nil
+}
+
+// UpdateTag change the name and the color of the tag
+func UpdateTag(user *models.User, tagID uuid.UUID, name string, color string) error {
+	if err := validateTag(name, color); err != nil {
+		return err
+	}
+	tag, err := getUserTag(user, tagID)
+	if err != nil {
+		return err
+	}
+	tag.Name = name
+	tag.Color = color
+	if err = tag.UpdateTag(); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return ErrDuplicate
+		}
+		return ErrSave
+	}
+	return nil
+}
+
+// DeleteTag delete the tag and detach it from all files
+func DeleteTag(user *models.User, tagID uuid.UUID) error {
+	tag, err := getUserTag(user, tagID)
+	if err != nil {
+		return err
+	}
+	if err = tag.DeleteTag(); err != nil {
+		return ErrSystem
+	}
+	return nil
+}
+
+// GetTags return the tags of the user and the number of files and folders of each tag
+func GetTags(user *models.User) ([]*models.Tag, map[uuid.UUID]int64, error) {
+	tags, err := models.GetTags(user.ID)
+	if err != nil {
+		return nil, nil, ErrSystem
+	}
+	var counts map[uuid.UUID]int64
+	counts, err = models.CountFilesByTag(user.ID)
+	if err != nil {
+		return nil, nil, ErrSystem
+	}
+	return tags, counts, nil
+}
+
+// AttachTag attach the tag to the file or folder
+func AttachTag(file *models.File, user *models.User, tagID uuid.UUID) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if _, err := getUserTag(user, tagID); err != nil {
+		return err
+	}
+	if err := models.AttachTag(file.ID, tagID); err != nil {
+		return ErrSave
+	}
+	return nil
+}
+
+// DetachTag detach the tag from the file or folder
+func DetachTag(file *models.File, user *models.User, tagID uuid.UUID) error {
+	if file.OwnerId != user.ID {
+		return ErrInvalidOrPermission
+	}
+	if err := models.DetachTag(file.ID, tagID); err != nil {
+		return ErrSave
+	}
+	return nil
+}
+
+// GetFilesByTag return the files and folders with the tag
+func GetFilesByTag(user *models.User, tagID uuid.UUID, c *gin.Context) ([]*models.File, error) {
+	if _, err := getUserTag(user, tagID); err != nil {
+		return nil, err
+	}
+	files, err := models.GetFilesByTag(user.ID, tagID)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	for _, v := range files {
+		if err = v.TraceRoot(); err != nil {
+			return nil, ErrSystem
+		}
+	}
+	if err = decryptFileNames(user, c, files...); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// LoadTags set the Tags field of the files in one query
+func LoadTags(files ...*models.File) error {
+	ids := make([]uuid.UUID, len(files))
+	for i, v := range files {
+		ids[i] = v.ID
+	}
+	tags, err := models.GetTagsOfFiles(ids)
+	if err != nil {
+		return ErrSystem
+	}
+	for _, v := range files {
+		v.Tags = tags[v.ID]
+	}
+	return nil
+}
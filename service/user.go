@@ -33,7 +33,9 @@ func LoginValidate(username string, password string) (bool, *models.User) {
 }
 
 // RegisterUser register a user in the system
-func RegisterUser(username string, password string, accountSalt string, encryptionKey string) error {
+// If wrappedKey is not empty, the user is created in the vault mode with the file encryption key generated and
+// wrapped by the client, and encryptionKey is not used
+func RegisterUser(username string, password string, accountSalt string, encryptionKey string, wrappedKey string) error {
 	if _, err := models.GetUserByUsername(username); err != nil {
 		user := models.NewUser()
 		user.Username = username
@@ -42,23 +44,31 @@ func RegisterUser(username string, password string, accountSalt string, encrypti
 		user.MacSalt = macSalt
 		user.Password = utils.GetHashWithSalt(password, macSalt)
 		user.Nickname = username
-		var encryptionKeyByte []byte
-		encryptionKeyByte, err = hex.DecodeString(encryptionKey)
-		if err != nil {
-			return ErrRequestPara
-		}
-		var encryptKey []byte
-		encryptKey, err = hex.DecodeString(utils.GenerateSaltOrKey())
-		if err != nil {
-			return err
-		}
-		var newEncryptionKey string
-		newEncryptionKey, err = utils.EncryptEncryptionKey(encryptionKeyByte, encryptKey)
-		if err != nil {
-			utils.GetLogger().Panic("Create user error")
-			return err
+		if wrappedKey != "" {
+			if !isWrappedKey(wrappedKey) {
+				return ErrRequestPara
+			}
+			user.EncryptionKey = wrappedKey
+			user.Vault = 1
+		} else {
+			var encryptionKeyByte []byte
+			encryptionKeyByte, err = hex.DecodeString(encryptionKey)
+			if err != nil {
+				return ErrRequestPara
+			}
+			var encryptKey []byte
+			encryptKey, err = hex.DecodeString(utils.GenerateSaltOrKey())
+			if err != nil {
+				return err
+			}
+			var newEncryptionKey string
+			newEncryptionKey, err = utils.EncryptEncryptionKey(encryptionKeyByte, encryptKey)
+			if err != nil {
+				utils.GetLogger().Panic("Create user error")
+				return err
+			}
+			user.EncryptionKey = newEncryptionKey
 		}
-		user.EncryptionKey = newEncryptionKey
 		err = user.RegisterUser()
 		if err != nil {
 			utils.GetLogger().Panic("Create user error")
@@ -83,6 +93,10 @@ func RegisterUser(username string, password string, accountSalt string, encrypti
 			utils.GetLogger().Panic("Create user file folder error")
 			return err
 		}
+		queueWebhookEvent(EventUserRegistered, uuid.Nil, user.Username, map[string]interface{}{
+			"id":       user.ID,
+			"username": user.Username,
+		})
 		return nil
 	} else {
 		return ErrUsernameInvalid
@@ -91,10 +105,22 @@ func RegisterUser(username string, password string, accountSalt string, encrypti
 
 // ChangePassword change user password
 func ChangePassword(user *models.User, newAccountSalt string, newPassword string, oldEncryption string, newEncryption string) error {
+	// Load again, the file encryption key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return ErrSystem
+	}
+	// The key of the users in the vault mode is wrapped again by the client, see ChangeVaultPassword
+	if user.Vault == 1 {
+		return ErrPrecondition
+	}
+	// The old key is wrapped by the current password until the rotation completes
+	if user.OldEncryptionKey != "" {
+		return ErrInProgress
+	}
 	newMacSalt := utils.GenerateSaltOrKey()
 	newPass := utils.GetHashWithSalt(newPassword, newMacSalt)
 	var newEncryptionKeyByte []byte
-	var err error
 	newEncryptionKeyByte, err = hex.DecodeString(newEncryption)
 	if err != nil {
 		return ErrRequestPara
@@ -189,11 +215,20 @@ func SetUserQuota(modifiedUsername string, newSize uint64) error {
 }
 
 // ResetUserPassword reset the user password
-func ResetUserPassword(resetUsername string) (string, error) {
+// If escrowPrivateKey is provided, the file encryption key escrowed by the user is kept,
+// otherwise the password of the user enabling encryption cannot be reset
+func ResetUserPassword(resetUsername string, escrowPrivateKey string) (string, error) {
 	resetUser, err := models.GetUserByUsername(resetUsername)
 	if err != nil {
 		return "", ErrRequestPara
 	}
+	// The key of the users in the vault mode is only known by their clients
+	if resetUser.Vault == 1 {
+		return "", ErrResetForbidden
+	}
+	if escrowPrivateKey != "" {
+		return resetUserPasswordByEscrow(resetUser, escrowPrivateKey)
+	}
 	if resetUser.Encryption > 0 {
 		return "", ErrResetForbidden
 	}
@@ -215,18 +250,46 @@ func GetUserNameByID(uid uuid.UUID) string {
 	}
 }
 
-// ChangeEncryptionAlgorithm will set the Migration status of the user and use goroutine to call
-// migration process asynchronously
-func ChangeEncryptionAlgorithm(user *models.User, algo int, c *gin.Context) error {
+// ChangeEncryptionAlgorithm will persist a migration job for the user and run it asynchronously
+// If lazy is true, only the new blobs will be written with the new algorithm, the existing blobs
+// are still readable since the algorithm is recorded in their format header
+func ChangeEncryptionAlgorithm(user *models.User, algo int, lazy bool, c *gin.Context) error {
+	// Load again, the file encryption key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return ErrSystem
+	}
+	if user.Vault == 1 {
+		return ErrPrecondition
+	}
 	encryptedKey := c.Value("encryptionKey").([]byte)
-	fileEncryptionKey, err := utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
+	var fileEncryptionKey []byte
+	fileEncryptionKey, err = utils.DecryptEncryptionKey(encryptedKey, user.EncryptionKey)
 	if err != nil {
 		return ErrRequestPara
 	}
 	if algo < 0 || algo > 3 {
 		return ErrRequestPara
 	}
-	user.SetMigration(1)
-	go MigrateAlgorithm(user, user.Encryption, algo, fileEncryptionKey)
+	if algo == user.Encryption {
+		return ErrRequestPara
+	}
+	if user.Migration != 0 || user.OldEncryptionKey != "" {
+		return ErrInProgress
+	}
+	if lazy {
+		if _, err = models.GetActiveMigrationJob(user.ID); err == nil {
+			return ErrInProgress
+		}
+		user.SetEncryption(algo)
+	} else if err = startMigration(user, user.Encryption, algo, fileEncryptionKey); err != nil {
+		return err
+	}
+	// The photo metadata saved before enabling encryption is not encrypted, see savePhotoInfo
+	if algo != 0 {
+		if err = models.ClearPhotoMetadata(user.ID); err != nil {
+			utils.GetLogger().Error("Clear photo metadata of user " + user.Username + " error: " + err.Error())
+		}
+	}
 	return nil
 }
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"encoding/hex"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"path"
+)
+
+// In the vault mode, the files are end-to-end encrypted by the client. The client unwraps the file encryption key
+// with the key derived from the password, which is never sent to the server, and encrypts each file by its own
+// data key wrapped by the file encryption key. The server only stores the ciphertext and the wrapped keys, so
+// previews, thumbnails, tracks and the other features reading the content are not available for the new files
+
+// wrappedKeySize the size of a key wrapped in the same format as EncryptionKey, the nonce, the key and the tag
+const wrappedKeySize = 12 + 32 + 16
+
+// isWrappedKey check the format of a key wrapped by the client, the server cannot check the key itself
+func isWrappedKey(key string) bool {
+	wrapped, err := hex.DecodeString(key)
+	return err == nil && len(wrapped) == wrappedKeySize
+}
+
+// VaultBlob the stored blob of a file and the keys for the client to decrypt it
+type VaultBlob struct {
+	// Content the blob with its format header, the blobs encrypted at rest are returned as plain blobs
+	Content []byte
+	// DataKey the data key of the file wrapped by the file encryption key DataKeyId,
+	// it is empty if the blob is not encrypted by a data key
+	DataKey   string
+	DataKeyId uint32
+	// LegacyEncryption the algorithm of the blobs without a format header
+	LegacyEncryption int
+}
+
+// EnableVault switch the user to the vault mode, the server will not receive the key derived from the password
+// any more. The file encryption key is not changed, the blobs encrypted by the server can be decrypted by the client
+func EnableVault(user *models.User) error {
+	// Load again, the key may be rotated after the user of the request is loaded
+	user, err := models.GetUserByID(user.ID)
+	if err != nil {
+		return ErrSystem
+	}
+	if user.Vault == 1 {
+		return nil
+	}
+	// The encrypted names could not be read or renamed without the key
+	if user.NameKey != "" {
+		return ErrPrecondition
+	}
+	if user.Migration != 0 || user.OldEncryptionKey != "" {
+		return ErrInProgress
+	}
+	if _, err = models.GetActiveMigrationJob(user.ID); err == nil {
+		return ErrInProgress
+	}
+	for _, jobType := range []string{JobRotateKey, JobScrub, JobEncryptNames} {
+		if _, err = models.GetActiveJob(user.ID, jobType); err == nil {
+			return ErrInProgress
+		}
+	}
+	var ok bool
+	if ok, err = user.EnableVault(); err != nil {
+		return ErrSave
+	}
+	if !ok {
+		return ErrInProgress
+	}
+	utils.GetLogger().Warn("Vault mode for user " + user.Username + " is enabled")
+	return nil
+}
+
+// GetVaultKey return the file encryption key wrapped by the client and its ID
+func GetVaultKey(user *models.User) (string, uint32, error) {
+	if user.Vault != 1 {
+		return "", 0, ErrPrecondition
+	}
+	return user.EncryptionKey, user.KeyId, nil
+}
+
+// ChangeVaultPassword change the password of the user in the vault mode
+// The file encryption key is wrapped again by the client with the key derived from the new password
+func ChangeVaultPassword(user *models.User, newAccountSalt string, newPassword string, newWrappedKey string) error {
+	if user.Vault != 1 {
+		return ErrPrecondition
+	}
+	if !isWrappedKey(newWrappedKey) {
+		return ErrRequestPara
+	}
+	newMacSalt := utils.GenerateSaltOrKey()
+	newPass := utils.GetHashWithSalt(newPassword, newMacSalt)
+	user.ChangePassword(newPass, newAccountSalt, newMacSalt, newWrappedKey)
+	return nil
+}
+
+// GetVaultBlob return the stored blob of the file without decrypting it
+func GetVaultBlob(file *models.File, user *models.User) (*VaultBlob, error) {
+	if file.OwnerId != user.ID {
+		return nil, ErrInvalidOrPermission
+	}
+	if file.IsDir == 1 {
+		return nil, ErrRequestPara
+	}
+	if user.Vault != 1 {
+		return nil, ErrPrecondition
+	}
+	dst := path.Join(utils.GetConfig().UserDataPath, user.ID.String(), "data", "files", file.RealPath)
+	blob, err := readFileBlob(dst, file)
+	if err != nil {
+		utils.GetLogger().Error("Read file " + dst + " error: " + err.Error())
+		return nil, ErrSystem
+	}
+	res := &VaultBlob{Content: blob, LegacyEncryption: user.LegacyEncryption}
+	if utils.IsMasterBlob(blob) {
+		// The master key is only known by the server
+		var content []byte
+		if content, err = decryptMasterBlob(blob); err != nil {
+			return nil, err
+		}
+		if res.Content, err = utils.EncryptBlob(0, 0, nil, content); err != nil {
+			return nil, ErrSystem
+		}
+	} else if utils.IsEnvelopeBlob(blob) || utils.IsClientBlob(blob) {
+		res.DataKey = file.DataKey
+		res.DataKeyId = file.DataKeyId
+	}
+	return res, nil
+}
@@ -0,0 +1,489 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"home-cloud/models"
+	"home-cloud/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook events
+const (
+	EventFileUploaded      = "file.uploaded"
+	EventFileCreated       = "file.created"
+	EventFileModified      = "file.modified"
+	EventFileDeleted       = "file.deleted"
+	EventFileRenamed       = "file.renamed"
+	EventFileMoved         = "file.moved"
+	EventUserRegistered    = "user.registered"
+	EventMigrationFinished = "migration.finished"
+	EventPing              = "ping"
+)
+
+// WebhookEvents all the events which can be subscribed
+var WebhookEvents = []string{
+	EventFileUploaded, EventFileCreated, EventFileModified, EventFileDeleted,
+	EventFileRenamed, EventFileMoved, EventUserRegistered, EventMigrationFinished,
+}
+
+// webhookMaxAttempts the delivery will be marked as failed after the attempts
+const webhookMaxAttempts = 8
+
+// webhookRetryBase the delay before the first retry, doubled after each attempt
+const webhookRetryBase = 30 * time.Second
+
+// webhookSignatureHeader the header of HMAC-SHA256 signature of the body
+const webhookSignatureHeader = "X-HomeCloud-Signature"
+
+// webhookWorkers the max number of webhooks delivered at the same time
+const webhookWorkers = 8
+
+// errWebhookAddress the webhook resolves to an address not allowed
+var errWebhookAddress = errors.New("webhook address is not allowed")
+
+// webhookClient check the address when connecting, so the host resolved or redirected to
+// a private address is also refused. No proxy is used, otherwise only the address of the proxy is checked
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !allowedWebhookIP(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+var webhookWorkerOnce sync.Once
+
+var (
+	webhookBusyLock sync.Mutex
+	// webhookBusy the webhooks being delivered, the deliveries of a webhook are sent in order by one worker
+	webhookBusy = map[uuid.UUID]bool{}
+	// webhookSlots limit the workers, a slow webhook only holds its own worker
+	webhookSlots = make(chan struct{}, webhookWorkers)
+)
+
+// webhookNotify wake up the worker when new deliveries are queued
+var webhookNotify = make(chan struct{}, 1)
+
+// fileActionEvents map the file event actions to the webhook events
+var fileActionEvents = map[string]string{
+	ActionUpload:    EventFileUploaded,
+	ActionOverwrite: EventFileUploaded,
+	ActionCreate:    EventFileCreated,
+	ActionEdit:      EventFileModified,
+	ActionDelete:    EventFileDeleted,
+	ActionRename:    EventFileRenamed,
+	ActionMove:      EventFileMoved,
+}
+
+func init() {
+	RegisterFileEventHook(queueFileWebhook)
+}
+
+// webhookPayload the JSON body sent to the webhook
+type webhookPayload struct {
+	Event    string      `json:"event"`
+	Time     time.Time   `json:"time"`
+	Username string      `json:"username"`
+	Data     interface{} `json:"data"`
+}
+
+// queueFileWebhook queue the file events to the webhooks
+func queueFileWebhook(event *FileEvent) {
+	webhookEvent, ok := fileActionEvents[event.Action]
+	if !ok {
+		return
+	}
+	data := map[string]interface{}{
+		"id":        event.File.ID,
+		"name":      storedName(event.File),
+		"position":  storedPosition(event.File),
+		"is_dir":    event.File.IsDir,
+		"size":      event.File.Size,
+		"client_ip": event.ClientIP,
+	}
+	// Only the stored names are sent, the type is decrypted and would reveal what the encrypted one hides
+	if event.User.NameKey == "" {
+		data["file_type"] = event.File.FileType
+	}
+	if event.OldPosition != "" {
+		data["old_position"] = event.storedOldPosition()
+	}
+	queueWebhookEvent(webhookEvent, event.File.OwnerId, event.User.Username, data)
+}
+
+// queueWebhookEvent save the deliveries of the event to the queue for the webhooks subscribing it
+// owner is the user whose webhooks will receive the event, uuid.Nil for admin-level webhooks only
+func queueWebhookEvent(event string, owner uuid.UUID, username string, data interface{}) {
+	webhooks, err := models.GetEventWebhooks(owner)
+	if err != nil {
+		utils.GetLogger().Error("Find webhooks for " + event + " error: " + err.Error())
+		return
+	}
+	payload, err := json.Marshal(&webhookPayload{Event: event, Time: time.Now(), Username: username, Data: data})
+	if err != nil {
+		utils.GetLogger().Error("Encode webhook payload for " + event + " error: " + err.Error())
+		return
+	}
+	queued := false
+	for _, webhook := range webhooks {
+		if !subscribes(webhook, event) {
+			continue
+		}
+		delivery := &models.WebhookDelivery{
+			WebhookId:     webhook.ID,
+			Event:         event,
+			Payload:       string(payload),
+			NextAttemptAt: time.Now(),
+		}
+		if err = delivery.CreateDelivery(); err != nil {
+			utils.GetLogger().Error("Queue webhook delivery for " + event + " error: " + err.Error())
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case webhookNotify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribes check if the webhook subscribes the event
+func subscribes(webhook *models.Webhook, event string) bool {
+	for _, v := range strings.Split(webhook.Events, ",") {
+		if v == "*" || v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// StartWebhookWorker start the worker sending the queued deliveries, pending deliveries will be resumed
+func StartWebhookWorker() {
+	webhookWorkerOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(10 * time.Second)
+			defer ticker.Stop()
+			for {
+				processWebhookDeliveries()
+				select {
+				case <-ticker.C:
+				case <-webhookNotify:
+				}
+			}
+		}()
+	})
+}
+
+// processWebhookDeliveries dispatch the due deliveries to the workers grouped by webhook
+// The webhooks being delivered are skipped, the worker notifies when it finishes, so the rest are loaded again
+func processWebhookDeliveries() {
+	for {
+		deliveries, err := models.GetDueDeliveries(busyWebhooks(), 100)
+		if err != nil {
+			utils.GetLogger().Error("Load webhook deliveries error: " + err.Error())
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		groups := make(map[uuid.UUID][]*models.WebhookDelivery)
+		var order []uuid.UUID
+		for _, delivery := range deliveries {
+			if _, ok := groups[delivery.WebhookId]; !ok {
+				order = append(order, delivery.WebhookId)
+			}
+			groups[delivery.WebhookId] = append(groups[delivery.WebhookId], delivery)
+		}
+		for _, webhookID := range order {
+			webhookSlots <- struct{}{}
+			webhookBusyLock.Lock()
+			webhookBusy[webhookID] = true
+			webhookBusyLock.Unlock()
+			go runWebhookWorker(webhookID, groups[webhookID])
+		}
+	}
+}
+
+// busyWebhooks return the webhooks being delivered by the workers
+func busyWebhooks() []uuid.UUID {
+	webhookBusyLock.Lock()
+	defer webhookBusyLock.Unlock()
+	ids := make([]uuid.UUID, 0, len(webhookBusy))
+	for id := range webhookBusy {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// runWebhookWorker send the deliveries of a webhook in order and release the worker
+// It stops at a delivery to be retried, the later ones are sent after it
+func runWebhookWorker(webhookID uuid.UUID, deliveries []*models.WebhookDelivery) {
+	defer func() {
+		webhookBusyLock.Lock()
+		delete(webhookBusy, webhookID)
+		webhookBusyLock.Unlock()
+		<-webhookSlots
+		select {
+		case webhookNotify <- struct{}{}:
+		default:
+		}
+	}()
+	for _, delivery := range deliveries {
+		if !deliverWebhook(delivery) {
+			return
+		}
+	}
+}
+
+// allowedWebhookIP check if the webhooks can be delivered to the address
+// Loopback, private, shared (carrier-grade NAT), link-local (including the cloud metadata service) and
+// unspecified addresses are refused unless allowed in the config
+func allowedWebhookIP(ip net.IP) bool {
+	if utils.GetConfig().AllowPrivateWebhooks {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// sharedAddressSpace 100.64.0.0/10 of RFC 6598, used inside the networks of the providers
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// deliverWebhook send the delivery and schedule the retry with exponential backoff if it fails
+// It returns false if the delivery is to be retried
+func deliverWebhook(delivery *models.WebhookDelivery) bool {
+	webhook, err := models.GetWebhookByID(delivery.WebhookId)
+	if err != nil {
+		// The webhook has been deleted
+		delivery.Status = 2
+		delivery.LastError = "webhook not found"
+		_ = delivery.UpdateDelivery()
+		return true
+	}
+	delivery.Attempts++
+	delivery.LastStatusCode, err = sendWebhook(webhook, delivery)
+	if err == nil {
+		delivery.Status = 1
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if len(delivery.LastError) > 512 {
+			delivery.LastError = delivery.LastError[:512]
+		}
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = 2
+			utils.GetLogger().Warnf("Webhook delivery %d to %s failed after %d attempts", delivery.ID, webhook.URL, delivery.Attempts)
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(webhookRetryBase << (delivery.Attempts - 1))
+		}
+	}
+	if err = delivery.UpdateDelivery(); err != nil {
+		utils.GetLogger().Error("Update webhook delivery error: " + err.Error())
+	}
+	return delivery.Status != 0
+}
+
+// signWebhookPayload return the HMAC-SHA256 signature of the payload in hex format
+func signWebhookPayload(secret string, payload []byte) string {
+	key, _ := hex.DecodeString(secret)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook post the payload to the webhook, only 2xx status is successful
+func sendWebhook(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "HomeCloud-Webhook")
+	req.Header.Set("X-HomeCloud-Event", delivery.Event)
+	req.Header.Set("X-HomeCloud-Delivery", fmt.Sprintf("%d", delivery.ID))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(webhook.Secret, payload))
+	var res *http.Response
+	res, err = webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// validateWebhookEvents check the events and return them in the stored format
+func validateWebhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "", ErrRequestPara
+	}
+	for _, event := range events {
+		if event == "*" {
+			continue
+		}
+		valid := false
+		for _, v := range WebhookEvents {
+			if v == event {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return "", ErrRequestPara
+		}
+	}
+	return strings.Join(events, ","), nil
+}
+
+// CreateWebhook create a webhook subscription, admin-level webhooks receive the events of all users
+func CreateWebhook(user *models.User, rawURL string, events []string, admin bool) (*models.Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(rawURL) > 2048 {
+		return nil, ErrRequestPara
+	}
+	// The host names are checked when delivering, since they may resolve to other addresses later
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowedWebhookIP(ip) {
+		return nil, ErrRequestPara
+	}
+	if admin && user.Status != 1 {
+		return nil, ErrInvalidOrPermission
+	}
+	var eventList string
+	eventList, err = validateWebhookEvents(events)
+	if err != nil {
+		return nil, err
+	}
+	webhook := &models.Webhook{
+		ID:      uuid.New(),
+		OwnerId: user.ID,
+		URL:     rawURL,
+		Secret:  utils.GenerateSaltOrKey(),
+		Events:  eventList,
+	}
+	if admin {
+		webhook.Admin = 1
+	}
+	if err = webhook.CreateWebhook(); err != nil {
+		return nil, ErrSave
+	}
+	return webhook, nil
+}
+
+// getUserWebhook return the webhook if the user can manage it
+// Admin-level webhooks can be managed by all admins
+func getUserWebhook(user *models.User, webhookID uuid.UUID) (*models.Webhook, error) {
+	webhook, err := models.GetWebhookByID(webhookID)
+	if err != nil {
+		return nil, ErrInvalidOrPermission
+	}
+	if webhook.Admin == 1 {
+		if user.Status != 1 {
+			return nil, ErrInvalidOrPermission
+		}
+	} else if webhook.OwnerId != user.ID {
+		return nil, ErrInvalidOrPermission
+	}
+	return webhook, nil
+}
+
+// GetWebhooks return the webhooks of the user, or all admin-level webhooks if admin is true
+func GetWebhooks(user *models.User, admin bool) ([]*models.Webhook, error) {
+	if admin && user.Status != 1 {
+		return nil, ErrInvalidOrPermission
+	}
+	webhooks, err := models.GetWebhooks(user.ID, admin)
+	if err != nil {
+		return nil, ErrSystem
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook delete the webhook and its delivery log
+func DeleteWebhook(user *models.User, webhookID uuid.UUID) error {
+	webhook, err := getUserWebhook(user, webhookID)
+	if err != nil {
+		return err
+	}
+	if err = webhook.DeleteWebhook(); err != nil {
+		return ErrSystem
+	}
+	return nil
+}
+
+// PingWebhook queue a ping event to the webhook, used to test the receiver
+func PingWebhook(user *models.User, webhookID uuid.UUID) error {
+	webhook, err := getUserWebhook(user, webhookID)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	payload, err = json.Marshal(&webhookPayload{Event: EventPing, Time: time.Now(), Username: user.Username,
+		Data: map[string]interface{}{"webhook": webhook.ID}})
+	if err != nil {
+		return ErrSystem
+	}
+	delivery := &models.WebhookDelivery{
+		WebhookId:     webhook.ID,
+		Event:         EventPing,
+		Payload:       string(payload),
+		NextAttemptAt: time.Now(),
+	}
+	if err = delivery.CreateDelivery(); err != nil {
+		return ErrSave
+	}
+	select {
+	case webhookNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// GetWebhookDeliveries return a page of the delivery log of the webhook, page starts from 1
+func GetWebhookDeliveries(user *models.User, webhookID uuid.UUID, page int, pageSize int) ([]*models.WebhookDelivery, int64, error) {
+	if page < 1 || pageSize < 1 {
+		return nil, 0, ErrRequestPara
+	}
+	if _, err := getUserWebhook(user, webhookID); err != nil {
+		return nil, 0, err
+	}
+	deliveries, total, err := models.GetDeliveries(webhookID, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, 0, ErrSystem
+	}
+	return deliveries, total, nil
+}
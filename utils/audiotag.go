@@ -0,0 +1,648 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// This file contains a minimal parser for the tags in audio files
+// Supported formats: ID3v1/ID3v2 (mp3), FLAC, Ogg Vorbis/Opus and MP4 (m4a)
+
+// AudioTag the information read from the tags of an audio file
+type AudioTag struct {
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Year        int
+	Track       int
+	// Duration in seconds, 0 if unknown
+	Duration int
+	// Cover the embedded cover art, nil if not exists
+	Cover     []byte
+	CoverMime string
+}
+
+var errUnknownAudioFormat = errors.New("unknown audio format")
+
+// ReadAudioTag read the tags from the content of an audio file
+func ReadAudioTag(content []byte) (*AudioTag, error) {
+	tag := &AudioTag{}
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte("ID3")):
+		err = readID3v2(content, tag)
+	case bytes.HasPrefix(content, []byte("fLaC")):
+		err = readFLAC(content, tag)
+	case bytes.HasPrefix(content, []byte("OggS")):
+		err = readOgg(content, tag)
+	case len(content) > 8 && bytes.Equal(content[4:8], []byte("ftyp")):
+		err = readMP4(content, tag)
+	case len(content) > 2 && content[0] == 0xff && content[1]&0xe0 == 0xe0:
+		// mp3 without ID3v2
+		tag.Duration = mp3Duration(content)
+		if len(content) > 128 && bytes.Equal(content[len(content)-128:len(content)-125], []byte("TAG")) {
+			readID3v1(content, tag)
+		}
+	case len(content) > 128 && bytes.Equal(content[len(content)-128:len(content)-125], []byte("TAG")):
+		readID3v1(content, tag)
+	default:
+		err = errUnknownAudioFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	tag.Title = strings.TrimSpace(tag.Title)
+	tag.Artist = strings.TrimSpace(tag.Artist)
+	tag.Album = strings.TrimSpace(tag.Album)
+	tag.AlbumArtist = strings.TrimSpace(tag.AlbumArtist)
+	return tag, nil
+}
+
+// parseNumber parse the number in "3" or "3/12" format
+func parseNumber(s string) int {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > 4 {
+		// Date like 2001-01-01
+		s = s[:4]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// readID3v1 read the 128-byte tag at the end of the file
+func readID3v1(content []byte, tag *AudioTag) {
+	t := content[len(content)-128:]
+	trim := func(b []byte) string {
+		return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+	}
+	if tag.Title == "" {
+		tag.Title = trim(t[3:33])
+	}
+	if tag.Artist == "" {
+		tag.Artist = trim(t[33:63])
+	}
+	if tag.Album == "" {
+		tag.Album = trim(t[63:93])
+	}
+	if tag.Year == 0 {
+		tag.Year = parseNumber(trim(t[93:97]))
+	}
+	// ID3v1.1 track number
+	if tag.Track == 0 && t[125] == 0 && t[126] != 0 {
+		tag.Track = int(t[126])
+	}
+}
+
+// syncSafe decode the sync-safe integer in ID3v2
+func syncSafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// decodeID3Text decode the text frame with the encoding byte at the beginning
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	encoding := b[0]
+	b = b[1:]
+	var s string
+	switch encoding {
+	case 1, 2:
+		s = decodeUTF16(b, encoding == 2)
+	case 3:
+		s = string(b)
+	default:
+		s = decodeLatin1(b)
+	}
+	// Multiple values are separated by null
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+func decodeLatin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeUTF16 decode UTF-16 with BOM, or big endian without BOM if bigEndian is true
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		if b[0] == 0xff && b[1] == 0xfe {
+			bigEndian = false
+			b = b[2:]
+		} else if b[0] == 0xfe && b[1] == 0xff {
+			bigEndian = true
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		var c uint16
+		if bigEndian {
+			c = binary.BigEndian.Uint16(b[i:])
+		} else {
+			c = binary.LittleEndian.Uint16(b[i:])
+		}
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// readID3Picture read the APIC (v2.3/v2.4) or PIC (v2.2) frame
+func readID3Picture(b []byte, v22 bool, tag *AudioTag) {
+	if len(b) < 4 || tag.Cover != nil {
+		return
+	}
+	encoding := b[0]
+	b = b[1:]
+	var mime string
+	if v22 {
+		switch strings.ToUpper(string(b[:3])) {
+		case "PNG":
+			mime = "image/png"
+		default:
+			mime = "image/jpeg"
+		}
+		b = b[3:]
+	} else {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return
+		}
+		mime = strings.ToLower(string(b[:i]))
+		b = b[i+1:]
+	}
+	if len(b) < 1 {
+		return
+	}
+	// Skip picture type and description
+	b = b[1:]
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				b = b[i+2:]
+				break
+			}
+		}
+	} else {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return
+		}
+		b = b[i+1:]
+	}
+	if !strings.HasPrefix(mime, "image/") {
+		mime = "image/jpeg"
+	}
+	tag.Cover = b
+	tag.CoverMime = mime
+}
+
+// readID3v2 read the ID3v2 tag at the beginning of the file and estimate the duration of the mp3
+func readID3v2(content []byte, tag *AudioTag) error {
+	if len(content) < 10 {
+		return errUnknownAudioFormat
+	}
+	version := content[3]
+	flags := content[5]
+	size := syncSafe(content[6:10])
+	end := 10 + size
+	if end > len(content) {
+		return errUnknownAudioFormat
+	}
+	pos := 10
+	// Skip extended header
+	if flags&0x40 != 0 && version >= 3 && pos+4 <= end {
+		if version == 4 {
+			pos += syncSafe(content[pos : pos+4])
+		} else {
+			pos += int(binary.BigEndian.Uint32(content[pos:pos+4])) + 4
+		}
+	}
+	v22 := version == 2
+	headerLen := 10
+	idLen := 4
+	if v22 {
+		headerLen = 6
+		idLen = 3
+	}
+	for pos+headerLen <= end {
+		id := string(content[pos : pos+idLen])
+		if id[0] == 0 {
+			// Padding
+			break
+		}
+		var frameSize int
+		if v22 {
+			frameSize = int(content[pos+3])<<16 | int(content[pos+4])<<8 | int(content[pos+5])
+		} else if version == 4 {
+			frameSize = syncSafe(content[pos+4 : pos+8])
+		} else {
+			frameSize = int(binary.BigEndian.Uint32(content[pos+4 : pos+8]))
+		}
+		pos += headerLen
+		if frameSize < 0 || pos+frameSize > end {
+			break
+		}
+		frame := content[pos : pos+frameSize]
+		switch id {
+		case "TIT2", "TT2":
+			tag.Title = decodeID3Text(frame)
+		case "TPE1", "TP1":
+			tag.Artist = decodeID3Text(frame)
+		case "TPE2", "TP2":
+			tag.AlbumArtist = decodeID3Text(frame)
+		case "TALB", "TAL":
+			tag.Album = decodeID3Text(frame)
+		case "TRCK", "TRK":
+			tag.Track = parseNumber(decodeID3Text(frame))
+		case "TYER", "TDRC", "TYE":
+			tag.Year = parseNumber(decodeID3Text(frame))
+		case "TLEN", "TLE":
+			if ms := parseNumber(decodeID3Text(frame)); ms > 0 {
+				tag.Duration = ms / 1000
+			}
+		case "APIC", "PIC":
+			readID3Picture(frame, v22, tag)
+		}
+		pos += frameSize
+	}
+	if tag.Duration == 0 {
+		tag.Duration = mp3Duration(content[end:])
+	}
+	if len(content) > end+128 && bytes.Equal(content[len(content)-128:len(content)-125], []byte("TAG")) {
+		readID3v1(content, tag)
+	}
+	return nil
+}
+
+var mp3Bitrates = [2][16]int{
+	// MPEG-1 Layer III
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	// MPEG-2/2.5 Layer III
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+}
+
+var mp3SampleRates = [4][4]int{
+	// MPEG-2.5, reserved, MPEG-2, MPEG-1
+	{11025, 12000, 8000, 0},
+	{0, 0, 0, 0},
+	{22050, 24000, 16000, 0},
+	{44100, 48000, 32000, 0},
+}
+
+// mp3Duration estimate the duration of the mp3 audio data by the Xing header or the bitrate of the first frame
+func mp3Duration(data []byte) int {
+	pos := 0
+	for pos+4 <= len(data) && !(data[pos] == 0xff && data[pos+1]&0xe0 == 0xe0) {
+		pos++
+		if pos > 64*1024 {
+			return 0
+		}
+	}
+	if pos+4 > len(data) {
+		return 0
+	}
+	header := data[pos : pos+4]
+	versionID := (header[1] >> 3) & 0x03
+	bitrateIndex := header[2] >> 4
+	sampleRateIndex := (header[2] >> 2) & 0x03
+	channelMode := header[3] >> 6
+	if versionID == 1 {
+		return 0
+	}
+	sampleRate := mp3SampleRates[versionID][sampleRateIndex]
+	if sampleRate == 0 {
+		return 0
+	}
+	samplesPerFrame := 1152
+	table := 0
+	if versionID != 3 {
+		samplesPerFrame = 576
+		table = 1
+	}
+	// Offset of the Xing header depends on the version and the channel mode
+	var sideInfo int
+	if versionID == 3 {
+		sideInfo = 32
+		if channelMode == 3 {
+			sideInfo = 17
+		}
+	} else {
+		sideInfo = 17
+		if channelMode == 3 {
+			sideInfo = 9
+		}
+	}
+	xing := pos + 4 + sideInfo
+	if xing+12 <= len(data) {
+		id := string(data[xing : xing+4])
+		if (id == "Xing" || id == "Info") && data[xing+7]&0x01 != 0 {
+			frames := int(binary.BigEndian.Uint32(data[xing+8 : xing+12]))
+			return frames * samplesPerFrame / sampleRate
+		}
+	}
+	bitrate := mp3Bitrates[table][bitrateIndex]
+	if bitrate == 0 {
+		return 0
+	}
+	return (len(data) - pos) * 8 / (bitrate * 1000)
+}
+
+// readVorbisComment read the comments in FLAC and Ogg, the vendor string is at the beginning
+func readVorbisComment(b []byte, tag *AudioTag) {
+	if len(b) < 4 {
+		return
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(b))
+	pos := 4 + vendorLen
+	if pos+4 > len(b) {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(b[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(b); i++ {
+		l := int(binary.LittleEndian.Uint32(b[pos:]))
+		pos += 4
+		if l < 0 || pos+l > len(b) {
+			return
+		}
+		comment := string(b[pos : pos+l])
+		pos += l
+		eq := strings.IndexByte(comment, '=')
+		if eq < 0 {
+			continue
+		}
+		value := comment[eq+1:]
+		switch strings.ToUpper(comment[:eq]) {
+		case "TITLE":
+			tag.Title = value
+		case "ARTIST":
+			if tag.Artist == "" {
+				tag.Artist = value
+			}
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			tag.AlbumArtist = value
+		case "ALBUM":
+			tag.Album = value
+		case "TRACKNUMBER":
+			tag.Track = parseNumber(value)
+		case "DATE", "YEAR":
+			tag.Year = parseNumber(value)
+		}
+	}
+}
+
+// readFLACPicture read the picture block in FLAC, also used in METADATA_BLOCK_PICTURE of Ogg
+func readFLACPicture(b []byte, tag *AudioTag) {
+	if tag.Cover != nil || len(b) < 8 {
+		return
+	}
+	pos := 4
+	mimeLen := int(binary.BigEndian.Uint32(b[pos:]))
+	pos += 4
+	if pos+mimeLen+4 > len(b) {
+		return
+	}
+	mime := strings.ToLower(string(b[pos : pos+mimeLen]))
+	pos += mimeLen
+	descLen := int(binary.BigEndian.Uint32(b[pos:]))
+	// Skip description, width, height, depth and colors
+	pos += 4 + descLen + 16
+	if pos+4 > len(b) {
+		return
+	}
+	dataLen := int(binary.BigEndian.Uint32(b[pos:]))
+	pos += 4
+	if pos+dataLen > len(b) {
+		return
+	}
+	if !strings.HasPrefix(mime, "image/") {
+		mime = "image/jpeg"
+	}
+	tag.Cover = b[pos : pos+dataLen]
+	tag.CoverMime = mime
+}
+
+// readFLAC read the metadata blocks of FLAC
+func readFLAC(content []byte, tag *AudioTag) error {
+	pos := 4
+	for pos+4 <= len(content) {
+		last := content[pos]&0x80 != 0
+		blockType := content[pos] & 0x7f
+		length := int(content[pos+1])<<16 | int(content[pos+2])<<8 | int(content[pos+3])
+		pos += 4
+		if pos+length > len(content) {
+			return errUnknownAudioFormat
+		}
+		block := content[pos : pos+length]
+		switch blockType {
+		case 0:
+			// STREAMINFO
+			if len(block) >= 18 {
+				sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+				samples := uint64(block[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(block[14:18]))
+				if sampleRate > 0 {
+					tag.Duration = int(samples / uint64(sampleRate))
+				}
+			}
+		case 4:
+			readVorbisComment(block, tag)
+		case 6:
+			readFLACPicture(block, tag)
+		}
+		pos += length
+		if last {
+			break
+		}
+	}
+	return nil
+}
+
+// readOggPackets read the first count packets in the Ogg stream and the last granule position
+func readOggPackets(content []byte, count int) (packets [][]byte, lastGranule uint64) {
+	var packet []byte
+	pos := 0
+	for pos+27 <= len(content) && bytes.Equal(content[pos:pos+4], []byte("OggS")) {
+		granule := binary.LittleEndian.Uint64(content[pos+6:])
+		if granule != ^uint64(0) {
+			lastGranule = granule
+		}
+		segments := int(content[pos+26])
+		if pos+27+segments > len(content) {
+			break
+		}
+		table := content[pos+27 : pos+27+segments]
+		pos += 27 + segments
+		for _, l := range table {
+			if pos+int(l) > len(content) {
+				return
+			}
+			if len(packets) < count {
+				packet = append(packet, content[pos:pos+int(l)]...)
+				if l < 255 {
+					packets = append(packets, packet)
+					packet = nil
+				}
+			}
+			pos += int(l)
+		}
+	}
+	return
+}
+
+// readOgg read the comment header of Ogg Vorbis or Opus
+func readOgg(content []byte, tag *AudioTag) error {
+	packets, lastGranule := readOggPackets(content, 2)
+	if len(packets) < 2 {
+		return errUnknownAudioFormat
+	}
+	var sampleRate uint64
+	var comment []byte
+	switch {
+	case bytes.HasPrefix(packets[0], []byte("\x01vorbis")) && len(packets[0]) >= 16:
+		sampleRate = uint64(binary.LittleEndian.Uint32(packets[0][12:]))
+		if bytes.HasPrefix(packets[1], []byte("\x03vorbis")) {
+			comment = packets[1][7:]
+		}
+	case bytes.HasPrefix(packets[0], []byte("OpusHead")):
+		// Opus always uses 48 kHz granule position
+		sampleRate = 48000
+		if bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+			comment = packets[1][8:]
+		}
+	default:
+		return errUnknownAudioFormat
+	}
+	readVorbisComment(comment, tag)
+	if sampleRate > 0 {
+		tag.Duration = int(lastGranule / sampleRate)
+	}
+	return nil
+}
+
+// maxMP4AtomDepth the deepest container atom walked, the metadata is at /moov/udta/meta/ilst/<name>,
+// so a file nesting the containers deeper cannot exhaust the stack
+const maxMP4AtomDepth = 8
+
+// readMP4Atoms walk the atoms in MP4 and call fn with the path of each atom
+func readMP4Atoms(b []byte, parent string, depth int, fn func(path string, data []byte)) {
+	if depth > maxMP4AtomDepth {
+		return
+	}
+	pos := 0
+	for pos+8 <= len(b) {
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		name := string(b[pos+4 : pos+8])
+		headerLen := 8
+		if size == 1 && pos+16 <= len(b) {
+			// Checked before the conversion, a huge 64-bit size would overflow int
+			largeSize := binary.BigEndian.Uint64(b[pos+8:])
+			if largeSize > uint64(len(b)) {
+				return
+			}
+			size = int(largeSize)
+			headerLen = 16
+		} else if size == 0 {
+			size = len(b) - pos
+		}
+		if size < headerLen || size > len(b)-pos {
+			return
+		}
+		data := b[pos+headerLen : pos+size]
+		p := parent + "/" + name
+		fn(p, data)
+		switch name {
+		case "moov", "udta", "ilst", "trak", "mdia":
+			readMP4Atoms(data, p, depth+1, fn)
+		case "meta":
+			// meta has 4 bytes version and flags
+			if len(data) > 4 {
+				readMP4Atoms(data[4:], p, depth+1, fn)
+			}
+		}
+		pos += size
+	}
+}
+
+// readMP4 read the iTunes metadata in MP4
+func readMP4(content []byte, tag *AudioTag) error {
+	const ilst = "/moov/udta/meta/ilst/"
+	readMP4Atoms(content, "", 0, func(p string, data []byte) {
+		if p == "/moov/mvhd" && len(data) >= 20 {
+			if data[0] == 1 && len(data) >= 32 {
+				timescale := binary.BigEndian.Uint32(data[20:])
+				duration := binary.BigEndian.Uint64(data[24:])
+				if timescale > 0 {
+					tag.Duration = int(duration / uint64(timescale))
+				}
+			} else {
+				timescale := binary.BigEndian.Uint32(data[12:])
+				duration := binary.BigEndian.Uint32(data[16:])
+				if timescale > 0 {
+					tag.Duration = int(duration / timescale)
+				}
+			}
+			return
+		}
+		if !strings.HasPrefix(p, ilst) {
+			return
+		}
+		name := strings.TrimPrefix(p, ilst)
+		// The value is in the data atom: size, "data", type (4 bytes), locale (4 bytes), value
+		if len(data) < 16 || string(data[4:8]) != "data" {
+			return
+		}
+		dataSize := int(binary.BigEndian.Uint32(data))
+		if dataSize < 16 || dataSize > len(data) {
+			return
+		}
+		dataType := binary.BigEndian.Uint32(data[8:]) & 0xffffff
+		value := data[16:dataSize]
+		switch name {
+		case "\xa9nam":
+			tag.Title = string(value)
+		case "\xa9ART":
+			tag.Artist = string(value)
+		case "aART":
+			tag.AlbumArtist = string(value)
+		case "\xa9alb":
+			tag.Album = string(value)
+		case "\xa9day":
+			tag.Year = parseNumber(string(value))
+		case "trkn":
+			if len(value) >= 4 {
+				tag.Track = int(binary.BigEndian.Uint16(value[2:]))
+			}
+		case "covr":
+			if tag.Cover == nil {
+				tag.Cover = value
+				if dataType == 14 {
+					tag.CoverMime = "image/png"
+				} else {
+					tag.CoverMime = "image/jpeg"
+				}
+			}
+		}
+	})
+	return nil
+}
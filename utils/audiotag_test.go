@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// mp4Atom build an atom with the 32-bit size
+func mp4Atom(name string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], name)
+	return append(b, body...)
+}
+
+// mp4LargeAtom build an atom in the 64-bit size form with the given size
+func mp4LargeAtom(name string, size uint64, body []byte) []byte {
+	b := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint32(b, 1)
+	copy(b[4:], name)
+	binary.BigEndian.PutUint64(b[8:], size)
+	return append(b, body...)
+}
+
+// mp4Text build the ilst item with a text data atom
+func mp4Text(name string, value string) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, 1)
+	return mp4Atom(name, mp4Atom("data", data, []byte(value)))
+}
+
+// mp4File build the file with the ilst items
+func mp4File(items ...[]byte) []byte {
+	ftyp := mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	meta := mp4Atom("meta", []byte{0, 0, 0, 0}, mp4Atom("ilst", items...))
+	return append(ftyp, mp4Atom("moov", mp4Atom("udta", meta))...)
+}
+
+// id3Frame build the ID3v2.3 text frame in ISO-8859-1
+func id3Frame(id string, value string) []byte {
+	b := make([]byte, 10)
+	copy(b, id)
+	binary.BigEndian.PutUint32(b[4:], uint32(1+len(value)))
+	b = append(b, 0)
+	return append(b, value...)
+}
+
+// id3File build the ID3v2.3 tag with the frames, followed by no audio data
+func id3File(frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	size := len(body)
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(header, body...)
+}
+
+func TestReadAudioTag(t *testing.T) {
+	id3v1 := make([]byte, 128)
+	copy(id3v1, "TAG")
+	copy(id3v1[3:], "Old Title")
+	copy(id3v1[33:], "Old Artist")
+	copy(id3v1[93:], "1999")
+	id3v1[126] = 7
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    AudioTag
+		wantErr bool
+	}{
+		{
+			name:    "mp4",
+			content: mp4File(mp4Text("\xa9nam", "Title"), mp4Text("\xa9ART", "Artist"), mp4Text("\xa9day", "2020-01-02")),
+			want:    AudioTag{Title: "Title", Artist: "Artist", Year: 2020},
+		},
+		{
+			name:    "mp4 64-bit size overflowing int",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), mp4LargeAtom("moov", 0x7FFFFFFFFFFFFFFF, nil)...),
+		},
+		{
+			name:    "mp4 64-bit size above the content",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), mp4LargeAtom("moov", 1<<20, make([]byte, 32))...),
+		},
+		{
+			name:    "mp4 64-bit size below the header",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), mp4LargeAtom("moov", 8, make([]byte, 32))...),
+		},
+		{
+			name:    "mp4 64-bit size truncated",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), 0, 0, 0, 1, 'm', 'o', 'o', 'v', 0, 0),
+		},
+		{
+			name:    "mp4 size above the content",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), 0xff, 0xff, 0xff, 0xff, 'm', 'o', 'o', 'v'),
+		},
+		{
+			name:    "mp4 data atom size above the item",
+			content: mp4File(mp4Atom("\xa9nam", []byte{0, 0, 0xff, 0xff, 'd', 'a', 't', 'a', 0, 0, 0, 1, 0, 0, 0, 0})),
+		},
+		{
+			name:    "mp4 nested too deep",
+			content: append(mp4Atom("ftyp", []byte("M4A ")), deepMP4Atoms(10000)...),
+		},
+		{
+			name:    "id3v2",
+			content: id3File(id3Frame("TIT2", "Title"), id3Frame("TPE1", "Artist"), id3Frame("TRCK", "3/12")),
+			want:    AudioTag{Title: "Title", Artist: "Artist", Track: 3},
+		},
+		{
+			name:    "id3v2 size above the content",
+			content: []byte{'I', 'D', '3', 3, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f},
+			wantErr: true,
+		},
+		{
+			name:    "id3v2 truncated header",
+			content: []byte("ID3\x03"),
+			wantErr: true,
+		},
+		{
+			name:    "id3v2 frame size above the tag",
+			content: id3File([]byte{'T', 'I', 'T', '2', 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 'x'}),
+		},
+		{
+			name:    "id3v2 extended header size above the tag",
+			content: []byte{'I', 'D', '3', 3, 0, 0x40, 0, 0, 0, 12, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    "id3v1",
+			content: append([]byte{0xff, 0xfb, 0x90, 0x00}, id3v1...),
+			want:    AudioTag{Title: "Old Title", Artist: "Old Artist", Year: 1999, Track: 7},
+		},
+		{
+			name:    "flac truncated",
+			content: []byte("fLaC\x04\x00\x00"),
+		},
+		{
+			name:    "flac block size above the content",
+			content: []byte("fLaC\x84\xff\xff\xff\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "ogg truncated",
+			content: []byte("OggS\x00\x02"),
+			wantErr: true,
+		},
+		{
+			name:    "unknown",
+			content: []byte("not audio"),
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			content: nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag, err := ReadAudioTag(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadAudioTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tag.Title != tt.want.Title || tag.Artist != tt.want.Artist || tag.Year != tt.want.Year ||
+				tag.Track != tt.want.Track {
+				t.Errorf("ReadAudioTag() = %+v, want %+v", *tag, tt.want)
+			}
+		})
+	}
+}
+
+// deepMP4Atoms build the moov atoms nested n levels
+func deepMP4Atoms(n int) []byte {
+	b := mp4Atom("moov")
+	for i := 1; i < n; i++ {
+		b = mp4Atom("moov", b)
+	}
+	return b
+}
+
+func TestReadAudioTagTruncated(t *testing.T) {
+	// Every prefix of a valid file is malformed input, none of them should panic
+	files := [][]byte{
+		mp4File(mp4Text("\xa9nam", "Title"), mp4Text("trkn", "\x00\x00\x00\x05\x00\x0c")),
+		id3File(id3Frame("TIT2", "Title"), id3Frame("TALB", "Album")),
+	}
+	for _, file := range files {
+		for i := range file {
+			_, _ = ReadAudioTag(file[:i])
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"strings"
 	"sync"
 )
 
@@ -14,8 +17,18 @@ type Config struct {
 	DBPassword    string `json:"db_password"`
 	DBName        string `json:"db_name"`
 	ListenAddress string `json:"listen_address"`
+	// FileTypes extend or override the mapping from extension (e.g. ".ts") to the type of file
+	FileTypes map[string]string `json:"file_types,omitempty"`
+	// MasterKeyFile the file containing the 256-bit master key in hex, which encrypts the blobs at rest
+	// for the users without encryption. It can also be set by the HOME_CLOUD_MASTER_KEY environment variable
+	MasterKeyFile string `json:"master_key_file,omitempty"`
+	// AllowPrivateWebhooks allow the webhooks to be delivered to loopback, private and link-local addresses
+	AllowPrivateWebhooks bool `json:"allow_private_webhooks,omitempty"`
 }
 
+// masterKeyEnv the environment variable of the master key in hex, it takes precedence over the key file
+const masterKeyEnv = "HOME_CLOUD_MASTER_KEY"
+
 var globalConfig *Config
 var configOnce sync.Once
 
@@ -39,6 +52,25 @@ func loadConfig() {
 		panic("Parse config.json error: missing some required fields. " +
 			"Please check the file or generate a new one by removing it and running again. ")
 	}
+	fileTypes := make(map[string]string, len(globalConfig.FileTypes))
+	for ext, fileType := range globalConfig.FileTypes {
+		if !strings.HasPrefix(ext, ".") || !validFileType(fileType) {
+			panic("Parse config.json error: invalid file type mapping " + ext + ": " + fileType + ". " +
+				"The extension should start with \".\" and the type should be one of " +
+				strings.Join(FileTypeList, ", ") + ". ")
+		}
+		fileTypes[strings.ToLower(ext)] = fileType
+	}
+	globalConfig.FileTypes = fileTypes
+}
+
+func validFileType(fileType string) bool {
+	for _, t := range FileTypeList {
+		if t == fileType {
+			return true
+		}
+	}
+	return false
 }
 
 // GetConfig return config instance
@@ -46,3 +78,35 @@ func GetConfig() *Config {
 	configOnce.Do(loadConfig)
 	return globalConfig
 }
+
+var masterKey *MasterKey
+var masterKeyOnce sync.Once
+
+func loadMasterKey() {
+	encoded := os.Getenv(masterKeyEnv)
+	source := masterKeyEnv
+	if encoded == "" && GetConfig().MasterKeyFile != "" {
+		source = GetConfig().MasterKeyFile
+		content, err := ioutil.ReadFile(source)
+		if err != nil {
+			panic("Read master key file error: " + err.Error())
+		}
+		encoded = string(content)
+	}
+	if encoded == "" {
+		return
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		panic("Invalid master key in " + source + ". It should be 64 hex characters. ")
+	}
+	if masterKey, err = NewMasterKey(key); err != nil {
+		panic("Load master key error: " + err.Error())
+	}
+}
+
+// GetMasterKey return the master key encrypting the blobs at rest, nil if it is not configured
+func GetMasterKey() *MasterKey {
+	masterKeyOnce.Do(loadMasterKey)
+	return masterKey
+}
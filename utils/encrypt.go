@@ -1,12 +1,22 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"strings"
 )
 
 // This file contains the wrapper functions for encryption and decryption in AEAD mode
@@ -80,6 +90,74 @@ func DecryptEncryptionKey(key []byte, encrypted string) ([]byte, error) {
 	return plainText, nil
 }
 
+// GenerateEscrowKeyPair generate an X25519 key pair for the admin escrow, in hex format
+func GenerateEscrowKeyPair() (publicKey string, privateKey string, err error) {
+	var public, private *[32]byte
+	public, private, err = box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(public[:]), hex.EncodeToString(private[:]), nil
+}
+
+// decodeEscrowKey decode the 32-byte X25519 key in hex format
+func decodeEscrowKey(key string) (*[32]byte, error) {
+	keyBytes, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != 32 {
+		return nil, errors.New("invalid escrow key")
+	}
+	var result [32]byte
+	copy(result[:], keyBytes)
+	return &result, nil
+}
+
+// ValidateEscrowPublicKey check the escrow public key provided by the admin
+func ValidateEscrowPublicKey(publicKey string) bool {
+	_, err := decodeEscrowKey(publicKey)
+	return err == nil
+}
+
+// SealEscrowKey seal the file encryption key to the escrow public key, only the private key can open it
+// return hex encode string of the anonymous sealed box
+func SealEscrowKey(publicKey string, encryptionKey []byte) (string, error) {
+	public, err := decodeEscrowKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	var sealed []byte
+	sealed, err = box.SealAnonymous(nil, encryptionKey, public, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sealed), nil
+}
+
+// OpenEscrowKey open the file encryption key sealed above by the escrow key pair
+func OpenEscrowKey(publicKey string, privateKey string, sealed string) ([]byte, error) {
+	public, err := decodeEscrowKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	var private *[32]byte
+	private, err = decodeEscrowKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	var sealedBytes []byte
+	sealedBytes, err = hex.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, ok := box.OpenAnonymous(nil, sealedBytes, public, private)
+	if !ok {
+		return nil, errors.New("cannot open the escrowed key")
+	}
+	return encryptionKey, nil
+}
+
 // EncryptFileAES used to encrypt uploaded files in AES
 func EncryptFileAES(key []byte, fileContent []byte) ([]byte, error) {
 	var block cipher.Block
@@ -193,3 +271,285 @@ func DecryptFileXChaCha(key []byte, encryptedContent []byte) (plainText []byte,
 	}
 	return plainText, nil
 }
+
+// EncryptFile encrypt the file content with the algorithm in the user setting
+// 0 will return the original content
+func EncryptFile(algorithm int, key []byte, fileContent []byte) ([]byte, error) {
+	switch algorithm {
+	case 0:
+		return fileContent, nil
+	case 1:
+		return EncryptFileAES(key, fileContent)
+	case 2:
+		return EncryptFileChaCha(key, fileContent)
+	case 3:
+		return EncryptFileXChaCha(key, fileContent)
+	default:
+		return nil, errors.New("unknown algorithm")
+	}
+}
+
+// DecryptFile decrypt the file content with the algorithm in the user setting
+// 0 will return the original content
+func DecryptFile(algorithm int, key []byte, encryptedContent []byte) ([]byte, error) {
+	switch algorithm {
+	case 0:
+		return encryptedContent, nil
+	case 1:
+		return DecryptFileAES(key, encryptedContent)
+	case 2:
+		return DecryptFileChaCha(key, encryptedContent)
+	case 3:
+		return DecryptFileXChaCha(key, encryptedContent)
+	default:
+		return nil, errors.New("unknown algorithm")
+	}
+}
+
+// blobMagic the first bytes of the blobs with a format header
+// Blobs written before the header was introduced start with the nonce or the plain content directly
+var blobMagic = []byte("HCBL")
+
+const (
+	// BlobVersion the version of the blob format header for the blobs encrypted by the file encryption key
+	BlobVersion = 1
+	// BlobVersionEnvelope the version for the blobs encrypted by the data key of their file,
+	// the data key is stored with the file, so KeyID is not used
+	BlobVersionEnvelope = 2
+	// BlobVersionMaster the version for the blobs of the users without encryption encrypted at rest
+	// by the master key of the instance, KeyID is the fingerprint of the master key
+	BlobVersionMaster = 3
+	// BlobVersionClient the version for the blobs encrypted by the client in the vault mode, the content is stored
+	// as uploaded and the data key wrapped by the client is stored with the file
+	BlobVersionClient = 4
+	// BlobAlgorithmClient the algorithm of the client blobs, it is unknown to the server
+	BlobAlgorithmClient = 255
+	// BlobHeaderSize magic (4 bytes), version (1 byte), algorithm (1 byte), chunk size (4 bytes) and key ID (4 bytes)
+	BlobHeaderSize = 14
+)
+
+// BlobHeader the format header stored before the content of every blob
+type BlobHeader struct {
+	Version int
+	// Algorithm 0 for plain content, others are the same as the user encryption setting
+	Algorithm int
+	// ChunkSize 0 if the whole content is sealed at once
+	ChunkSize uint32
+	// KeyID the ID of the file encryption key of the user, 0 for the first key
+	KeyID uint32
+}
+
+// Marshal encode the header in big endian
+func (header *BlobHeader) Marshal() []byte {
+	buf := make([]byte, BlobHeaderSize)
+	copy(buf, blobMagic)
+	buf[4] = byte(header.Version)
+	buf[5] = byte(header.Algorithm)
+	binary.BigEndian.PutUint32(buf[6:10], header.ChunkSize)
+	binary.BigEndian.PutUint32(buf[10:14], header.KeyID)
+	return buf
+}
+
+// ParseBlobHeader split the header and the content of the blob
+// ok is false if the blob has no header, i.e. it is written before the header was introduced
+func ParseBlobHeader(blob []byte) (header *BlobHeader, content []byte, ok bool) {
+	if len(blob) < BlobHeaderSize || !bytes.Equal(blob[:4], blobMagic) {
+		return nil, blob, false
+	}
+	header = &BlobHeader{
+		Version:   int(blob[4]),
+		Algorithm: int(blob[5]),
+		ChunkSize: binary.BigEndian.Uint32(blob[6:10]),
+		KeyID:     binary.BigEndian.Uint32(blob[10:14]),
+	}
+	// A legacy plain blob may start with the magic by chance
+	if header.Version == BlobVersionClient {
+		if header.Algorithm != BlobAlgorithmClient {
+			return nil, blob, false
+		}
+	} else if (header.Version != BlobVersion && header.Version != BlobVersionEnvelope && header.Version != BlobVersionMaster) ||
+		header.Algorithm < 0 || header.Algorithm > 3 {
+		return nil, blob, false
+	}
+	return header, blob[BlobHeaderSize:], true
+}
+
+// EncryptBlob encrypt the content with the algorithm and prefix the format header
+// keyID is the ID of the key, so the blob can be read during key rotation
+func EncryptBlob(algorithm int, keyID uint32, key []byte, content []byte) ([]byte, error) {
+	encrypted, err := EncryptFile(algorithm, key, content)
+	if err != nil {
+		return nil, err
+	}
+	header := &BlobHeader{Version: BlobVersion, Algorithm: algorithm, KeyID: keyID}
+	return append(header.Marshal(), encrypted...), nil
+}
+
+// EncryptEnvelopeBlob encrypt the content with the data key of the file and prefix the format header
+func EncryptEnvelopeBlob(algorithm int, dataKey []byte, content []byte) ([]byte, error) {
+	encrypted, err := EncryptFile(algorithm, dataKey, content)
+	if err != nil {
+		return nil, err
+	}
+	header := &BlobHeader{Version: BlobVersionEnvelope, Algorithm: algorithm}
+	return append(header.Marshal(), encrypted...), nil
+}
+
+// IsEnvelopeBlob return true if the blob is encrypted by the data key of its file
+func IsEnvelopeBlob(blob []byte) bool {
+	header, _, ok := ParseBlobHeader(blob)
+	return ok && header.Version == BlobVersionEnvelope
+}
+
+// IsMasterBlob return true if the blob is encrypted at rest by the master key
+func IsMasterBlob(blob []byte) bool {
+	header, _, ok := ParseBlobHeader(blob)
+	return ok && header.Version == BlobVersionMaster
+}
+
+// WrapClientBlob prefix the format header to the content encrypted by the client
+func WrapClientBlob(content []byte) []byte {
+	header := &BlobHeader{Version: BlobVersionClient, Algorithm: BlobAlgorithmClient}
+	return append(header.Marshal(), content...)
+}
+
+// IsClientBlob return true if the blob is encrypted by the client in the vault mode
+func IsClientBlob(blob []byte) bool {
+	header, _, ok := ParseBlobHeader(blob)
+	return ok && header.Version == BlobVersionClient
+}
+
+// MasterKey the master key of the instance, the blobs are encrypted by a key derived from it,
+// so the master key itself is never used directly
+type MasterKey struct {
+	blobKey []byte
+	// ID the fingerprint of the master key saved in the blob header, to tell a wrong key from a corrupted blob
+	ID uint32
+}
+
+// NewMasterKey derive the blob key and the fingerprint from the 256-bit master key
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	keys := make([]byte, 36)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, key, []byte{}, []byte("HOME-CLOUD-AT-REST")), keys); err != nil {
+		return nil, err
+	}
+	return &MasterKey{blobKey: keys[:32], ID: binary.BigEndian.Uint32(keys[32:])}, nil
+}
+
+// EncryptBlob encrypt the content at rest in XChaCha20-Poly1305, the random nonce is safe for any number of blobs
+func (mk *MasterKey) EncryptBlob(content []byte) ([]byte, error) {
+	encrypted, err := EncryptFileXChaCha(mk.blobKey, content)
+	if err != nil {
+		return nil, err
+	}
+	header := &BlobHeader{Version: BlobVersionMaster, Algorithm: 3, KeyID: mk.ID}
+	return append(header.Marshal(), encrypted...), nil
+}
+
+// DecryptBlob decrypt the blob encrypted at rest
+func (mk *MasterKey) DecryptBlob(blob []byte) ([]byte, error) {
+	header, content, ok := ParseBlobHeader(blob)
+	if !ok || header.Version != BlobVersionMaster {
+		return nil, errors.New("not encrypted by the master key")
+	}
+	if header.KeyID != mk.ID {
+		return nil, errors.New("encrypted by another master key")
+	}
+	return DecryptFile(header.Algorithm, mk.blobKey, content)
+}
+
+// GetBlobAlgorithm return the algorithm in the header of the blob and the content after the header
+// Blobs without a header are encrypted with legacyAlgorithm
+func GetBlobAlgorithm(legacyAlgorithm int, blob []byte) (int, []byte) {
+	header, content, ok := ParseBlobHeader(blob)
+	if !ok {
+		return legacyAlgorithm, blob
+	}
+	return header.Algorithm, content
+}
+
+// GetBlobKeyID return the key ID in the header of the blob, blobs without a header use the first key 0
+// It is meaningless for the envelope blobs
+func GetBlobKeyID(blob []byte) uint32 {
+	header, _, ok := ParseBlobHeader(blob)
+	if !ok {
+		return 0
+	}
+	return header.KeyID
+}
+
+// GenerateFileEncryptionKey generate a random 256-bit file encryption key
+func GenerateFileEncryptionKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encryptedNamePrefix the prefix of the encrypted names, ":" is not allowed in the names from users,
+// so a plain name will never be taken as an encrypted one
+const encryptedNamePrefix = "~:"
+
+// MaxEncryptedNameLength the maximum length in bytes of a name to be encrypted, the encrypted name
+// (prefix, 12-byte nonce, 16-byte tag in base64) should fit the 191 characters of the name column
+const MaxEncryptedNameLength = 113
+
+// NameCipher encrypt the names of files and folders deterministically, so the same name in the same folder
+// is always encrypted to the same value and the unique index and the lookup by path still work.
+// The nonce is the HMAC of the name (synthetic IV), so only the equality of names is revealed
+type NameCipher struct {
+	macKey []byte
+	aead   cipher.AEAD
+}
+
+// NewNameCipher derive the keys of the cipher from the 256-bit name key
+func NewNameCipher(nameKey []byte) (*NameCipher, error) {
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, nameKey, []byte{}, []byte("HOME-CLOUD-FILE-NAMES")), keys); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[32:])
+	if err != nil {
+		return nil, err
+	}
+	var gcm cipher.AEAD
+	if gcm, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return &NameCipher{macKey: keys[:32], aead: gcm}, nil
+}
+
+// EncryptName encrypt the name, the result is prefixed and encoded in base64 without "/"
+func (nc *NameCipher) EncryptName(name string) (string, error) {
+	if len(name) > MaxEncryptedNameLength {
+		return "", errors.New("name too long")
+	}
+	mac := hmac.New(sha256.New, nc.macKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:nc.aead.NonceSize()]
+	sealed := nc.aead.Seal(nonce, nonce, []byte(name), nil)
+	return encryptedNamePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptName decrypt the name encrypted above, ok is false if it is not encrypted or cannot be decrypted
+func (nc *NameCipher) DecryptName(encrypted string) (name string, ok bool) {
+	if !IsEncryptedName(encrypted) {
+		return encrypted, false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted[len(encryptedNamePrefix):])
+	if err != nil || len(sealed) < nc.aead.NonceSize() {
+		return encrypted, false
+	}
+	var plain []byte
+	plain, err = nc.aead.Open(nil, sealed[:nc.aead.NonceSize()], sealed[nc.aead.NonceSize():], nil)
+	if err != nil {
+		return encrypted, false
+	}
+	return string(plain), true
+}
+
+// IsEncryptedName check whether the stored name is encrypted
+func IsEncryptedName(name string) bool {
+	return strings.HasPrefix(name, encryptedNamePrefix)
+}
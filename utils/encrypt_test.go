@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseBlobHeader(t *testing.T) {
+	content := []byte("content")
+	tests := []struct {
+		name   string
+		header BlobHeader
+	}{
+		{"plain", BlobHeader{Version: BlobVersion}},
+		{"aes", BlobHeader{Version: BlobVersion, Algorithm: 1, KeyID: 7}},
+		{"xchacha chunked", BlobHeader{Version: BlobVersion, Algorithm: 3, ChunkSize: 1 << 20, KeyID: 0xFFFFFFFF}},
+		{"envelope", BlobHeader{Version: BlobVersionEnvelope, Algorithm: 2}},
+		{"master", BlobHeader{Version: BlobVersionMaster, Algorithm: 3, KeyID: 42}},
+		{"client", BlobHeader{Version: BlobVersionClient, Algorithm: BlobAlgorithmClient}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, rest, ok := ParseBlobHeader(append(tt.header.Marshal(), content...))
+			if !ok {
+				t.Fatal("ParseBlobHeader() ok = false, want true")
+			}
+			if *header != tt.header {
+				t.Errorf("ParseBlobHeader() = %+v, want %+v", *header, tt.header)
+			}
+			if !bytes.Equal(rest, content) {
+				t.Errorf("ParseBlobHeader() content = %q, want %q", rest, content)
+			}
+		})
+	}
+}
+
+func TestParseBlobHeaderMalformed(t *testing.T) {
+	valid := (&BlobHeader{Version: BlobVersion, Algorithm: 1}).Marshal()
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{"empty", nil},
+		{"magic only", []byte("HCBL")},
+		{"truncated", valid[:BlobHeaderSize-1]},
+		{"other magic", append([]byte("HCBX"), valid[4:]...)},
+		{"unknown version", (&BlobHeader{Version: 9}).Marshal()},
+		{"unknown algorithm", (&BlobHeader{Version: BlobVersion, Algorithm: 4}).Marshal()},
+		{"algorithm out of range", (&BlobHeader{Version: BlobVersion, Algorithm: 255}).Marshal()},
+		{"client with a known algorithm", (&BlobHeader{Version: BlobVersionClient, Algorithm: 1}).Marshal()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Taken as a legacy blob without a header
+			header, rest, ok := ParseBlobHeader(tt.blob)
+			if ok || header != nil {
+				t.Errorf("ParseBlobHeader() = %+v, want no header", header)
+			}
+			if !bytes.Equal(rest, tt.blob) {
+				t.Errorf("ParseBlobHeader() content = %q, want the whole blob", rest)
+			}
+			if algorithm, _ := GetBlobAlgorithm(2, tt.blob); algorithm != 2 {
+				t.Errorf("GetBlobAlgorithm() = %d, want the legacy algorithm 2", algorithm)
+			}
+			if keyID := GetBlobKeyID(tt.blob); keyID != 0 {
+				t.Errorf("GetBlobKeyID() = %d, want 0", keyID)
+			}
+		})
+	}
+}
+
+func TestEncryptBlob(t *testing.T) {
+	key, err := GenerateFileEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("the content of the file")
+	for algorithm := 0; algorithm <= 3; algorithm++ {
+		blob, err := EncryptBlob(algorithm, 5, key, content)
+		if err != nil {
+			t.Fatalf("EncryptBlob(%d) error = %v", algorithm, err)
+		}
+		got, rest := GetBlobAlgorithm(0, blob)
+		if got != algorithm {
+			t.Errorf("GetBlobAlgorithm() = %d, want %d", got, algorithm)
+		}
+		if keyID := GetBlobKeyID(blob); keyID != 5 {
+			t.Errorf("GetBlobKeyID() = %d, want 5", keyID)
+		}
+		var plain []byte
+		if plain, err = DecryptFile(got, key, rest); err != nil || !bytes.Equal(plain, content) {
+			t.Errorf("DecryptFile(%d) = %q, %v, want %q", algorithm, plain, err, content)
+		}
+		if algorithm == 0 {
+			continue
+		}
+		tampered := append([]byte{}, rest...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err = DecryptFile(algorithm, key, tampered); err == nil {
+			t.Errorf("DecryptFile(%d) of the tampered content error = nil", algorithm)
+		}
+		// Shorter than the nonce, it must fail without panicking
+		for _, truncated := range [][]byte{nil, rest[:8], rest[:len(rest)-1]} {
+			if _, err = DecryptFile(algorithm, key, truncated); err == nil {
+				t.Errorf("DecryptFile(%d) of %d bytes error = nil", algorithm, len(truncated))
+			}
+		}
+	}
+}
+
+func TestEnvelopeAndClientBlob(t *testing.T) {
+	dataKey, _ := GenerateFileEncryptionKey()
+	blob, err := EncryptEnvelopeBlob(1, dataKey, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEnvelopeBlob(blob) || IsMasterBlob(blob) || IsClientBlob(blob) {
+		t.Error("EncryptEnvelopeBlob() is not only an envelope blob")
+	}
+	client := WrapClientBlob([]byte("sealed by the client"))
+	if !IsClientBlob(client) || IsEnvelopeBlob(client) {
+		t.Error("WrapClientBlob() is not only a client blob")
+	}
+	if algorithm, rest := GetBlobAlgorithm(0, client); algorithm != BlobAlgorithmClient ||
+		string(rest) != "sealed by the client" {
+		t.Errorf("GetBlobAlgorithm() = %d %q", algorithm, rest)
+	}
+}
+
+func TestMasterKey(t *testing.T) {
+	key, _ := GenerateFileEncryptionKey()
+	otherKey, _ := GenerateFileEncryptionKey()
+	mk, err := NewMasterKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewMasterKey(otherKey)
+	var blob []byte
+	if blob, err = mk.EncryptBlob([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if !IsMasterBlob(blob) {
+		t.Error("IsMasterBlob() = false, want true")
+	}
+	var plain []byte
+	if plain, err = mk.DecryptBlob(blob); err != nil || string(plain) != "content" {
+		t.Errorf("DecryptBlob() = %q, %v, want content", plain, err)
+	}
+	if _, err = other.DecryptBlob(blob); err == nil {
+		t.Error("DecryptBlob() by another master key error = nil")
+	}
+	if _, err = mk.DecryptBlob(blob[:BlobHeaderSize+4]); err == nil {
+		t.Error("DecryptBlob() of the truncated blob error = nil")
+	}
+	if _, err = mk.DecryptBlob([]byte("plain content")); err == nil {
+		t.Error("DecryptBlob() of a plain blob error = nil")
+	}
+}
+
+func TestNameCipher(t *testing.T) {
+	nameKey, _ := GenerateFileEncryptionKey()
+	nc, err := NewNameCipher(nameKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"ascii", "report.pdf", false},
+		{"unicode", "照片 2021 – été.jpg", false},
+		{"empty", "", false},
+		{"longest", strings.Repeat("a", MaxEncryptedNameLength), false},
+		{"too long", strings.Repeat("a", MaxEncryptedNameLength+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := nc.EncryptName(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncryptName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !IsEncryptedName(encrypted) || strings.Contains(encrypted, "/") || len(encrypted) > 191 {
+				t.Errorf("EncryptName() = %q, want a prefixed value without / fitting the name column", encrypted)
+			}
+			// Deterministic, so the names can still be looked up
+			if again, _ := nc.EncryptName(tt.value); again != encrypted {
+				t.Errorf("EncryptName() = %q then %q, want the same value", encrypted, again)
+			}
+			if name, ok := nc.DecryptName(encrypted); !ok || name != tt.value {
+				t.Errorf("DecryptName() = %q, %v, want %q", name, ok, tt.value)
+			}
+		})
+	}
+	a, _ := nc.EncryptName("a.txt")
+	b, _ := nc.EncryptName("b.txt")
+	if a == b {
+		t.Error("EncryptName() of different names are equal")
+	}
+}
+
+func TestNameCipherMalformed(t *testing.T) {
+	nameKey, _ := GenerateFileEncryptionKey()
+	otherKey, _ := GenerateFileEncryptionKey()
+	nc, _ := NewNameCipher(nameKey)
+	other, _ := NewNameCipher(otherKey)
+	encrypted, _ := nc.EncryptName("secret.txt")
+	// The last character may only carry the padding bits
+	tampered := []byte(encrypted)
+	if i := len(tampered) / 2; tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	tests := []struct {
+		name   string
+		cipher *NameCipher
+		value  string
+	}{
+		{"plain name", nc, "secret.txt"},
+		{"prefix only", nc, "~:"},
+		{"not base64", nc, "~:not base64!"},
+		{"shorter than the nonce", nc, encrypted[:10]},
+		{"truncated", nc, encrypted[:len(encrypted)-1]},
+		{"tampered", nc, string(tampered)},
+		{"another key", other, encrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The value is returned as it is, so a name not encrypted yet is still displayed
+			if name, ok := tt.cipher.DecryptName(tt.value); ok || name != tt.value {
+				t.Errorf("DecryptName() = %q, %v, want %q, false", name, ok, tt.value)
+			}
+		})
+	}
+	if IsEncryptedName("secret.txt") || !IsEncryptedName(encrypted) {
+		t.Error("IsEncryptedName() does not tell the encrypted names")
+	}
+}
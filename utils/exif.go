@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+	"time"
+)
+
+// PhotoInfo the information extracted from an image
+type PhotoInfo struct {
+	// TakenAt is nil if the capture date is missing
+	TakenAt     *time.Time
+	CameraMake  string
+	CameraModel string
+	Orientation int
+	Width       int
+	Height      int
+	// Latitude and Longitude are nil if the GPS information is missing
+	Latitude  *float64
+	Longitude *float64
+}
+
+// ExtractPhotoInfo read the dimensions and the EXIF of the image
+// Missing information will be left empty, it will not return error
+func ExtractPhotoInfo(r io.ReadSeeker) *PhotoInfo {
+	info := &PhotoInfo{Orientation: 1}
+	if config, _, err := image.DecodeConfig(r); err == nil {
+		info.Width = config.Width
+		info.Height = config.Height
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return info
+	}
+	x, err := exif.Decode(r)
+	if err != nil {
+		return info
+	}
+	if takenAt, err := x.DateTime(); err == nil {
+		info.TakenAt = &takenAt
+	}
+	info.CameraMake = getExifString(x, exif.Make)
+	info.CameraModel = getExifString(x, exif.Model)
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil && orientation >= 1 && orientation <= 8 {
+			info.Orientation = orientation
+		}
+	}
+	if info.Width == 0 || info.Height == 0 {
+		if tag, err := x.Get(exif.PixelXDimension); err == nil {
+			info.Width, _ = tag.Int(0)
+		}
+		if tag, err := x.Get(exif.PixelYDimension); err == nil {
+			info.Height, _ = tag.Int(0)
+		}
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		info.Latitude = &lat
+		info.Longitude = &long
+	}
+	return info
+}
+
+func getExifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	s = strings.TrimSpace(strings.Trim(s, "\x00"))
+	if len(s) > 100 {
+		s = s[:100]
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// exifEntry an entry of the IFD, value is padded or placed after the IFD by exifSegment
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifSegment build the APP1 segment with the entries in IFD0 in big endian
+func exifSegment(entries ...exifEntry) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	ifd := make([]byte, 2, 2+12*len(entries)+4)
+	binary.BigEndian.PutUint16(ifd, uint16(len(entries)))
+	var data []byte
+	dataOffset := 8 + 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		binary.BigEndian.PutUint16(entry, e.tag)
+		binary.BigEndian.PutUint16(entry[2:], e.typ)
+		binary.BigEndian.PutUint32(entry[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(entry[8:], e.value)
+		} else {
+			binary.BigEndian.PutUint32(entry[8:], uint32(dataOffset+len(data)))
+			data = append(data, e.value...)
+		}
+		ifd = append(ifd, entry...)
+	}
+	ifd = append(ifd, 0, 0, 0, 0)
+	body := append([]byte("Exif\x00\x00"), append(append(tiff, ifd...), data...)...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(body)))
+	return append(segment, body...)
+}
+
+// exifASCII the entry of a NUL terminated string
+func exifASCII(tag uint16, value string) exifEntry {
+	return exifEntry{tag: tag, typ: 2, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+// encodeImage encode a blank image in the format
+func encodeImage(t *testing.T, format string, width int, height int) []byte {
+	var b bytes.Buffer
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	var err error
+	if format == "png" {
+		err = png.Encode(&b, img)
+	} else {
+		err = jpeg.Encode(&b, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// withExif insert the APP1 segment after the SOI marker of the JPEG
+func withExif(jpg []byte, segment []byte) []byte {
+	return append(append(append([]byte{}, jpg[:2]...), segment...), jpg[2:]...)
+}
+
+func TestExtractPhotoInfo(t *testing.T) {
+	jpg := encodeImage(t, "jpeg", 4, 3)
+	segment := exifSegment(
+		exifASCII(0x010F, "Camera Maker"),
+		exifASCII(0x0110, "Model X"),
+		exifEntry{tag: 0x0112, typ: 3, count: 1, value: []byte{0, 6}},
+		exifASCII(0x0132, "2021:05:06 07:08:09"),
+	)
+	takenAt := time.Date(2021, 5, 6, 7, 8, 9, 0, time.Local)
+	badOrientation := exifSegment(exifEntry{tag: 0x0112, typ: 3, count: 1, value: []byte{0, 9}})
+	// The string points far beyond the segment
+	badOffset := exifSegment(exifEntry{tag: 0x010F, typ: 2, count: 0xFFFF, value: make([]byte, 5)})
+
+	tests := []struct {
+		name        string
+		content     []byte
+		width       int
+		height      int
+		orientation int
+		cameraMake  string
+		cameraModel string
+		takenAt     *time.Time
+	}{
+		{name: "png", content: encodeImage(t, "png", 5, 7), width: 5, height: 7, orientation: 1},
+		{name: "jpeg without exif", content: jpg, width: 4, height: 3, orientation: 1},
+		{
+			name: "jpeg with exif", content: withExif(jpg, segment), width: 4, height: 3, orientation: 6,
+			cameraMake: "Camera Maker", cameraModel: "Model X", takenAt: &takenAt,
+		},
+		{name: "orientation out of range", content: withExif(jpg, badOrientation), width: 4, height: 3, orientation: 1},
+		{name: "value offset above the segment", content: withExif(jpg, badOffset), width: 4, height: 3, orientation: 1},
+		{name: "exif truncated", content: withExif(jpg, segment)[:len(segment)], orientation: 1},
+		{name: "jpeg truncated", content: jpg[:10], orientation: 1},
+		{name: "garbage", content: []byte("not an image at all"), orientation: 1},
+		{name: "empty", content: nil, orientation: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := ExtractPhotoInfo(bytes.NewReader(tt.content))
+			if info.Width != tt.width || info.Height != tt.height || info.Orientation != tt.orientation {
+				t.Errorf("ExtractPhotoInfo() = %dx%d orientation %d, want %dx%d orientation %d",
+					info.Width, info.Height, info.Orientation, tt.width, tt.height, tt.orientation)
+			}
+			if info.CameraMake != tt.cameraMake || info.CameraModel != tt.cameraModel {
+				t.Errorf("ExtractPhotoInfo() camera = %q %q, want %q %q",
+					info.CameraMake, info.CameraModel, tt.cameraMake, tt.cameraModel)
+			}
+			if (info.TakenAt == nil) != (tt.takenAt == nil) || info.TakenAt != nil && !info.TakenAt.Equal(*tt.takenAt) {
+				t.Errorf("ExtractPhotoInfo() taken at = %v, want %v", info.TakenAt, tt.takenAt)
+			}
+			if info.Latitude != nil || info.Longitude != nil {
+				t.Errorf("ExtractPhotoInfo() location = %v %v, want none", info.Latitude, info.Longitude)
+			}
+		})
+	}
+}
+
+func TestExtractPhotoInfoTruncated(t *testing.T) {
+	// Every prefix of a valid file is malformed input, none of them should panic
+	jpg := withExif(encodeImage(t, "jpeg", 4, 3), exifSegment(exifASCII(0x010F, "Camera Maker"),
+		exifASCII(0x0132, "2021:05:06 07:08:09")))
+	for i := range jpg {
+		_ = ExtractPhotoInfo(bytes.NewReader(jpg[:i]))
+	}
+}
@@ -1,103 +1,194 @@
 package utils
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
+// fileTypes map extension to its type
+var fileTypes = map[string]string{
+	".py":   "txt",
+	".go":   "txt",
+	".js":   "txt",
+	".ts":   "txt",
+	".rs":   "txt",
+	".html": "txt",
+	".css":  "txt",
+	".c":    "txt",
+	".h":    "txt",
+	".cpp":  "txt",
+	".java": "txt",
+	".sh":   "txt",
+	".json": "txt",
+	".xml":  "txt",
+	".yaml": "txt",
+	".yml":  "txt",
+	".toml": "txt",
+	".ini":  "txt",
+	".csv":  "txt",
+	".log":  "txt",
+	".txt":  "txt",
+	".md":   "md",
+	".mp3":  "audio",
+	".wav":  "audio",
+	".flac": "audio",
+	".wma":  "audio",
+	".ape":  "audio",
+	".aac":  "audio",
+	".m4a":  "audio",
+	".ogg":  "audio",
+	".oga":  "audio",
+	".opus": "audio",
+	".mp4":  "video",
+	".m4v":  "video",
+	".avi":  "video",
+	".mpg":  "video",
+	".wmv":  "video",
+	".mkv":  "video",
+	".webm": "video",
+	".flv":  "video",
+	".mov":  "video",
+	".jpg":  "image",
+	".jpeg": "image",
+	".png":  "image",
+	".svg":  "image",
+	".gif":  "image",
+	".webp": "image",
+	".heic": "image",
+	".bmp":  "image",
+	".zip":  "zip",
+	".7z":   "zip",
+	".rar":  "zip",
+	".tar":  "zip",
+	".gz":   "zip",
+	".doc":  "doc",
+	".docx": "doc",
+	".ppt":  "ppt",
+	".pptx": "ppt",
+	".xls":  "xls",
+	".xlsx": "xls",
+	".pdf":  "pdf",
+	".exe":  "exe",
+}
+
+// FileTypeList all the types of files, used to check the mapping in the config file
+var FileTypeList = []string{"txt", "md", "audio", "video", "image", "zip", "doc", "ppt", "xls", "pdf", "exe", "other"}
+
 // GetFileTypeByName map extension to its type
+// The mapping in the config file will override the default mapping
 func GetFileTypeByName(name string) (fileType string) {
-	switch strings.ToLower(filepath.Ext(name)) {
-	case ".py":
-		fallthrough
-	case ".go":
-		fallthrough
-	case ".js":
-		fallthrough
-	case ".html":
-		fallthrough
-	case ".css":
-		fallthrough
-	case ".c":
-		fallthrough
-	case ".cpp":
-		fallthrough
-	case ".java":
-		fallthrough
-	case ".txt":
-		fileType = "txt"
-	case ".md":
-		fileType = "md"
-	case ".mp3":
-		fallthrough
-	case ".wav":
-		fallthrough
-	case ".flac":
-		fallthrough
-	case ".wma":
-		fallthrough
-	case ".ape":
-		fallthrough
-	case ".aac":
-		fileType = "audio"
-	case ".mp4":
-		fallthrough
-	case ".avi":
-		fallthrough
-	case ".mpg":
-		fallthrough
-	case ".wmv":
-		fallthrough
-	case ".mkv":
-		fallthrough
-	case ".flv":
-		fallthrough
-	case ".mov":
-		fileType = "video"
-	case ".jpg":
-		fallthrough
-	case ".jpeg":
-		fallthrough
-	case ".png":
-		fallthrough
-	case ".svg":
-		fallthrough
-	case ".gif":
-		fallthrough
-	case ".webp":
-		fallthrough
-	case ".heic":
-		fallthrough
-	case ".bmp":
-		fileType = "image"
-	case ".zip":
-		fallthrough
-	case ".7z":
-		fallthrough
-	case ".rar":
-		fallthrough
-	case ".tar":
-		fallthrough
-	case ".gz":
-		fileType = "zip"
-	case ".doc":
-		fallthrough
-	case ".docx":
-		fileType = "doc"
-	case ".ppt":
-		fallthrough
-	case ".pptx":
-		fileType = "ppt"
-	case ".xls":
-		fallthrough
-	case ".xlsx":
-		fileType = "xls"
-	case ".pdf":
-		fileType = "pdf"
-	case ".exe":
-		fileType = "exe"
-	default:
-		fileType = "other"
+	ext := strings.ToLower(filepath.Ext(name))
+	if fileType, ok := GetConfig().FileTypes[ext]; ok {
+		return fileType
+	}
+	if fileType, ok := fileTypes[ext]; ok {
+		return fileType
+	}
+	return "other"
+}
+
+// mimeTypes map extension to the MIME type used when serving the file inline
+var mimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".bmp":  "image/bmp",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".wma":  "audio/x-ms-wma",
+	".ape":  "audio/x-ape",
+	".aac":  "audio/aac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mpg":  "video/mpeg",
+	".wmv":  "video/x-ms-wmv",
+	".mkv":  "video/x-matroska",
+	".flv":  "video/x-flv",
+	".mov":  "video/quicktime",
+	".pdf":  "application/pdf",
+}
+
+// GetMimeTypeByName return the MIME type used to serve the file based on its type, stored MIME type and extension
+// Text files (including html and scripts) will be served as plain text
+// The stored MIME type will only be used if it matches the type of the file
+// Unknown types will return application/octet-stream
+func GetMimeTypeByName(name string, fileType string, mimeType string) string {
+	switch fileType {
+	case "txt":
+		return "text/plain; charset=utf-8"
+	case "md":
+		return "text/markdown; charset=utf-8"
+	case "image", "audio", "video", "pdf":
+		if GetFileTypeByMime(mimeType) == fileType {
+			return mimeType
+		}
+		if mimeType, ok := mimeTypes[strings.ToLower(filepath.Ext(name))]; ok {
+			return mimeType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// GetContentDisposition build the Content-Disposition header value
+// with an ASCII fallback filename and the RFC 5987 encoded UTF-8 filename
+func GetContentDisposition(dispositionType string, filename string) string {
+	var fallback strings.Builder
+	var encoded strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		// attr-char in RFC 5987
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", dispositionType, fallback.String(), encoded.String())
+}
+
+// WriteFileAtomic write the content to a temp file in the same folder and rename it to the path
+// The old content will be kept if the process crashes or an error occurs when writing
+// The temp file is unique, so the concurrent writes of the same path never share it
+func WriteFileAtomic(filePath string, content []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = f.Chmod(perm)
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
 	}
-	return
+	return os.Rename(tmp, filePath)
 }
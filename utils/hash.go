@@ -63,15 +63,22 @@ func GeneratePasswordInfo() (
 	newEncryptionKey string,
 	err error,
 ) {
-	newPass := make([]byte, 4)
-	if _, err = rand.Read(newPass); err != nil {
+	if newPassword, err = GenerateRandomPassword(); err != nil {
 		return
 	}
-	newPassword = hex.EncodeToString(newPass)
 	newAccountSalt, newMacSalt, newSavePassword, newEncryptionKey, err = GeneratePasswordInfoFromPassword(newPassword)
 	return
 }
 
+// GenerateRandomPassword generate a temporary password for the password reset by admins
+func GenerateRandomPassword() (string, error) {
+	newPass := make([]byte, 4)
+	if _, err := rand.Read(newPass); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(newPass), nil
+}
+
 // GeneratePasswordInfoFromPassword Generate authentication information for account with provided password
 // newAccountSalt is encoded in hex and decoded directly
 // because of compatibility with frontend salt generation
@@ -81,6 +88,32 @@ func GeneratePasswordInfoFromPassword(newPassword string) (
 	newSavePassword string,
 	newEncryptionKey string,
 	err error,
+) {
+	var newEncryptKey []byte
+	newAccountSalt, newMacSalt, newSavePassword, newEncryptKey, err = DerivePasswordInfo(newPassword)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	var encryptKey []byte
+	encryptKey, err = hex.DecodeString(GenerateSaltOrKey())
+	if err != nil {
+		return "", "", "", "", err
+	}
+	newEncryptionKey, err = EncryptEncryptionKey(newEncryptKey, encryptKey)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	return
+}
+
+// DerivePasswordInfo Generate authentication information for the provided password in the same way as the frontend
+// newEncryptKey is the key derived from the password, which is used to encrypt the existing file encryption key
+func DerivePasswordInfo(newPassword string) (
+	newAccountSalt string,
+	newMacSalt string,
+	newSavePassword string,
+	newEncryptKey []byte,
+	err error,
 ) {
 	newAccountSalt = GenerateSaltOrKey()
 	newMacSalt = GenerateSaltOrKey()
@@ -88,23 +121,25 @@ func GeneratePasswordInfoFromPassword(newPassword string) (
 	hkdfReader := hkdf.New(sha512.New, newMasterKey, []byte{}, []byte("HOME-CLOUD-AUTH-KEY-FOR-LOGIN"))
 	newAuth := make([]byte, 32)
 	if _, err = io.ReadFull(hkdfReader, newAuth); err != nil {
-		return "", "", "", "", err
+		return "", "", "", nil, err
 	}
 	newAuthKey := hex.EncodeToString(newAuth)
 	newSavePassword = GetHashWithSalt(newAuthKey, newMacSalt)
 	hkdfReader = hkdf.New(sha512.New, newMasterKey, []byte{}, []byte("HOME-CLOUD-ENCRYPTION-KEY-FOR-FILES"))
-	newEncryptKey := make([]byte, 32)
+	newEncryptKey = make([]byte, 32)
 	if _, err = io.ReadFull(hkdfReader, newEncryptKey); err != nil {
-		return "", "", "", "", err
-	}
-	var encryptKey []byte
-	encryptKey, err = hex.DecodeString(GenerateSaltOrKey())
-	if err != nil {
-		return "", "", "", "", err
-	}
-	newEncryptionKey, err = EncryptEncryptionKey(newEncryptKey, encryptKey)
-	if err != nil {
-		return "", "", "", "", err
+		return "", "", "", nil, err
 	}
 	return
 }
+
+// DeriveRecoveryKey derive the key encrypting the file encryption key from the recovery key of the user
+// The recovery key is random, so it is only expanded by HKDF
+func DeriveRecoveryKey(recoveryKey []byte) ([]byte, error) {
+	hkdfReader := hkdf.New(sha512.New, recoveryKey, []byte{}, []byte("HOME-CLOUD-RECOVERY-KEY-FOR-FILES"))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdfReader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"html"
+)
+
+// RenderMarkdown convert the markdown content to an HTML page
+// Raw HTML in the content will be omitted and dangerous links will be removed by goldmark
+// since the unsafe option is not enabled
+func RenderMarkdown(content []byte, title string) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>")
+	buf.WriteString(html.EscapeString(title))
+	buf.WriteString("</title>\n</head>\n<body>\n")
+	if err := goldmark.Convert(content, &buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SniffLength the number of bytes at the beginning of the file used to detect the MIME type
+const SniffLength = 512
+
+// signature the magic bytes at the offset of a file type
+type signature struct {
+	offset   int
+	magic    []byte
+	mimeType string
+}
+
+// signatures the magic bytes not supported or not specific enough in http.DetectContentType
+var signatures = []signature{
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("MAC "), "audio/x-ape"},
+	{0, []byte("OggS"), "audio/ogg"},
+	{0, []byte("\xFF\xF1"), "audio/aac"},
+	{0, []byte("\xFF\xF9"), "audio/aac"},
+	{0, []byte("\x1A\x45\xDF\xA3"), "video/x-matroska"},
+	{0, []byte("FLV\x01"), "video/x-flv"},
+	{0, []byte("\x30\x26\xB2\x75\x8E\x66\xCF\x11"), "video/x-ms-asf"},
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// isoBrands map the major brands of the ISO base media files (the ftyp box) to the MIME types
+// The files of other brands are left to http.DetectContentType
+var isoBrands = map[string]string{
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"M4P ": "audio/mp4",
+	"qt  ": "video/quicktime",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic-sequence",
+	"hevx": "image/heic-sequence",
+	"mif1": "image/heif",
+	"msf1": "image/heif-sequence",
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"iso4": "video/mp4",
+	"iso5": "video/mp4",
+	"iso6": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"M4V ": "video/mp4",
+	"M4VH": "video/mp4",
+	"M4VP": "video/mp4",
+	"f4v ": "video/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// detectISOBrand return the MIME type by the major brand in the ftyp box, empty if it is not known
+func detectISOBrand(head []byte) string {
+	if len(head) < 12 || !bytes.Equal(head[4:8], []byte("ftyp")) {
+		return ""
+	}
+	return isoBrands[string(head[8:12])]
+}
+
+// isPortableExecutable check the DOS header and the PE signature at the offset in the DOS header,
+// so the text starting with "MZ" is not taken as an executable
+func isPortableExecutable(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(head[0x3C:0x40]))
+	return offset >= 0x40 && offset <= len(head)-4 && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// DetectMimeType detect the MIME type from the first bytes of the file
+// It will return application/octet-stream if the type cannot be determined
+func DetectMimeType(head []byte) string {
+	if len(head) > SniffLength {
+		head = head[:SniffLength]
+	}
+	for _, sig := range signatures {
+		if len(head) >= sig.offset+len(sig.magic) && bytes.Equal(head[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.mimeType
+		}
+	}
+	if mimeType := detectISOBrand(head); mimeType != "" {
+		return mimeType
+	}
+	if isPortableExecutable(head) {
+		return "application/vnd.microsoft.portable-executable"
+	}
+	mimeType := http.DetectContentType(head)
+	// Remove parameters like charset except for text
+	if !strings.HasPrefix(mimeType, "text/") {
+		mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	}
+	// The WebM signature in http.DetectContentType is also the signature of matroska
+	if mimeType == "video/webm" {
+		mimeType = "video/x-matroska"
+	}
+	return mimeType
+}
+
+// GetFileTypeByMime map MIME type to the type of file, return empty string for generic MIME types
+// like text/plain or application/octet-stream, which cannot determine the type
+func GetFileTypeByMime(mimeType string) string {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	switch {
+	case mimeType == "image/svg+xml":
+		// svg is detected as text, will only be set by the extension
+		return "image"
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "audio/"), mimeType == "application/ogg":
+		return "audio"
+	case strings.HasPrefix(mimeType, "video/"), mimeType == "video/x-ms-asf":
+		return "video"
+	case mimeType == "application/pdf":
+		return "pdf"
+	case mimeType == "application/zip", mimeType == "application/x-gzip", mimeType == "application/x-rar-compressed",
+		mimeType == "application/x-7z-compressed", mimeType == "application/x-tar":
+		return "zip"
+	case mimeType == "application/vnd.microsoft.portable-executable":
+		return "exe"
+	}
+	return ""
+}
+
+// GetFileType decide the type of the file based on the name and the detected MIME type
+// The mapping in the config file has the highest priority, then the detected content
+// If the content is generic, e.g. plain text, it will fall back to the extension
+func GetFileType(name string, mimeType string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if fileType, ok := GetConfig().FileTypes[ext]; ok {
+		return fileType
+	}
+	byName := GetFileTypeByName(name)
+	byMime := GetFileTypeByMime(mimeType)
+	if byMime == "" {
+		return byName
+	}
+	// Office documents are zip files, audio in mp4 container may be detected as video
+	if byMime == "zip" && (byName == "doc" || byName == "ppt" || byName == "xls") {
+		return byName
+	}
+	if byMime == "video" && byName == "audio" {
+		return byName
+	}
+	return byMime
+}
+
+// GetMimeType return the MIME type stored with the file
+// The extension will be used if the detected MIME type is generic
+func GetMimeType(name string, detected string) string {
+	if GetFileTypeByMime(detected) != "" {
+		return detected
+	}
+	if mimeType, ok := mimeTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return mimeType
+	}
+	if detected == "application/octet-stream" {
+		switch GetFileTypeByName(name) {
+		case "txt":
+			return "text/plain; charset=utf-8"
+		case "md":
+			return "text/markdown; charset=utf-8"
+		}
+	}
+	return detected
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// peHead build the DOS header with the PE signature at the offset
+func peHead(offset uint32, size int) []byte {
+	b := make([]byte, size)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3C:], offset)
+	if int(offset)+4 <= size {
+		copy(b[offset:], "PE\x00\x00")
+	}
+	return b
+}
+
+// ftypHead build the ftyp box with the major brand and the compatible brands
+func ftypHead(brand string, compatible string) []byte {
+	b := make([]byte, 4, 16+len(compatible))
+	binary.BigEndian.PutUint32(b, uint32(16+len(compatible)))
+	b = append(b, "ftyp"+brand+"\x00\x00\x00\x00"...)
+	return append(b, compatible...)
+}
+
+func TestDetectMimeType(t *testing.T) {
+	tar := make([]byte, 262)
+	copy(tar[257:], "ustar")
+	long := make([]byte, SniffLength+100)
+	copy(long[SniffLength:], "ustar")
+
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "audio/flac"},
+		{"ogg", []byte("OggS\x00\x02"), "audio/ogg"},
+		{"7z", []byte("7z\xBC\xAF\x27\x1C\x00\x04"), "application/x-7z-compressed"},
+		{"tar", tar, "application/x-tar"},
+		{"tar truncated", tar[:260], "application/octet-stream"},
+		{"magic after the sniff length", long, "application/octet-stream"},
+		{"avif", ftypHead("avif", "isom"), "image/avif"},
+		{"heic", ftypHead("heic", "isom"), "image/heic"},
+		{"m4a", ftypHead("M4A ", "isom"), "audio/mp4"},
+		{"mp4", ftypHead("isom", "isom"), "video/mp4"},
+		{"unknown brand", ftypHead("abcd", "abcd"), "application/octet-stream"},
+		{"unknown brand compatible with mp4", ftypHead("abcd", "mp41"), "video/mp4"},
+		{"ftyp truncated", []byte("\x00\x00\x00\x18ftyp"), "application/octet-stream"},
+		{"pe", peHead(0x80, 0x84), "application/vnd.microsoft.portable-executable"},
+		{"pe signature truncated", peHead(0x80, 0x82), "application/octet-stream"},
+		{"pe offset above the head", peHead(0xFFFFFFFF, 0x40), "application/octet-stream"},
+		{"pe offset inside the dos header", peHead(0x20, 0x84), "application/octet-stream"},
+		{"text starting with MZ", []byte("MZ is not an executable"), "text/plain; charset=utf-8"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"webm", []byte("\x1A\x45\xDF\xA3\x01\x00\x00\x00"), "video/x-matroska"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectMimeType(tt.head); got != tt.want {
+				t.Errorf("DetectMimeType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetFileTypeByMime(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"image/heic", "image"},
+		{"image/svg+xml", "image"},
+		{"audio/flac", "audio"},
+		{"application/ogg", "audio"},
+		{"video/mp4", "video"},
+		{"video/x-ms-asf", "video"},
+		{"application/pdf", "pdf"},
+		{"application/x-tar", "zip"},
+		{"application/vnd.microsoft.portable-executable", "exe"},
+		{"text/plain; charset=utf-8", ""},
+		{"application/octet-stream", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			if got := GetFileTypeByMime(tt.mimeType); got != tt.want {
+				t.Errorf("GetFileTypeByMime(%q) = %q, want %q", tt.mimeType, got, tt.want)
+			}
+		})
+	}
+}